@@ -0,0 +1,355 @@
+package gcpviz
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cayleygraph/cayley/graph"
+	_ "github.com/cayleygraph/cayley/graph/memstore"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	relations RawResourceRelations
+	labels    map[string]map[string]string
+	styles    []GraphStyle
+	theme     string
+	layout    string
+	override  map[string]string
+	progress  ProgressFunc
+
+	queryTimeout time.Duration
+	queryLimit   int
+}
+
+// Option configures the relations, labels and styles of a graph created with New.
+type Option func(*config) error
+
+func decodeYaml(r io.Reader, out interface{}) error {
+	err := yaml.NewDecoder(r).Decode(out)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// WithRelations sets the relations between asset types.
+func WithRelations(relations RawResourceRelations) Option {
+	return func(c *config) error {
+		c.relations = relations
+		return nil
+	}
+}
+
+// WithRelationsReader reads the relations in YAML format (see relations.yaml).
+func WithRelationsReader(r io.Reader) Option {
+	return func(c *config) error {
+		return errors.Wrap(decodeYaml(r, &c.relations), "error parsing relations")
+	}
+}
+
+// WithRelationsFile reads the relations from a YAML file (see relations.yaml).
+func WithRelationsFile(fileName string) Option {
+	return func(c *config) error {
+		file, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(decodeYaml(bytes.NewReader(file), &c.relations), fmt.Sprintf("error parsing relations file %s", fileName))
+	}
+}
+
+// WithLabels sets the label, headLabel, tailLabel and link templates per asset type.
+func WithLabels(labels map[string]map[string]string) Option {
+	return func(c *config) error {
+		c.labels = labels
+		return nil
+	}
+}
+
+// WithLabelsReader reads the labels in YAML format (see labels.yaml).
+func WithLabelsReader(r io.Reader) Option {
+	return func(c *config) error {
+		return errors.Wrap(decodeYaml(r, &c.labels), "error parsing labels")
+	}
+}
+
+// WithLabelsFile reads the labels from a YAML file (see labels.yaml).
+func WithLabelsFile(fileName string) Option {
+	return func(c *config) error {
+		file, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(decodeYaml(bytes.NewReader(file), &c.labels), fmt.Sprintf("error parsing labels file %s", fileName))
+	}
+}
+
+// WithStyle adds a style layer. Layers are merged in the order they are given.
+func WithStyle(style GraphStyle) Option {
+	return func(c *config) error {
+		c.styles = append(c.styles, style)
+		return nil
+	}
+}
+
+// WithStyleReader reads a style layer in YAML format (see style.yaml).
+func WithStyleReader(r io.Reader) Option {
+	return func(c *config) error {
+		var style GraphStyle
+		if err := decodeYaml(r, &style); err != nil {
+			return errors.Wrap(err, "error parsing style")
+		}
+		c.styles = append(c.styles, style)
+		return nil
+	}
+}
+
+// WithStyleFiles reads style layers from YAML files (see style.yaml), later files
+// override earlier ones.
+func WithStyleFiles(fileNames ...string) Option {
+	return func(c *config) error {
+		for _, fileName := range fileNames {
+			file, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				return err
+			}
+			var style GraphStyle
+			if err := decodeYaml(bytes.NewReader(file), &style); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error parsing style file %s", fileName))
+			}
+			c.styles = append(c.styles, style)
+		}
+		return nil
+	}
+}
+
+// WithTheme applies a built-in color theme on top of the style layers.
+func WithTheme(theme string) Option {
+	return func(c *config) error {
+		c.theme = theme
+		return nil
+	}
+}
+
+// WithStyleOverrides overrides style parameters using SJSON paths (ie. "options.overlap").
+func WithStyleOverrides(override map[string]string) Option {
+	return func(c *config) error {
+		c.override = override
+		return nil
+	}
+}
+
+// New creates a graph engine configured with options.
+func New(options ...Option) (*GcpViz, error) {
+	qs, _ := graph.NewQuadStore("memstore", "", nil)
+	qw, _ := graph.NewQuadWriter("single", qs, nil)
+
+	var c config
+	for _, option := range options {
+		if err := option(&c); err != nil {
+			return nil, err
+		}
+	}
+
+	gcpViz := GcpViz{QS: qs, QW: qw, Progress: c.progress, QueryTimeout: c.queryTimeout, QueryLimit: c.queryLimit}
+
+	err := gcpViz.setRelations(c.relations)
+	if err != nil {
+		return nil, fmt.Errorf("error loading relations map: %v", err)
+	}
+	err = gcpViz.setLabels(c.labels)
+	if err != nil {
+		return nil, fmt.Errorf("error loading labels map: %v", err)
+	}
+	// Options of the layout profile are layered on top of the styles
+	layout, _ := layoutProfile(c.layout)
+	gcpViz.layout = layout
+	styles := append(make([]GraphStyle, 0, len(c.styles)+1), c.styles...)
+	if len(layout.Options) > 0 {
+		styles = append(styles, GraphStyle{Options: layout.Options})
+	}
+	err = gcpViz.setStyle(styles, c.theme, c.override)
+	if err != nil {
+		return nil, fmt.Errorf("error loading styles map: %v", err)
+	}
+	return &gcpViz, nil
+}
+
+// AssetIterator iterates over assets in Cloud Asset Inventory JSON format.
+type AssetIterator interface {
+	Next() bool
+	Asset() []byte
+	Err() error
+}
+
+type sliceAssetIterator struct {
+	assets [][]byte
+	idx    int
+}
+
+// NewSliceAssetIterator returns an iterator over assets in memory.
+func NewSliceAssetIterator(assets [][]byte) AssetIterator {
+	return &sliceAssetIterator{assets: assets, idx: -1}
+}
+
+func (i *sliceAssetIterator) Next() bool {
+	i.idx++
+	return i.idx < len(i.assets)
+}
+
+func (i *sliceAssetIterator) Asset() []byte {
+	return i.assets[i.idx]
+}
+
+func (i *sliceAssetIterator) Err() error {
+	return nil
+}
+
+type readerAssetIterator struct {
+	scanner  *bufio.Scanner
+	position int64
+	line     int64
+}
+
+// newReaderAssetIterator returns an iterator over newline delimited assets.
+func newReaderAssetIterator(r io.Reader) *readerAssetIterator {
+	const bufferSize = 5 * 1024 * 1024 // Length of one line is maximum 5 MB
+
+	scanner := bufio.NewScanner(bufio.NewReader(r))
+	buf := make([]byte, bufferSize)
+	scanner.Buffer(buf, bufferSize)
+	return &readerAssetIterator{scanner: scanner}
+}
+
+func (i *readerAssetIterator) Next() bool {
+	for i.scanner.Scan() {
+		i.line++
+		i.position += int64(len(i.scanner.Bytes())) + 1
+		if len(bytes.TrimSpace(i.scanner.Bytes())) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *readerAssetIterator) Asset() []byte {
+	return i.scanner.Bytes()
+}
+
+func (i *readerAssetIterator) Err() error {
+	return i.scanner.Err()
+}
+
+// AddAssets adds assets to the graph database created with Create. Call EnrichAssets
+// afterwards to create the references between assets.
+func (v *GcpViz) AddAssets(ctx context.Context, iter AssetIterator) error {
+	return v.addAssets(ctx, iter, "", "", nil)
+}
+
+// ReadAssets reads newline delimited assets, like a Cloud Asset Inventory export.
+func (v *GcpViz) ReadAssets(ctx context.Context, r io.Reader, source string) error {
+	return v.addAssets(ctx, newReaderAssetIterator(r), "", source, nil)
+}
+
+// Node is an asset returned by Query, with its rendered label and link.
+type Node struct {
+	ID        int64
+	Name      string
+	AssetType string
+	Parent    string
+	Label     string
+	Link      string
+	Resource  *TemplateResource
+}
+
+// Edge is a relationship between two nodes returned by Query.
+type Edge struct {
+	From      string
+	To        string
+	FromID    int64
+	ToID      int64
+	HeadLabel string
+	TailLabel string
+	Relation  string
+}
+
+func (v *GcpViz) executeLabel(labels map[string]*template.Template, resource *TemplateResource) string {
+	labelTemplate, found := labels[resource.AssetType]
+	if !found || labelTemplate == nil {
+		return ""
+	}
+	var out bytes.Buffer
+	if err := v.executeTemplate(labelTemplate, &out, resource); err != nil {
+		return ""
+	}
+	return strings.Trim(out.String(), "\n")
+}
+
+// Query runs a Gizmo query and returns the nodes that have a label and the edges
+// between them, instead of rendering them as a graph.
+func (v *GcpViz) Query(ctx context.Context, gizmoQuery string, parameters map[string]interface{}) ([]Node, []Edge, error) {
+	if parameters == nil {
+		parameters = make(map[string]interface{}, 0)
+	}
+	gizmoQ, err := v.prepareQuery(gizmoQuery, parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodes := make([]Node, 0)
+	resources := make(map[int64]*TemplateResource, 0)
+	addNode := func(name string, id int64, parent string) {
+		if _, found := resources[id]; found || id == -1 {
+			return
+		}
+		resource, err := v.getAsset(name)
+		if err != nil || v.Labels[resource.AssetType] == nil {
+			return
+		}
+		resources[id] = resource
+		nodes = append(nodes, Node{
+			ID:        id,
+			Name:      name,
+			AssetType: resource.AssetType,
+			Parent:    parent,
+			Label:     v.executeLabel(v.Labels, resource),
+			Link:      v.executeLabel(v.Links, resource),
+			Resource:  resource,
+		})
+	}
+	err = v.executeQuery(ctx, gizmoQ, func(result queryResult) error {
+		addNode(result.parent, result.parentId, "")
+		addNode(result.node, result.id, result.parent)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	edges := make([]Edge, 0)
+	for _, node := range nodes {
+		v.eachUser(node.Name, func(user string, userId int64) {
+			if from, found := resources[userId]; found {
+				edges = append(edges, Edge{
+					From:      user,
+					To:        node.Name,
+					FromID:    userId,
+					ToID:      node.ID,
+					HeadLabel: v.executeLabel(v.HeadLabels, from),
+					TailLabel: v.executeLabel(v.TailLabels, from),
+					Relation:  v.relationBetween(user, node.Name),
+				})
+			}
+		})
+	}
+	return nodes, edges, nil
+}
@@ -0,0 +1,155 @@
+package gcpviz
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+)
+
+// Minimal writer for Avro object container files (uncompressed), supporting the
+// field types used by the export: strings, nullable strings and arrays of strings.
+
+const avroBlockSize = 1000
+
+type avroEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *avroEncoder) writeLong(n int64) {
+	// Zig-zag encoded variable length integer
+	u := uint64((n << 1) ^ (n >> 63))
+	for u >= 0x80 {
+		e.buf.WriteByte(byte(u) | 0x80)
+		u >>= 7
+	}
+	e.buf.WriteByte(byte(u))
+}
+
+func (e *avroEncoder) writeBytes(b []byte) {
+	e.writeLong(int64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *avroEncoder) writeString(s string) {
+	e.writeBytes([]byte(s))
+}
+
+func (e *avroEncoder) writeNullableString(s string) {
+	// Union of null (index 0) and string (index 1)
+	if s == "" {
+		e.writeLong(0)
+		return
+	}
+	e.writeLong(1)
+	e.writeString(s)
+}
+
+func (e *avroEncoder) writeStringArray(a []string) {
+	if len(a) > 0 {
+		e.writeLong(int64(len(a)))
+		for _, s := range a {
+			e.writeString(s)
+		}
+	}
+	e.writeLong(0)
+}
+
+type avroWriter struct {
+	out     io.Writer
+	sync    [16]byte
+	block   avroEncoder
+	records int64
+	fields  []exportField
+}
+
+func newAvroWriter(out io.Writer, name string, fields []exportField) (*avroWriter, error) {
+	w := &avroWriter{out: out, fields: fields}
+	if _, err := rand.Read(w.sync[:]); err != nil {
+		return nil, err
+	}
+
+	schema, err := json.Marshal(avroSchema(name, fields))
+	if err != nil {
+		return nil, err
+	}
+	var header avroEncoder
+	header.buf.WriteString("Obj\x01")
+	header.writeLong(2)
+	header.writeString("avro.schema")
+	header.writeBytes(schema)
+	header.writeString("avro.codec")
+	header.writeBytes([]byte("null"))
+	header.writeLong(0)
+	header.buf.Write(w.sync[:])
+	_, err = out.Write(header.buf.Bytes())
+	return w, err
+}
+
+// Write encodes a record, with values in the order of the schema fields.
+func (w *avroWriter) Write(values map[string]interface{}) error {
+	for _, field := range w.fields {
+		switch field.Type {
+		case "string":
+			s, _ := values[field.Name].(string)
+			w.block.writeString(s)
+		case "nullable":
+			s, _ := values[field.Name].(string)
+			w.block.writeNullableString(s)
+		case "array":
+			a, _ := values[field.Name].([]string)
+			w.block.writeStringArray(a)
+		}
+	}
+	w.records++
+	if w.records >= avroBlockSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+func (w *avroWriter) Flush() error {
+	if w.records == 0 {
+		return nil
+	}
+	var block avroEncoder
+	block.writeLong(w.records)
+	block.writeBytes(w.block.buf.Bytes())
+	block.buf.Write(w.sync[:])
+	if _, err := w.out.Write(block.buf.Bytes()); err != nil {
+		return err
+	}
+	w.block.buf.Reset()
+	w.records = 0
+	return nil
+}
+
+type avroSchemaField struct {
+	Name string      `json:"name"`
+	Type interface{} `json:"type"`
+	Doc  string      `json:"doc,omitempty"`
+}
+
+type avroSchemaRecord struct {
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Fields    []avroSchemaField `json:"fields"`
+}
+
+func avroSchema(name string, fields []exportField) avroSchemaRecord {
+	schema := avroSchemaRecord{Type: "record", Name: name, Namespace: "gcpviz", Fields: make([]avroSchemaField, len(fields))}
+	for idx, field := range fields {
+		var fieldType interface{}
+		switch field.Type {
+		case "string":
+			fieldType = "string"
+		case "nullable":
+			fieldType = []string{"null", "string"}
+		case "array":
+			fieldType = map[string]string{"type": "array", "items": "string"}
+		}
+		schema.Fields[idx] = avroSchemaField{Name: field.Name, Type: fieldType, Doc: field.Description}
+	}
+	return schema
+}
@@ -0,0 +1,195 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cayleygraph/cayley"
+	cquad "github.com/cayleygraph/quad"
+)
+
+// The blast radius of an asset is everything that transitively depends on it: the
+// assets that use it, the assets that use those, and so on. As every asset uses its
+// project, the radius of a project or folder covers all of its resources, unless the
+// traversal is stopped at some asset types.
+
+// BlastRadius lists the assets that depend on Asset, in the order they were reached.
+// Truncated is set if the depth limit was reached while assets at that depth still
+// had dependents.
+type BlastRadius struct {
+	Asset     string             `json:"asset"`
+	AssetType string             `json:"asset_type"`
+	MaxDepth  int                `json:"max_depth,omitempty"`
+	Assets    []BlastRadiusAsset `json:"assets"`
+	Truncated bool               `json:"truncated"`
+}
+
+// BlastRadiusAsset is an affected asset at Depth steps from the asset, reached via
+// the asset it uses. Stopped is set for assets of a stop listed asset type, whose
+// dependents were not followed.
+type BlastRadiusAsset struct {
+	Name      string `json:"name"`
+	AssetType string `json:"asset_type"`
+	Depth     int    `json:"depth"`
+	Via       string `json:"via,omitempty"`
+	Stopped   bool   `json:"stopped,omitempty"`
+}
+
+// resolveAsset returns an asset by name, compute self-link or alias (ie. the email
+// of a service account).
+func (v *GcpViz) resolveAsset(name string) (*TemplateResource, error) {
+	asset, err := v.getAsset(name)
+	if err == nil {
+		return asset, nil
+	}
+	tx, txErr := v.AssetDatabase.Begin(false)
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+	if alias := tx.Bucket([]byte("Aliases")).Get([]byte(name)); alias != nil {
+		return v.getAsset(string(alias))
+	}
+	return nil, err
+}
+
+// users returns the sorted names of the assets that use name.
+func (v *GcpViz) users(name string) []string {
+	users := make([]string, 0)
+	p := cayley.StartPath(v.QS, cquad.String(name)).In("uses")
+	p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
+		if user, ok := cquad.NativeOf(val).(string); ok {
+			users = append(users, user)
+		}
+	})
+	sort.Strings(users)
+	return users
+}
+
+// BlastRadius finds the assets that depend on name, following references in reverse
+// up to maxDepth steps (unlimited if zero). Assets of the stopAssetTypes are included,
+// but not the assets that depend on them.
+func (v *GcpViz) BlastRadius(ctx context.Context, name string, maxDepth int, stopAssetTypes []string) (*BlastRadius, error) {
+	asset, err := v.resolveAsset(name)
+	if err != nil {
+		return nil, fmt.Errorf("asset %s not found in graph: %v", name, err)
+	}
+	stop := make(map[string]bool, len(stopAssetTypes))
+	for _, assetType := range stopAssetTypes {
+		stop[assetType] = true
+	}
+
+	radius := &BlastRadius{Asset: asset.Name, AssetType: asset.AssetType, MaxDepth: maxDepth, Assets: make([]BlastRadiusAsset, 0)}
+	seen := map[string]bool{asset.Name: true}
+	frontier := []string{asset.Name}
+	for depth := 1; len(frontier) > 0; depth++ {
+		next := make([]string, 0)
+		for _, used := range frontier {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			for _, user := range v.users(used) {
+				if seen[user] {
+					continue
+				}
+				userAsset, err := v.getAsset(user)
+				if err != nil {
+					// Not an asset, ie. an IP address
+					continue
+				}
+				if maxDepth > 0 && depth > maxDepth {
+					radius.Truncated = true
+					break
+				}
+				seen[user] = true
+				affected := BlastRadiusAsset{Name: user, AssetType: userAsset.AssetType, Depth: depth, Via: used, Stopped: stop[userAsset.AssetType]}
+				radius.Assets = append(radius.Assets, affected)
+				if !affected.Stopped {
+					next = append(next, user)
+				}
+			}
+		}
+		if radius.Truncated {
+			break
+		}
+		frontier = next
+	}
+	return radius, nil
+}
+
+// QueryParameters returns the parameters for rendering the blast radius with a query
+// (see queries/blast-radius.js): the asset as "asset" and the affected assets as
+// "BlastRadius".
+func (r *BlastRadius) QueryParameters() map[string]interface{} {
+	assets := append([]BlastRadiusAsset{{Name: r.Asset, AssetType: r.AssetType}}, r.Assets...)
+	return map[string]interface{}{
+		"asset":       r.Asset,
+		"BlastRadius": assets,
+	}
+}
+
+// WriteBlastRadius writes the blast radius as a text summary or as JSON.
+func WriteBlastRadius(out io.Writer, radius *BlastRadius, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(radius)
+	}
+	if format != "text" {
+		return fmt.Errorf("unknown blast radius format %s, specify either text, json or dot", format)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Blast radius of %s (%s): %d assets", radius.Asset, radius.AssetType, len(radius.Assets))
+	if radius.Truncated {
+		fmt.Fprintf(w, ", more beyond depth %d", radius.MaxDepth)
+	}
+	fmt.Fprintf(w, "\n")
+
+	assetTypes := make(map[string]int, 0)
+	projects := make(map[string]int, 0)
+	for _, asset := range radius.Assets {
+		assetTypes[asset.AssetType]++
+		if project := GetProject(asset.Name); project != "" {
+			projects[project]++
+		}
+	}
+	fmt.Fprintf(w, "\nAffected assets per type\nCOUNT\tASSET TYPE\n")
+	for _, count := range sortCounts(assetTypes, nil) {
+		fmt.Fprintf(w, "%d\t%s\n", count.Count, count.Name)
+	}
+	fmt.Fprintf(w, "\nAffected assets per project\nCOUNT\tPROJECT\n")
+	for _, count := range sortCounts(projects, nil) {
+		fmt.Fprintf(w, "%d\t%s\n", count.Count, count.Name)
+	}
+
+	fmt.Fprintf(w, "\nAffected assets\nDEPTH\tASSET TYPE\tNAME\tVIA\n")
+	for _, asset := range radius.Assets {
+		name := asset.Name
+		if asset.Stopped {
+			name += " (stopped)"
+		}
+		via := asset.Via
+		if via == radius.Asset {
+			via = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", asset.Depth, asset.AssetType, name, via)
+	}
+	return w.Flush()
+}
+
+// ParseAssetTypes splits a comma separated list of asset types.
+func ParseAssetTypes(assetTypes string) []string {
+	parsed := make([]string, 0)
+	for _, assetType := range strings.Split(assetTypes, ",") {
+		if assetType = strings.TrimSpace(assetType); assetType != "" {
+			parsed = append(parsed, assetType)
+		}
+	}
+	return parsed
+}
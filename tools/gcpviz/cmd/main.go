@@ -5,13 +5,16 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/GoogleCloudPlatform/professional-services/tools/gcpviz"
 	"github.com/dimiro1/banner"
@@ -31,14 +34,45 @@ func (i *arrayFlags) Set(value string) error {
 }
 
 func main() {
-	modePtr := flag.String("mode", "", "mode of operation (generate, visualize)")
+	modePtr := flag.String("mode", "", "mode of operation (generate, visualize, tiles, validate-config, export, ip-report, stats, blast-radius, watch)")
 	relationsFilePtr := flag.String("relations-file", "relations.yaml", "location of relations file")
-	styleFilePtr := flag.String("style-file", "style.yaml", "location of graph style file")
+	styleFilePtr := flag.String("style-file", "style.yaml", "location of graph style file (separate multiple files with commas, later files override earlier ones)")
+	themePtr := flag.String("theme", "", "built-in color theme to apply to graph style (dark, light, print, colorblind)")
+	layoutPtr := flag.String("layout", "", "layout profile (default, or hierarchical for a top-down diagram of the resource hierarchy with dot)")
 	labelsFilePtr := flag.String("labels-file", "labels.yaml", "location of node/edge labels file")
 	queryFilePtr := flag.String("query-file", "query.js", "location of Gizmo query file")
 	graphFilePtr := flag.String("graph-file", "graph.db", "location of Graph & Asset database file")
-	resourceInventoryFilePtr := flag.String("resource-inventory-file", "resource_inventory.json", "location of resource inventory file from Cloud Asset Inventory")
+	resourceInventoryFilePtr := flag.String("resource-inventory-file", "resource_inventory.json", "location of resource inventory file from Cloud Asset Inventory (separate multiple exports with commas, optionally tagged as source=file)")
+	terraformFilePtr := flag.String("terraform-file", "", "location of Terraform state or plan in JSON format (output of \"terraform show -json\")")
+	kubernetesFilePtr := flag.String("kubernetes-file", "", "location of Kubernetes objects of GKE clusters in JSON format (output of \"kubectl get -o json\"), as cluster=file where cluster is projects/PROJECT/locations/LOCATION/clusters/CLUSTER (separate multiple clusters with commas)")
+	onPremFilePtr := flag.String("onprem-file", "", "location of on-premises sites file (YAML with names, CIDRs, peer IPs and ASNs of sites)")
+	labelVertexesPtr := flag.Bool("label-vertexes", false, "add resource labels and tag values as vertexes, linked from resources with labelled and tagged edges")
+	labelKeysPtr := flag.String("label-keys", "", "only add labels with these keys as vertexes (separate multiple keys with commas, default all)")
+	snapshotTimePtr := flag.String("snapshot-time", "", "record generated graph as a snapshot taken at this time (YYYY-MM-DD or RFC 3339), keeping earlier snapshots in the graph file")
+	asOfPtr := flag.String("as-of", "", "visualize the graph as it was at this time (YYYY-MM-DD or RFC 3339), requires snapshots")
+	exportDirPtr := flag.String("export-dir", ".", "directory to write nodes and edges to in export mode")
+	exportFormatPtr := flag.String("export-format", "json", "format of exported nodes and edges (json for newline delimited JSON, or avro)")
+	tileDirPtr := flag.String("tile-dir", "tiles", "directory to write partitions and index page to in tiles mode")
+	partitionByPtr := flag.String("partition-by", "project", "how to partition the diagram in tiles mode (folder, project or component)")
+	ipReportFormatPtr := flag.String("ip-report-format", "csv", "format of IP address report (csv, or json for newline delimited JSON)")
+	ipThresholdPtr := flag.Float64("ip-exhaustion-threshold", 80, "utilization of a subnetwork range in percent from which it is reported as exhausted")
+	assetPtr := flag.String("asset", "", "name of the asset to calculate the blast radius of (asset name, compute self-link or alias such as a service account email)")
+	blastRadiusDepthPtr := flag.Int("blast-radius-depth", 0, "maximum number of steps to follow from the asset in blast-radius mode (0 for unlimited)")
+	blastRadiusStopPtr := flag.String("blast-radius-stop", "", "asset types whose dependents are not followed in blast-radius mode (separate multiple asset types with commas)")
+	blastRadiusFormatPtr := flag.String("blast-radius-format", "text", "format of blast radius (text, json, or dot to render it with -query-file, by default queries/blast-radius.js)")
+	statsFormatPtr := flag.String("stats-format", "table", "format of graph statistics in stats mode (table or json)")
+	statsTopPtr := flag.Int("stats-top", 10, "number of most connected assets to list in stats mode (0 for all)")
+	subscriptionPtr := flag.String("subscription", "", "Pub/Sub subscription of a Cloud Asset Inventory feed to apply changes from in watch mode (projects/PROJECT/subscriptions/SUBSCRIPTION)")
+	watchOutputPtr := flag.String("watch-output", "", "file to render -query-file to after each batch of changes in watch mode")
 	graphTitlePtr := flag.String("graph-title", "", "Title for the graph")
+	metricsFilePtr := flag.String("metrics-file", "", "location of CSV or JSON file with metrics per asset name or project, available in templates as .Metrics")
+	metricsKeyPtr := flag.String("metrics-key", "", "column or field that holds the asset name or project in the metrics file (defaults to first CSV column or \"name\")")
+	lenientPtr := flag.Bool("lenient", false, "skip assets that cannot be parsed instead of failing")
+	reportFilePtr := flag.String("report-file", "", "write a JSON report of skipped assets, dangling references and JSONPath errors to this file when generating")
+	timeoutPtr := flag.Duration("timeout", 0, "stop generating, visualizing or exporting after this time (ie. 10m), leaving the graph file untouched")
+	queryTimeoutPtr := flag.Duration("query-timeout", 0, "stop queries that run longer than this time (ie. 30s)")
+	queryLimitPtr := flag.Int("query-limit", 0, "stop queries that return more than this number of results")
+	progressPtr := flag.String("progress", "text", "format of progress output on standard error (text, json or none)")
 	noColorPtr := flag.Bool("no-color", false, "disables color in output")
 	noBannerPtr := flag.Bool("no-banner", false, "disables banner")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to `file`")
@@ -46,7 +80,7 @@ func main() {
 	var graphParameters arrayFlags
 	var queryParameters arrayFlags
 	flag.Var(&graphParameters, "graph-parameter", "override graph style parameters using SJSON (ie. \"options.overlap=vpsc\")")
-	flag.Var(&queryParameters, "query-parameter", "additional parameter to pass to Gizmo query (param=value)")
+	flag.Var(&queryParameters, "query-parameter", "additional parameter to pass to Gizmo query (param=value for strings, param:=value for JSON values)")
 
 	flag.Parse()
 
@@ -96,32 +130,149 @@ func main() {
 			overrideParams[param[0]] = param[1]
 		}
 	}
-	viz, err := gcpviz.NewGcpViz(*relationsFilePtr, *labelsFilePtr, *styleFilePtr, overrideParams)
+	styleFiles := strings.Split(*styleFilePtr, ",")
+	viz, err := gcpviz.New(gcpviz.WithRelationsFile(*relationsFilePtr), gcpviz.WithLabelsFile(*labelsFilePtr), gcpviz.WithStyleFiles(styleFiles...), gcpviz.WithTheme(*themePtr), gcpviz.WithLayout(*layoutPtr), gcpviz.WithStyleOverrides(overrideParams))
 	if err != nil {
 		log.Fatalf("Failed to initialize graph engine: %v", err)
 	}
+	switch *progressPtr {
+	case "text":
+		viz.Progress = gcpviz.TextProgress(os.Stderr)
+	case "json":
+		viz.Progress = gcpviz.JSONProgress(os.Stderr)
+	case "none":
+		viz.Progress = func(gcpviz.ProgressEvent) {}
+	default:
+		log.Fatalf("Invalid progress format %s, specify either text, json or none", *progressPtr)
+	}
+	viz.Lenient = *lenientPtr
+	viz.LabelVertexes = *labelVertexesPtr
+	viz.LabelKeys = gcpviz.ParseLabelKeys(*labelKeysPtr)
+	viz.QueryTimeout = *queryTimeoutPtr
+	viz.QueryLimit = *queryLimitPtr
+	if *snapshotTimePtr != "" {
+		viz.SnapshotTime, err = gcpviz.ParseTime(*snapshotTimePtr)
+		if err != nil {
+			log.Fatalf("Failed to parse snapshot time: %v", err)
+		}
+	}
+	if *asOfPtr != "" {
+		viz.AsOf, err = gcpviz.ParseTime(*asOfPtr)
+		if err != nil {
+			log.Fatalf("Failed to parse as-of time: %v", err)
+		}
+	}
+	if *metricsFilePtr != "" {
+		err = viz.LoadMetrics(*metricsFilePtr, *metricsKeyPtr)
+		if err != nil {
+			log.Fatalf("Failed to load metrics file: %v", err)
+		}
+	}
+
+	// Stop on timeout or when interrupted, a second interrupt exits immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *timeoutPtr > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *timeoutPtr)
+		defer cancelTimeout()
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		log.Printf("Interrupted, stopping...")
+		cancel()
+	}()
+
+	gizmoParameters := func() map[string]interface{} {
+		var parameters map[string]interface{}
+		if len(queryParameters) > 0 {
+			parameters = make(map[string]interface{}, len(queryParameters)+1)
+			for _, p := range queryParameters {
+				name, value, err := gcpviz.ParseQueryParameter(p)
+				if err != nil {
+					log.Fatalf("Invalid query parameter: %v", err)
+				}
+				parameters[name] = value
+			}
+		} else {
+			parameters = make(map[string]interface{}, 1)
+		}
+		parameters["Title"] = viz.EscapeLabel(*graphTitlePtr)
+		return parameters
+	}
+
 	if *modePtr == "generate" {
+		// Discard the partially generated graph, the previous graph file is kept
+		fatal := func(format string, v ...interface{}) {
+			viz.Abort()
+			log.Fatalf(format, v...)
+		}
+
 		err = viz.Create(*graphFilePtr)
 		if err != nil {
-			log.Fatalf("Failed to create graph file: %v", err)
+			fatal("Failed to create graph file: %v", err)
 		}
 
-		err = viz.ReadAssetsFromFile(*resourceInventoryFilePtr)
-		if err != nil {
-			log.Fatalf("Failed read assets from resource inventory: %v", err)
+		// When only Terraform or Kubernetes files are given, the resource inventory is not required
+		readInventory := *terraformFilePtr == "" && *kubernetesFilePtr == ""
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "resource-inventory-file" {
+				readInventory = true
+			}
+		})
+		if readInventory {
+			err = viz.ReadAssetsFromFiles(ctx, gcpviz.ParseInventoryFiles(*resourceInventoryFilePtr))
+			if err != nil {
+				fatal("Failed read assets from resource inventory: %v", err)
+			}
+		}
+
+		if *terraformFilePtr != "" {
+			err = viz.ReadAssetsFromTerraform(ctx, *terraformFilePtr)
+			if err != nil {
+				fatal("Failed to read assets from Terraform file: %v", err)
+			}
 		}
 
-		err = viz.EnrichAssets()
+		if *kubernetesFilePtr != "" {
+			kubernetesFiles, err := gcpviz.ParseKubernetesFiles(*kubernetesFilePtr)
+			if err != nil {
+				fatal("Failed to parse Kubernetes files: %v", err)
+			}
+			err = viz.ReadAssetsFromKubernetes(ctx, kubernetesFiles)
+			if err != nil {
+				fatal("Failed to read assets from Kubernetes file: %v", err)
+			}
+		}
+
+		if *onPremFilePtr != "" {
+			err = viz.ReadOnPremSites(ctx, *onPremFilePtr)
+			if err != nil {
+				fatal("Failed to read on-premises sites: %v", err)
+			}
+		}
+
+		err = viz.EnrichAssets(ctx)
 		if err != nil {
-			log.Fatalf("Failed create references and enrich assets in resource inventory: %v", err)
+			fatal("Failed create references and enrich assets in resource inventory: %v", err)
 		}
 
 		err = viz.Save()
 		if err != nil {
-			log.Fatalf("Failed to save graph file: %v", err)
+			fatal("Failed to save graph file: %v", err)
+		}
+
+		if *reportFilePtr != "" {
+			err = viz.WriteReport(*reportFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to write report: %v", err)
+			}
 		}
 	}
-	if *modePtr == "visualize" {
+	if *modePtr == "visualize" || *modePtr == "tiles" {
 		err = viz.Load(*graphFilePtr)
 		if err != nil {
 			log.Fatalf("Failed to load graph file: %v", err)
@@ -132,27 +283,19 @@ func main() {
 			log.Fatalf("Failed to load query file: %v", err)
 		}
 
-		var parameters map[string]interface{}
-		if len(queryParameters) > 0 {
-			parameters = make(map[string]interface{}, len(queryParameters)+1)
-			for _, p := range queryParameters {
-				param := strings.SplitN(p, "=", 2)
-				if len(param) == 2 {
-					parameters[param[0]] = param[1]
-				} else {
-					log.Fatalf("Invalid query parameter (use param=value format): %s", p)
-				}
+		parameters := gizmoParameters()
+		if *modePtr == "tiles" {
+			err = viz.GenerateTiles(ctx, string(gizmoQuery), parameters, *tileDirPtr, *partitionByPtr)
+			if err != nil {
+				log.Fatalf("Failed to create partitioned graph: %v", err)
 			}
-		} else {
-			parameters = make(map[string]interface{}, 1)
+			return
 		}
-		parameters["Title"] = viz.EscapeLabel(*graphTitlePtr)
 		f := bufio.NewWriter(os.Stdout)
 		defer f.Flush()
 
 		waitGroup := sync.WaitGroup{}
 
-		ctx := context.Background()
 		waitGroup.Add(1)
 		err = viz.GenerateNodes(&waitGroup, ctx, string(gizmoQuery), parameters, f)
 		if err != nil {
@@ -160,7 +303,164 @@ func main() {
 		}
 		waitGroup.Wait()
 	}
-	if *modePtr != "visualize" && *modePtr != "generate" {
-		log.Fatal("invalid mode specified, specify either generate or visualize")
+	if *modePtr == "validate-config" {
+		if _, err := os.Stat(*graphFilePtr); err == nil {
+			err = viz.Load(*graphFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to load graph file: %v", err)
+			}
+		} else {
+			log.Printf("Graph file %s not found, templates will not be checked against assets", *graphFilePtr)
+		}
+
+		problems, err := viz.ValidateConfig(*relationsFilePtr, *labelsFilePtr, styleFiles)
+		if err != nil {
+			log.Fatalf("Failed to validate configuration: %v", err)
+		}
+		gcpviz.WriteConfigProblems(os.Stdout, problems)
+		for _, problem := range problems {
+			if problem.Severity == gcpviz.SeverityError {
+				os.Exit(1)
+			}
+		}
+	}
+	if *modePtr == "export" {
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+
+		err = viz.Export(ctx, *exportDirPtr, *exportFormatPtr)
+		if err != nil {
+			log.Fatalf("Failed to export graph: %v", err)
+		}
+	}
+	if *modePtr == "ip-report" {
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+
+		f := bufio.NewWriter(os.Stdout)
+		defer f.Flush()
+		err = viz.WriteIpReport(ctx, f, *ipReportFormatPtr, *ipThresholdPtr)
+		if err != nil {
+			log.Fatalf("Failed to write IP address report: %v", err)
+		}
+	}
+	if *modePtr == "stats" {
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+
+		f := bufio.NewWriter(os.Stdout)
+		defer f.Flush()
+		err = viz.WriteStats(ctx, f, *statsFormatPtr, *statsTopPtr)
+		if err != nil {
+			log.Fatalf("Failed to write graph statistics: %v", err)
+		}
+	}
+	if *modePtr == "blast-radius" {
+		if *assetPtr == "" {
+			log.Fatal("specify the asset to calculate the blast radius of with -asset")
+		}
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+
+		radius, err := viz.BlastRadius(ctx, *assetPtr, *blastRadiusDepthPtr, gcpviz.ParseAssetTypes(*blastRadiusStopPtr))
+		if err != nil {
+			log.Fatalf("Failed to calculate blast radius: %v", err)
+		}
+
+		f := bufio.NewWriter(os.Stdout)
+		defer f.Flush()
+		if *blastRadiusFormatPtr != "dot" {
+			err = gcpviz.WriteBlastRadius(f, radius, *blastRadiusFormatPtr)
+			if err != nil {
+				log.Fatalf("Failed to write blast radius: %v", err)
+			}
+			return
+		}
+
+		queryFile := "queries/blast-radius.js"
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "query-file" {
+				queryFile = *queryFilePtr
+			}
+		})
+		gizmoQuery, err := ioutil.ReadFile(queryFile)
+		if err != nil {
+			log.Fatalf("Failed to load query file: %v", err)
+		}
+		parameters := radius.QueryParameters()
+		title := *graphTitlePtr
+		if title == "" {
+			title = fmt.Sprintf("Blast radius of %s", radius.Asset)
+		}
+		parameters["Title"] = viz.EscapeLabel(title)
+
+		waitGroup := sync.WaitGroup{}
+		waitGroup.Add(1)
+		err = viz.GenerateNodes(&waitGroup, ctx, string(gizmoQuery), parameters, f)
+		if err != nil {
+			log.Fatalf("Failed to create graph: %v", err)
+		}
+		waitGroup.Wait()
+	}
+	if *modePtr == "watch" {
+		if *subscriptionPtr == "" {
+			log.Fatal("specify the subscription of the feed with -subscription")
+		}
+		if !viz.SnapshotTime.IsZero() {
+			log.Fatal("snapshots cannot be recorded in watch mode")
+		}
+		sub, err := gcpviz.NewPubSubSubscription(ctx, *subscriptionPtr)
+		if err != nil {
+			log.Fatalf("Failed to subscribe to feed: %v", err)
+		}
+
+		var render func() error
+		if *watchOutputPtr != "" {
+			gizmoQuery, err := ioutil.ReadFile(*queryFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to load query file: %v", err)
+			}
+			parameters := gizmoParameters()
+
+			// The diagram is replaced only once it has been rendered completely
+			render = func() error {
+				tmpFile := *watchOutputPtr + ".tmp"
+				out, err := os.Create(tmpFile)
+				if err != nil {
+					return err
+				}
+				f := bufio.NewWriter(out)
+				waitGroup := sync.WaitGroup{}
+				waitGroup.Add(1)
+				err = viz.GenerateNodes(&waitGroup, ctx, string(gizmoQuery), parameters, f)
+				if err == nil {
+					waitGroup.Wait()
+					err = f.Flush()
+				}
+				out.Close()
+				if err != nil {
+					os.Remove(tmpFile)
+					return err
+				}
+				log.Printf("Rendered %s", *watchOutputPtr)
+				return os.Rename(tmpFile, *watchOutputPtr)
+			}
+		}
+
+		err = viz.Watch(ctx, *graphFilePtr, sub, render)
+		if err != nil {
+			log.Fatalf("Failed to apply changes from feed: %v", err)
+		}
+	}
+	if *modePtr != "visualize" && *modePtr != "tiles" && *modePtr != "generate" && *modePtr != "validate-config" && *modePtr != "export" && *modePtr != "ip-report" && *modePtr != "stats" && *modePtr != "blast-radius" && *modePtr != "watch" {
+		log.Fatal("invalid mode specified, specify either generate, visualize, tiles, validate-config, export, ip-report, stats, blast-radius or watch")
 	}
 }
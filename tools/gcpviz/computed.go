@@ -0,0 +1,287 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cayleygraph/cayley"
+	cquad "github.com/cayleygraph/quad"
+	"github.com/pkg/errors"
+	"github.com/yalp/jsonpath"
+)
+
+// Computed fields aggregate values from the assets linked to an asset, such as the
+// number of instances in a subnetwork. They are stored in resource.computed and are
+// available in templates as {{ .Resource.Computed.<field> }}.
+
+var computedFunctions = map[string]bool{
+	"count":    true,
+	"sum":      true,
+	"min":      true,
+	"max":      true,
+	"distinct": true,
+	"first":    true,
+}
+
+// ComputedField is a field computed from linked assets.
+type ComputedField struct {
+	// Function is one of count, sum, min, max, distinct or first
+	Function string `yaml:"function" json:"function"`
+	// Relation is the predicate to follow, "uses" (default), "child" or a named relationship
+	Relation string `yaml:"relation,omitempty" json:"relation,omitempty"`
+	// Direction is "in" for assets referring to this asset (default) or "out" for assets
+	// this asset refers to (or its children for "child")
+	Direction string `yaml:"direction,omitempty" json:"direction,omitempty"`
+	// AssetTypes limits the linked assets to these asset types
+	AssetTypes []string `yaml:"asset_types,omitempty" json:"asset_types,omitempty"`
+	// Path is evaluated against the data of the linked assets, without it the names
+	// of the linked assets are used as values
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+}
+
+type computedField struct {
+	ComputedField
+	path       jsonpath.FilterFunc
+	assetTypes map[string]bool
+}
+
+func (f ComputedField) check() error {
+	if !computedFunctions[f.Function] {
+		return fmt.Errorf("unknown function %q (expected count, sum, min, max, distinct or first)", f.Function)
+	}
+	if f.Direction != "" && f.Direction != "in" && f.Direction != "out" {
+		return fmt.Errorf("invalid direction %q (expected in or out)", f.Direction)
+	}
+	if f.Relation != "" && f.Relation != "uses" && f.Relation != "child" {
+		if err := checkRelationName(f.Relation); err != nil {
+			return err
+		}
+	}
+	if f.Path == "" && (f.Function == "sum" || f.Function == "min" || f.Function == "max") {
+		return fmt.Errorf("function %s requires a path", f.Function)
+	}
+	return nil
+}
+
+func prepareComputedField(field ComputedField) (*computedField, error) {
+	if err := field.check(); err != nil {
+		return nil, err
+	}
+	prepared := &computedField{ComputedField: field, assetTypes: make(map[string]bool, len(field.AssetTypes))}
+	for _, assetType := range field.AssetTypes {
+		prepared.assetTypes[assetType] = true
+	}
+	if field.Path != "" {
+		path, err := jsonpath.Prepare(field.Path)
+		if err != nil {
+			return nil, err
+		}
+		prepared.path = path
+	}
+	return prepared, nil
+}
+
+// appendValues flattens the result of a JSONPath expression.
+func appendValues(values []interface{}, result interface{}) []interface{} {
+	switch result := result.(type) {
+	case nil:
+		return values
+	case []interface{}:
+		for _, value := range result {
+			values = append(values, appendValues(nil, value)...)
+		}
+		return values
+	}
+	return append(values, result)
+}
+
+// linkedAssets returns the names of the assets linked to name via the predicate of the
+// field, in sorted order.
+func (v *GcpViz) linkedAssets(name string, field *computedField) []string {
+	predicate := field.Relation
+	if predicate == "" {
+		predicate = "uses"
+	}
+	p := cayley.StartPath(v.QS, cquad.String(name))
+	if field.Direction == "out" {
+		p = p.Out(predicate)
+	} else {
+		p = p.In(predicate)
+	}
+
+	linked := make([]string, 0)
+	seen := make(map[string]bool, 0)
+	p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
+		target, ok := cquad.NativeOf(val).(string)
+		if ok && !seen[target] {
+			seen[target] = true
+			linked = append(linked, target)
+		}
+	})
+	sort.Strings(linked)
+	return linked
+}
+
+func (v *GcpViz) computeField(assetType string, name string, fieldName string, field *computedField, assets map[string]*TemplateResource) interface{} {
+	values := make([]interface{}, 0)
+	for _, target := range v.linkedAssets(name, field) {
+		asset, found := assets[target]
+		if !found {
+			var err error
+			asset, err = v.getAsset(target)
+			if err != nil {
+				// Not an asset, ie. a reference to a resource outside of the inventory
+				asset = nil
+			}
+			assets[target] = asset
+		}
+		if asset == nil || (len(field.assetTypes) > 0 && !field.assetTypes[asset.AssetType]) {
+			continue
+		}
+		if field.path == nil {
+			values = append(values, target)
+			continue
+		}
+		result, err := field.path(asset.Resource.Data)
+		v.report().addJsonPathResult("computed", assetType, field.Path, err)
+		if err != nil {
+			continue
+		}
+		values = appendValues(values, result)
+	}
+
+	switch field.Function {
+	case "count":
+		return len(values)
+	case "sum", "min", "max":
+		var result float64
+		numbers := 0
+		for _, value := range values {
+			number, ok := toFloat(value)
+			if !ok {
+				v.warn(PhaseEnrich, "non-numeric value %v for computed field %s of %s.", value, fieldName, name)
+				continue
+			}
+			switch {
+			case field.Function == "sum":
+				result += number
+			case numbers == 0, field.Function == "min" && number < result, field.Function == "max" && number > result:
+				result = number
+			}
+			numbers++
+		}
+		if numbers == 0 && field.Function != "sum" {
+			return nil
+		}
+		return result
+	case "distinct":
+		distinct := make([]interface{}, 0)
+		seen := make(map[string]bool, 0)
+		for _, value := range values {
+			key := fmt.Sprint(value)
+			if !seen[key] {
+				seen[key] = true
+				distinct = append(distinct, value)
+			}
+		}
+		sort.SliceStable(distinct, func(i, j int) bool {
+			return fmt.Sprint(distinct[i]) < fmt.Sprint(distinct[j])
+		})
+		return distinct
+	case "first":
+		if len(values) > 0 {
+			return values[0]
+		}
+	}
+	return nil
+}
+
+// computeFields calculates the computed fields of relations.yaml for all assets.
+func (v *GcpViz) computeFields(ctx context.Context) error {
+	if len(v.Relations.Computed) == 0 {
+		return nil
+	}
+	v.progress(ProgressEvent{Phase: PhaseEnrich, Message: "Computing fields from linked assets..."})
+
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names := make([]string, 0)
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		isComputedAsset := false
+		for assetType := range v.Relations.Computed {
+			// Simple optimization to avoid unmarshaling tons of JSON
+			if strings.Contains(string(bv), assetType) {
+				isComputedAsset = true
+				break
+			}
+		}
+		if !isComputedAsset {
+			return nil
+		}
+		var asset map[string]interface{}
+		if err := json.Unmarshal(bv, &asset); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", string(k)))
+		}
+		if _, found := v.Relations.Computed[stringField(asset, "asset_type")]; found {
+			names = append(names, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tx.Rollback()
+
+	assets := make(map[string]*TemplateResource, 0)
+	computed := make(map[string]map[string]interface{}, len(names))
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		asset, err := v.getAsset(name)
+		if err != nil {
+			return err
+		}
+		fields := v.Relations.Computed[asset.AssetType]
+		values := make(map[string]interface{}, len(fields))
+		for fieldName, field := range fields {
+			if value := v.computeField(asset.AssetType, name, fieldName, field, assets); value != nil {
+				values[fieldName] = value
+			}
+		}
+		computed[name] = values
+	}
+
+	wrtx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer wrtx.Rollback()
+
+	for _, name := range names {
+		// Assets are fetched again, the cached ones may not have all fields computed yet
+		asset, err := v.getAssetTx(wrtx, name)
+		if err != nil {
+			return err
+		}
+		asset.Resource.Computed = computed[name]
+		if err = v.UpdateAsset(wrtx, name, asset); err != nil {
+			return err
+		}
+	}
+	if err = wrtx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseEnrich, Message: fmt.Sprintf("Computed fields of %d assets.", len(names)), Done: true})
+	return nil
+}
@@ -0,0 +1,264 @@
+package gcpviz
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// exportField describes a column of the exported nodes and edges. Type is one of
+// string, nullable (string) or array (of strings).
+type exportField struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+var nodeExportFields = []exportField{
+	{"name", "string", "Full resource name of the asset"},
+	{"asset_type", "string", "Cloud Asset Inventory asset type"},
+	{"parent", "nullable", "Full resource name of the parent"},
+	{"ancestors", "array", "Ancestry path, from the asset itself up to the organization"},
+	{"aliases", "array", "Alternative names (such as self links) that resolve to this asset"},
+	{"source", "nullable", "Export or Terraform file the asset was read from"},
+	{"update_time", "nullable", "Last update time of the asset"},
+	{"data", "string", "Resource data (including enriched fields) as JSON"},
+}
+
+var edgeExportFields = []exportField{
+	{"source_name", "string", "Full resource name of the source vertex"},
+	{"source_asset_type", "nullable", "Asset type of the source vertex, if it is an asset"},
+	{"relation", "string", "Relationship between the vertexes (child, uses)"},
+	{"target_name", "string", "Full resource name of the target vertex"},
+	{"target_asset_type", "nullable", "Asset type of the target vertex, if it is an asset"},
+	{"label", "nullable", "Edge label, the asset type the relationship was created for"},
+}
+
+type exportWriter interface {
+	Write(values map[string]interface{}) error
+	Flush() error
+}
+
+type jsonExportWriter struct {
+	enc    *json.Encoder
+	fields []exportField
+}
+
+func (w *jsonExportWriter) Write(values map[string]interface{}) error {
+	for _, field := range w.fields {
+		switch field.Type {
+		case "nullable":
+			if values[field.Name] == "" {
+				values[field.Name] = nil
+			}
+		case "array":
+			if a, _ := values[field.Name].([]string); a == nil {
+				values[field.Name] = []string{}
+			}
+		}
+	}
+	return w.enc.Encode(values)
+}
+
+func (w *jsonExportWriter) Flush() error {
+	return nil
+}
+
+func bigQuerySchema(fields []exportField) []map[string]string {
+	schema := make([]map[string]string, len(fields))
+	for idx, field := range fields {
+		column := map[string]string{"name": field.Name, "type": "STRING", "mode": "REQUIRED", "description": field.Description}
+		switch field.Type {
+		case "nullable":
+			column["mode"] = "NULLABLE"
+		case "array":
+			column["mode"] = "REPEATED"
+		}
+		schema[idx] = column
+	}
+	return schema
+}
+
+func writeJsonFile(fileName string, value interface{}) error {
+	jsn, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(jsn, '\n'), 0644)
+}
+
+// exportTable writes one table of the export (nodes or edges) along with its schema.
+func (v *GcpViz) exportTable(dir string, table string, recordName string, format string, fields []exportField, records func(exportWriter) (int64, error)) error {
+	var extension string
+	switch format {
+	case "json":
+		extension = "json"
+		err := writeJsonFile(filepath.Join(dir, fmt.Sprintf("%s.schema.json", table)), bigQuerySchema(fields))
+		if err != nil {
+			return err
+		}
+	case "avro":
+		extension = "avro"
+		err := writeJsonFile(filepath.Join(dir, fmt.Sprintf("%s.avsc", table)), avroSchema(recordName, fields))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown export format %s, specify either json or avro", format)
+	}
+
+	fileName := filepath.Join(dir, fmt.Sprintf("%s.%s", table, extension))
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+
+	var writer exportWriter
+	if format == "avro" {
+		writer, err = newAvroWriter(out, recordName, fields)
+		if err != nil {
+			return err
+		}
+	} else {
+		writer = &jsonExportWriter{enc: json.NewEncoder(out), fields: fields}
+	}
+
+	count, err := records(writer)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("exporting %s", table))
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if err = out.Flush(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseExport, Message: fmt.Sprintf("Exported %s to %s", table, fileName), Current: count, Unit: "records", Done: true})
+	return file.Close()
+}
+
+// forEachAsset calls fn for every asset in the graph, or in the loaded snapshot.
+func (v *GcpViz) forEachAsset(ctx context.Context, tx *bolt.Tx, fn func(name string, asset []byte) error) error {
+	if v.snapshot.IsZero() {
+		return tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fn(string(k), bv)
+		})
+	}
+	return tx.Bucket([]byte("AssetHistory")).ForEach(func(k, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		asset, _, err := v.assetAsOf(tx, string(k))
+		if err != nil || asset == nil {
+			return err
+		}
+		return fn(string(k), asset)
+	})
+}
+
+// Export writes the assets (nodes) and relationships (edges) of the graph to dir as
+// newline delimited JSON or Avro files, together with BigQuery or Avro schemas.
+func (v *GcpViz) Export(ctx context.Context, dir string, format string) error {
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	aliases := make(map[string][]string, 0)
+	err = tx.Bucket([]byte("Aliases")).ForEach(func(k, bv []byte) error {
+		aliases[string(bv)] = append(aliases[string(bv)], string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	assetTypes := make(map[string]string, 0)
+	err = v.exportTable(dir, "nodes", "Node", format, nodeExportFields, func(w exportWriter) (int64, error) {
+		var count int64
+		err := v.forEachAsset(ctx, tx, func(name string, asset []byte) error {
+			var resource TemplateResource
+			if err := json.Unmarshal(asset, &resource); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", name))
+			}
+			data, err := json.Marshal(resource.Resource.Data)
+			if err != nil {
+				return err
+			}
+			assetTypes[name] = resource.AssetType
+			sort.Strings(aliases[name])
+			count++
+			return w.Write(map[string]interface{}{
+				"name":        resource.Name,
+				"asset_type":  resource.AssetType,
+				"parent":      resource.Resource.Parent,
+				"ancestors":   resource.Ancestors,
+				"aliases":     aliases[name],
+				"source":      resource.Source,
+				"update_time": resource.UpdateTime,
+				"data":        string(data),
+			})
+		})
+		return count, err
+	})
+	if err != nil {
+		return err
+	}
+
+	return v.exportTable(dir, "edges", "Edge", format, edgeExportFields, func(w exportWriter) (int64, error) {
+		// Named relationships are stored alongside a "uses" quad, export them only once
+		named := make(map[string]bool, 0)
+		namedIt := v.QS.QuadsAllIterator()
+		for namedIt.Next(ctx) {
+			q := v.QS.Quad(namedIt.Result())
+			if predicate := quadValue(q.Predicate); predicate != "uses" && predicate != "child" {
+				named[quadValue(q.Subject)+"\x00"+quadValue(q.Object)+"\x00"+quadValue(q.Label)] = true
+			}
+		}
+		namedIt.Close()
+
+		var count int64
+		it := v.QS.QuadsAllIterator()
+		defer it.Close()
+		for it.Next(ctx) {
+			if err := ctx.Err(); err != nil {
+				return count, err
+			}
+			q := v.QS.Quad(it.Result())
+			source, target := quadValue(q.Subject), quadValue(q.Object)
+			if source == "" {
+				continue
+			}
+			if quadValue(q.Predicate) == "uses" && named[source+"\x00"+target+"\x00"+quadValue(q.Label)] {
+				continue
+			}
+			count++
+			err := w.Write(map[string]interface{}{
+				"source_name":       source,
+				"source_asset_type": assetTypes[source],
+				"relation":          quadValue(q.Predicate),
+				"target_name":       target,
+				"target_asset_type": assetTypes[target],
+				"label":             quadValue(q.Label),
+			})
+			if err != nil {
+				return count, err
+			}
+		}
+		return count, it.Err()
+	})
+}
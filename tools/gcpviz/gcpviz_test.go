@@ -0,0 +1,1779 @@
+package gcpviz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/cayleygraph/cayley"
+	cquad "github.com/cayleygraph/quad"
+)
+
+// The tests build a graph from testdata/inventory.json, a small synthetic inventory
+// with an organization, folders, a host and an application project and most of the
+// asset types in relations.yaml, using the shipped relations, labels and styles.
+// The objects of its GKE cluster are read from testdata/kubernetes.json, the output
+// of kubectl get -o json, and its on-premises sites from testdata/onprem.yaml. Labels
+// and tag values are only added as vertexes for the tests and queries that need them.
+// testdata/partner.json is a second export to merge, with a partner organization and
+// copies of fixture assets, and testdata/terraform-plan.json a plan in the format of
+// terraform show -json.
+//
+// Golden diagrams are in testdata/golden; regenerate them after intended changes
+// with: go test -run TestQueries -update
+var update = flag.Bool("update", false, "update golden files in testdata/golden")
+
+const (
+	fixtureInventory  = "testdata/inventory.json"
+	fixtureKubernetes = "testdata/kubernetes.json"
+	fixtureOnPrem     = "testdata/onprem.yaml"
+	fixturePartner    = "testdata/partner.json"
+	fixtureTerraform  = "testdata/terraform-plan.json"
+	goldenDir         = "testdata/golden"
+
+	organization   = "//cloudresourcemanager.googleapis.com/organizations/100"
+	hostProject    = "//cloudresourcemanager.googleapis.com/projects/301"
+	appProject     = "//cloudresourcemanager.googleapis.com/projects/302"
+	hostNetwork    = "//compute.googleapis.com/projects/host/global/networks/vpc-host"
+	appNetwork     = "//compute.googleapis.com/projects/app/global/networks/vpc-app"
+	appSubnetwork  = "//compute.googleapis.com/projects/app/regions/europe-west1/subnetworks/sub-app"
+	serviceAccount = "//iam.googleapis.com/projects/app/serviceAccounts/111"
+	cluster        = "//container.googleapis.com/projects/app/locations/europe-west1/clusters/gke-1"
+)
+
+// Parameters of queries that start from a project instead of the organization
+var queryParameters = map[string]map[string]interface{}{
+	"one-project-example": {"project": appProject},
+	"shared-vpc":          {"project": appProject, "sharedvpcproject": hostProject},
+	"vpc-security":        {"project": appProject},
+	"labels":              {"label": "team"},
+}
+
+// Queries that need a graph with label vertexes
+var labelQueries = map[string]bool{
+	"labels": true,
+}
+
+func newTestViz(t *testing.T) *GcpViz {
+	t.Helper()
+	viz, err := New(WithRelationsFile("relations.yaml"), WithLabelsFile("labels.yaml"), WithStyleFiles("style.yaml"), WithProgress(func(ProgressEvent) {}))
+	if err != nil {
+		t.Fatalf("failed to create graph: %v", err)
+	}
+	return viz
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gcpviz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// generateGraph generates a graph file from the assets read by read and returns it
+// with the graph engine that generated it.
+func generateGraph(t *testing.T, labelVertexes bool, read func(ctx context.Context, generator *GcpViz) error) (string, *GcpViz) {
+	t.Helper()
+	graphFile := filepath.Join(tempDir(t), "graph.db")
+
+	ctx := context.Background()
+	generator := newTestViz(t)
+	generator.LabelVertexes = labelVertexes
+	if err := generator.Create(graphFile); err != nil {
+		t.Fatalf("failed to create graph file: %v", err)
+	}
+	if err := read(ctx, generator); err != nil {
+		generator.Abort()
+		t.Fatalf("failed to read assets: %v", err)
+	}
+	if err := generator.EnrichAssets(ctx); err != nil {
+		t.Fatalf("failed to enrich assets: %v", err)
+	}
+	if err := generator.Save(); err != nil {
+		t.Fatalf("failed to save graph: %v", err)
+	}
+	return graphFile, generator
+}
+
+// readFixture reads the fixture inventory, Kubernetes objects and on-premises sites.
+func readFixture(ctx context.Context, generator *GcpViz) error {
+	if err := generator.ReadAssetsFromFile(ctx, fixtureInventory, ""); err != nil {
+		return err
+	}
+	if err := generator.ReadAssetsFromKubernetes(ctx, []KubernetesFile{{Cluster: cluster, File: fixtureKubernetes}}); err != nil {
+		return err
+	}
+	return generator.ReadOnPremSites(ctx, fixtureOnPrem)
+}
+
+// generateFixture generates a graph file from the fixture and returns it with the
+// report of the generation.
+func generateFixture(t *testing.T, labelVertexes bool) (string, *Report) {
+	t.Helper()
+	graphFile, generator := generateGraph(t, labelVertexes, readFixture)
+	return graphFile, generator.Report
+}
+
+// loadFixture generates a graph file from the fixture inventory and loads it.
+func loadFixture(t *testing.T) *GcpViz {
+	t.Helper()
+	graphFile, _ := generateFixture(t, false)
+	return loadGraph(t, graphFile)
+}
+
+// loadLabelledFixture is loadFixture with label vertexes.
+func loadLabelledFixture(t *testing.T) *GcpViz {
+	t.Helper()
+	graphFile, _ := generateFixture(t, true)
+	return loadGraph(t, graphFile)
+}
+
+func loadGraph(t *testing.T, graphFile string) *GcpViz {
+	t.Helper()
+	viz := newTestViz(t)
+	if err := viz.Load(graphFile); err != nil {
+		t.Fatalf("failed to load graph: %v", err)
+	}
+	t.Cleanup(func() { viz.AssetDatabase.Close() })
+	return viz
+}
+
+// linked returns the sorted vertexes linked from name via predicate.
+func linked(viz *GcpViz, name string, predicate string) []string {
+	values := make([]string, 0)
+	p := cayley.StartPath(viz.QS, cquad.String(name)).Out(predicate)
+	p.Iterate(nil).EachValue(viz.QS, func(val cquad.Value) {
+		values = append(values, cquad.NativeOf(val).(string))
+	})
+	sort.Strings(values)
+	return values
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestQueries(t *testing.T) {
+	unlabelled, labelled := loadFixture(t), loadLabelledFixture(t)
+
+	queries, err := filepath.Glob("queries/*.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) == 0 {
+		t.Fatal("no queries found")
+	}
+	for _, queryFile := range queries {
+		name := strings.TrimSuffix(filepath.Base(queryFile), ".js")
+		t.Run(name, func(t *testing.T) {
+			viz := unlabelled
+			if labelQueries[name] {
+				viz = labelled
+			}
+			query, err := ioutil.ReadFile(queryFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parameters := map[string]interface{}{"Title": viz.EscapeLabel(name)}
+			for k, v := range queryParameters[name] {
+				parameters[k] = v
+			}
+			if name == "blast-radius" {
+				radius, err := viz.BlastRadius(context.Background(), appSubnetwork, 0, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range radius.QueryParameters() {
+					parameters[k] = v
+				}
+			}
+
+			var out bytes.Buffer
+			var wg sync.WaitGroup
+			wg.Add(1)
+			if err := viz.GenerateNodes(&wg, context.Background(), string(query), parameters, &out); err != nil {
+				t.Fatalf("failed to generate graph: %v", err)
+			}
+			wg.Wait()
+			if !strings.Contains(out.String(), " -> ") {
+				t.Errorf("query returned a graph without edges:\n%s", out.String())
+			}
+			// Fields missing in the fixture render as <no value>
+			if strings.Contains(out.String(), "<no value>") {
+				t.Errorf("query rendered a label with missing fields:\n%s", out.String())
+			}
+
+			goldenFile := filepath.Join(goldenDir, name+".gv")
+			if *update {
+				if err := os.MkdirAll(goldenDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(goldenFile, out.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			golden, err := ioutil.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), golden) {
+				t.Errorf("graph differs from %s (run with -update if the change is intended):\n%s", goldenFile, out.String())
+			}
+		})
+	}
+}
+
+func TestRelations(t *testing.T) {
+	viz := loadFixture(t)
+
+	tests := []struct {
+		name      string
+		from      string
+		predicate string
+		to        string
+	}{
+		{"project in folder", appProject, "uses", "//cloudresourcemanager.googleapis.com/folders/202"},
+		{"folder in folder", "//cloudresourcemanager.googleapis.com/folders/202", "uses", "//cloudresourcemanager.googleapis.com/folders/200"},
+		{"folder in organization", "//cloudresourcemanager.googleapis.com/folders/200", "uses", organization},
+		{"child of organization", organization, "child", "//cloudresourcemanager.googleapis.com/folders/201"},
+		{"subnetwork in network", appSubnetwork, "uses", appNetwork},
+		{"instance in subnetwork", "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1", "uses", appSubnetwork},
+		{"named relation", "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1", "attached_disk", "//compute.googleapis.com/projects/app/zones/europe-west1-b/disks/vm-1"},
+		{"named relation is also used", "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1", "uses", "//compute.googleapis.com/projects/app/zones/europe-west1-b/disks/vm-1"},
+		{"peering", hostNetwork, "peers_with", appNetwork},
+		{"peering back", appNetwork, "peers_with", hostNetwork},
+		{"tunnel to gateway", "//compute.googleapis.com/projects/host/regions/europe-west1/vpnTunnels/tunnel-1", "uses", "//compute.googleapis.com/projects/host/regions/europe-west1/vpnGateways/gw-1"},
+		{"load balancer chain", "//compute.googleapis.com/projects/app/global/forwardingRules/gfr-1", "uses", "//compute.googleapis.com/projects/app/global/targetHttpProxies/proxy-1"},
+		{"backend to instance group", "//compute.googleapis.com/projects/app/global/backendServices/bs-1", "uses", "//compute.googleapis.com/projects/app/zones/europe-west1-b/instanceGroups/ig-1"},
+		{"node pool in cluster", "//container.googleapis.com/projects/app/locations/europe-west1/clusters/gke-1/nodePools/pool-1", "uses", "//container.googleapis.com/projects/app/locations/europe-west1/clusters/gke-1"},
+		{"table in dataset", "//bigquery.googleapis.com/projects/app/datasets/analytics/tables/events", "uses", "//bigquery.googleapis.com/projects/app/datasets/analytics"},
+		{"subscription to topic", "//pubsub.googleapis.com/projects/app/subscriptions/events-sub", "uses", "//pubsub.googleapis.com/projects/app/topics/events"},
+		// Kubernetes objects are linked by owner, node, selector and annotations
+		{"namespace in cluster", cluster + "/k8s/namespaces/shop", "uses", cluster},
+		{"placeholder namespace", cluster + "/k8s/namespaces/cache/pods/redis-0", "uses", cluster + "/k8s/namespaces/cache"},
+		{"replica set owned by deployment", cluster + "/k8s/namespaces/shop/apps/replicasets/frontend-5d8f7", "uses", cluster + "/k8s/namespaces/shop/apps/deployments/frontend"},
+		{"pod owned by replica set", cluster + "/k8s/namespaces/shop/pods/frontend-5d8f7-abcde", "uses", cluster + "/k8s/namespaces/shop/apps/replicasets/frontend-5d8f7"},
+		{"pod of missing replica set", cluster + "/k8s/namespaces/shop/pods/frontend-6c9b8-fghij", "uses", cluster + "/k8s/namespaces/shop/apps/deployments/frontend"},
+		{"pod on node", cluster + "/k8s/namespaces/shop/pods/frontend-5d8f7-abcde", "uses", cluster + "/k8s/nodes/gke-gke-1-pool-1-abcd"},
+		{"service selects pod", cluster + "/k8s/namespaces/shop/services/frontend", "uses", cluster + "/k8s/namespaces/shop/pods/frontend-6c9b8-fghij"},
+		{"service network endpoint group", cluster + "/k8s/namespaces/shop/services/frontend", "uses", "//compute.googleapis.com/projects/app/zones/europe-west1-b/networkEndpointGroups/k8s1-abc-shop-frontend-80"},
+		{"ingress backend service", cluster + "/k8s/namespaces/shop/networking.k8s.io/ingresses/frontend", "uses", cluster + "/k8s/namespaces/shop/services/frontend"},
+		{"ingress forwarding rule", cluster + "/k8s/namespaces/shop/networking.k8s.io/ingresses/frontend", "uses", "//compute.googleapis.com/projects/app/global/forwardingRules/k8s2-fr-abc"},
+		{"ingress load balancer backend", cluster + "/k8s/namespaces/shop/networking.k8s.io/ingresses/frontend", "uses", "//compute.googleapis.com/projects/app/global/backendServices/k8s1-abc-shop-frontend-80"},
+		// On-premises sites are linked by peer IP, ASN and interconnect attachment
+		{"site to tunnel by peer ip", "//onprem.gcpviz/sites/dc-1", "uses", "//compute.googleapis.com/projects/host/regions/europe-west1/vpnTunnels/tunnel-1"},
+		{"site to router by asn", "//onprem.gcpviz/sites/dc-1", "uses", "//compute.googleapis.com/projects/host/regions/europe-west1/routers/router-1"},
+		{"site to router by peer ip", "//onprem.gcpviz/sites/dc-2", "uses", "//compute.googleapis.com/projects/host/regions/europe-west1/routers/router-2"},
+		{"site to interconnect attachment", "//onprem.gcpviz/sites/dc-2", "uses", "//compute.googleapis.com/projects/host/regions/europe-west1/interconnectAttachments/attachment-1"},
+		{"site in organization", organization, "child", "//onprem.gcpviz/sites/dc-1"},
+		// Service accounts are referred to by email, which is resolved via aliases
+		{"alias target", "//compute.googleapis.com/projects/app/global/firewalls/allow-ssh", "targets_sa", serviceAccount},
+		{"alias source", "//compute.googleapis.com/projects/host/global/firewalls/allow-health-checks", "sources_sa", serviceAccount},
+		{"instance identity", "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1", "runs_as", serviceAccount},
+		{"node pool identity", "//container.googleapis.com/projects/app/locations/europe-west1/clusters/gke-1/nodePools/pool-1", "runs_as", serviceAccount},
+		{"function identity", "//cloudfunctions.googleapis.com/projects/app/locations/europe-west1/functions/process-events", "runs_as", serviceAccount},
+		{"cloud run identity", "//run.googleapis.com/projects/app/locations/europe-west1/services/frontend", "runs_as", serviceAccount},
+		{"service account key", serviceAccount, "child", serviceAccount + "/keys/0123abcd"},
+		{"tag value of key", "//cloudresourcemanager.googleapis.com/tagValues/501", "uses", "//cloudresourcemanager.googleapis.com/tagKeys/500"},
+		// Addresses are linked to the firewalls with ranges that contain them
+		{"address in firewall range", "//compute.googleapis.com/projects/app/regions/europe-west1/addresses/addr-1", "uses", "//compute.googleapis.com/projects/host/global/firewalls/allow-internal"},
+		{"forwarding rule in firewall range", "//compute.googleapis.com/projects/app/regions/europe-west1/forwardingRules/ilb-1", "uses", "//compute.googleapis.com/projects/host/global/firewalls/allow-internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := linked(viz, tt.from, tt.predicate)
+			if !contains(values, tt.to) {
+				t.Errorf("%s -%s-> %s not found, got %v", tt.from, tt.predicate, tt.to, values)
+			}
+		})
+	}
+
+	// Addresses outside of the source ranges of a firewall are not linked to it
+	values := linked(viz, "//compute.googleapis.com/projects/app/regions/europe-west1/addresses/addr-1", "uses")
+	if contains(values, "//compute.googleapis.com/projects/host/global/firewalls/allow-health-checks") {
+		t.Errorf("address linked to firewall without a matching range: %v", values)
+	}
+	// Sites are only linked to the connections to their own peers
+	if values := linked(viz, "//onprem.gcpviz/sites/dc-2", "uses"); contains(values, "//compute.googleapis.com/projects/host/regions/europe-west1/vpnTunnels/tunnel-1") {
+		t.Errorf("site linked to the tunnel of another site: %v", values)
+	}
+	// Services only select the pods matching their selector
+	if values := linked(viz, cluster+"/k8s/namespaces/shop/services/frontend", "uses"); contains(values, cluster+"/k8s/namespaces/cache/pods/redis-0") {
+		t.Errorf("service linked to pod outside of its selector: %v", values)
+	}
+	// Unnamed relations do not create other predicates
+	if values := linked(viz, appSubnetwork, "peers_with"); len(values) > 0 {
+		t.Errorf("unexpected peers_with relation of subnetwork: %v", values)
+	}
+}
+
+func TestRouteOverlaps(t *testing.T) {
+	_, report := generateFixture(t, false)
+	if report == nil {
+		t.Fatal("no report of the generation")
+	}
+
+	overlaps := make([]string, 0)
+	for _, overlap := range report.RouteOverlaps {
+		overlaps = append(overlaps, fmt.Sprintf("%s %s %s %s", GetLastPart(overlap.Site), overlap.Cidr, GetLastPart(overlap.Resource), overlap.Range))
+	}
+	sort.Strings(overlaps)
+	expected := []string{
+		"dc-1 192.168.0.0/16 dc-2 192.168.10.0/24",
+		"dc-2 10.1.0.128/25 sub-app 10.1.0.0/24",
+		"dc-2 192.168.10.0/24 dc-1 192.168.0.0/16",
+	}
+	if !reflect.DeepEqual(overlaps, expected) {
+		t.Errorf("expected route overlaps %v, got %v", expected, overlaps)
+	}
+}
+
+func TestIpOverlaps(t *testing.T) {
+	inventory, err := ioutil.ReadFile(fixtureInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A subnetwork of the host network, which is peered with the application network
+	overlapping := `{"ancestors": ["projects/301", "folders/201", "organizations/100"], "asset_type": "compute.googleapis.com/Subnetwork", "name": "//compute.googleapis.com/projects/host/regions/europe-west1/subnetworks/sub-overlap", "resource": {"data": {"ipCidrRange": "10.1.0.128/25", "name": "sub-overlap", "network": "https://www.googleapis.com/compute/v1/projects/host/global/networks/vpc-host"}, "discovery_name": "Subnetwork", "parent": "//cloudresourcemanager.googleapis.com/projects/301", "version": "v1"}, "update_time": "2020-06-01T00:00:00Z"}`
+	inventoryFile := filepath.Join(tempDir(t), "inventory.json")
+	if err := ioutil.WriteFile(inventoryFile, append(inventory, []byte(overlapping+"\n")...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, generator := generateGraph(t, false, func(ctx context.Context, generator *GcpViz) error {
+		return generator.ReadAssetsFromFile(ctx, inventoryFile, "")
+	})
+
+	expected := []SubnetworkOverlap{{
+		Subnetwork: appSubnetwork,
+		Cidr:       "10.1.0.0/24",
+		Other:      "//compute.googleapis.com/projects/host/regions/europe-west1/subnetworks/sub-overlap",
+		Range:      "10.1.0.128/25",
+	}}
+	if generator.Report == nil || !reflect.DeepEqual(generator.Report.IpOverlaps, expected) {
+		t.Errorf("expected IP overlaps %v in the report, got %+v", expected, generator.Report)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	unlabelled, labelled := loadFixture(t), loadLabelledFixture(t)
+
+	// Labels and tag values are only linked with label vertexes
+	if values := linked(unlabelled, appProject, "labelled"); len(values) > 0 {
+		t.Errorf("unexpected labels without label vertexes: %v", values)
+	}
+	if values := linked(unlabelled, appProject, "tagged"); len(values) > 0 {
+		t.Errorf("unexpected tag values without label vertexes: %v", values)
+	}
+
+	tests := []struct {
+		name      string
+		from      string
+		predicate string
+		to        string
+	}{
+		{"project label", appProject, "labelled", LabelVertex("team", "payments")},
+		{"bucket label", "//storage.googleapis.com/app-bucket", "labelled", LabelVertex("env", "prod")},
+		{"cloud sql user label", "//cloudsql.googleapis.com/projects/app/instances/sql-1", "labelled", LabelVertex("team", "data")},
+		{"label is also used", "//storage.googleapis.com/app-bucket", "uses", LabelVertex("team", "payments")},
+		{"tag binding", appProject, "tagged", "//cloudresourcemanager.googleapis.com/tagValues/501"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := linked(labelled, tt.from, tt.predicate)
+			if !contains(values, tt.to) {
+				t.Errorf("%s -%s-> %s not found, got %v", tt.from, tt.predicate, tt.to, values)
+			}
+		})
+	}
+
+	// Label vertexes are left out of statistics and do not join the resources with
+	// the same label into one component. Tag values are assets, which are already
+	// connected to the tagged resources via their tag bindings.
+	stats, err := unlabelled.Stats(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labelledStats, err := labelled.Stats(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labelledStats.Assets != stats.Assets {
+		t.Errorf("expected %d assets with label vertexes, got %d", stats.Assets, labelledStats.Assets)
+	}
+	if !reflect.DeepEqual(labelledStats.MostConnected, stats.MostConnected) {
+		t.Errorf("expected the most connected assets %v with label vertexes, got %v", stats.MostConnected, labelledStats.MostConnected)
+	}
+	componentSizes := func(stats *GraphStats) []int {
+		sizes := make([]int, 0, len(stats.Components))
+		for _, component := range stats.Components {
+			sizes = append(sizes, component.Size)
+		}
+		return sizes
+	}
+	if !reflect.DeepEqual(componentSizes(labelledStats), componentSizes(stats)) {
+		t.Errorf("expected components of %v assets with label vertexes, got %v", componentSizes(stats), componentSizes(labelledStats))
+	}
+	for _, component := range labelledStats.Components {
+		for _, assetType := range component.AssetTypes {
+			if assetType.Name == labelAssetType {
+				t.Errorf("component %s contains label vertexes", component.Root)
+			}
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	partnerNetwork := "//compute.googleapis.com/projects/partner/global/networks/vpc-partner"
+	graphFile, generator := generateGraph(t, false, func(ctx context.Context, generator *GcpViz) error {
+		return generator.ReadAssetsFromFiles(ctx, ParseInventoryFiles("example="+fixtureInventory+","+fixturePartner))
+	})
+	if generator.TotalDuplicates != 2 {
+		t.Errorf("expected 2 duplicate assets, got %d", generator.TotalDuplicates)
+	}
+	// The partner network peers with the host network in the other organization
+	if generator.TotalCrossOrg != 1 {
+		t.Errorf("expected 1 cross-organization reference, got %d", generator.TotalCrossOrg)
+	}
+	if !contains(generator.OrgRoots, "//cloudresourcemanager.googleapis.com/organizations/900") {
+		t.Errorf("expected the partner organization to be a root, got %v", generator.OrgRoots)
+	}
+
+	viz := loadGraph(t, graphFile)
+	if values := linked(viz, partnerNetwork, "peers_with"); !contains(values, hostNetwork) {
+		t.Errorf("%s -peers_with-> %s not found, got %v", partnerNetwork, hostNetwork, values)
+	}
+	// The newest copy of an asset wins, with the source of its export
+	tests := []struct {
+		name   string
+		status string
+		source string
+	}{
+		{"//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1", "RUNNING", "example"},
+		{"//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-2", "RUNNING", "partner"},
+		{partnerNetwork, "", "partner"},
+	}
+	for _, tt := range tests {
+		asset, err := viz.getAsset(tt.name)
+		if err != nil {
+			t.Errorf("asset %s not found: %v", tt.name, err)
+			continue
+		}
+		if status := stringField(asset.Resource.Data, "status"); status != tt.status || asset.Source != tt.source {
+			t.Errorf("expected %s to be %q from %s, got %q from %s", tt.name, tt.status, tt.source, status, asset.Source)
+		}
+	}
+
+	// A later copy wins ties, and changes in watch mode are not counted as duplicates
+	existing := []byte(`{"name": "a", "update_time": "2020-06-01T00:00:00Z", "resource": {"parent": "p"}}`)
+	merger := newTestViz(t)
+	for _, tt := range []struct {
+		updateTime string
+		replace    bool
+	}{
+		{"2020-05-01T00:00:00Z", false},
+		{"2020-06-01T00:00:00Z", true},
+		{"2020-07-01T00:00:00Z", true},
+	} {
+		replace, err := merger.mergeAsset(existing, "a", "p", map[string]interface{}{"update_time": tt.updateTime})
+		if err != nil || replace != tt.replace {
+			t.Errorf("expected a copy updated at %s to replace the asset: %v, got %v (%v)", tt.updateTime, tt.replace, replace, err)
+		}
+	}
+	merger.update = &graphUpdate{}
+	if _, err := merger.mergeAsset(existing, "a", "p", map[string]interface{}{}); err != nil || merger.TotalDuplicates != 3 {
+		t.Errorf("expected 3 duplicates, got %d (%v)", merger.TotalDuplicates, err)
+	}
+}
+
+func TestTerraform(t *testing.T) {
+	batchSubnetwork := "//compute.googleapis.com/projects/app/regions/europe-west1/subnetworks/sub-batch"
+	batchInstance := "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/batch-1"
+	graphFile, _ := generateGraph(t, false, func(ctx context.Context, generator *GcpViz) error {
+		if err := readFixture(ctx, generator); err != nil {
+			return err
+		}
+		return generator.ReadAssetsFromTerraform(ctx, fixtureTerraform)
+	})
+	viz := loadGraph(t, graphFile)
+
+	tests := []struct {
+		name    string
+		planned string
+		source  string
+	}{
+		{batchSubnetwork, "create", "terraform"},
+		{batchInstance, "create", "terraform"},
+		// Resources to be deleted are added from the prior state
+		{"//compute.googleapis.com/projects/app/zones/europe-west1-b/disks/scratch", "delete", "terraform"},
+		// Existing assets are only marked
+		{"//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-2", "update", ""},
+		{"//compute.googleapis.com/projects/app/global/firewalls/allow-ssh", "delete", ""},
+		{appNetwork, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(GetLastPart(tt.name), func(t *testing.T) {
+			asset, err := viz.getAsset(tt.name)
+			if err != nil {
+				t.Fatalf("asset %s not found: %v", tt.name, err)
+			}
+			if asset.Planned != tt.planned || asset.Source != tt.source {
+				t.Errorf("expected %s to be planned %q from %q, got %q from %q", tt.name, tt.planned, tt.source, asset.Planned, asset.Source)
+			}
+		})
+	}
+
+	// The unknown subnetwork of the planned instance is resolved from the configuration
+	if values := linked(viz, batchInstance, "uses"); !contains(values, batchSubnetwork) {
+		t.Errorf("%s -uses-> %s not found, got %v", batchInstance, batchSubnetwork, values)
+	}
+	if values := linked(viz, batchSubnetwork, "uses"); !contains(values, appNetwork) {
+		t.Errorf("%s -uses-> %s not found, got %v", batchSubnetwork, appNetwork, values)
+	}
+	// Projects are referred to by ID in Terraform and by number in the inventory
+	if values := linked(viz, appProject, "child"); !contains(values, batchSubnetwork) {
+		t.Errorf("expected %s to be in %s, got %v", batchSubnetwork, appProject, values)
+	}
+}
+
+func TestParseQueryParameter(t *testing.T) {
+	tests := []struct {
+		parameter string
+		name      string
+		value     interface{}
+		err       bool
+	}{
+		{"project=//cloudresourcemanager.googleapis.com/projects/302", "project", "//cloudresourcemanager.googleapis.com/projects/302", false},
+		{"filter=name=vm-1", "filter", "name=vm-1", false},
+		{"empty=", "empty", "", false},
+		{"depth:=3", "depth", float64(3), false},
+		{"stopped:=true", "stopped", true, false},
+		{`label:="team"`, "label", "team", false},
+		{`types:=["compute.googleapis.com/Instance"]`, "types", []interface{}{"compute.googleapis.com/Instance"}, false},
+		{`labels:={"team":"payments"}`, "labels", map[string]interface{}{"team": "payments"}, false},
+		{"project", "", nil, true},
+		{"=value", "", nil, true},
+		{"depth:=three", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.parameter, func(t *testing.T) {
+			name, value, err := ParseQueryParameter(tt.parameter)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if name != tt.name || !reflect.DeepEqual(value, tt.value) {
+				t.Errorf("expected %s=%#v, got %s=%#v", tt.name, tt.value, name, value)
+			}
+		})
+	}
+}
+
+func TestEscapeQueryParameter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{"string", "vm-1", "vm-1"},
+		{"string with quotes", `x"); g.V("y`, `x\"); g.V(\"y`},
+		{"string with single quotes and newlines", "it's\n", `it\'s\u000A`},
+		{"nil", nil, "<no value>"},
+		{"literal", QueryLiteral(`["a"]`), `["a"]`},
+		{"string list", []string{"//a", `b"`}, `[//a b\"]`},
+		{"number", float64(3), "3"},
+		{"boolean", true, "true"},
+		{"list", []interface{}{`a"`, float64(1)}, `[a\" 1]`},
+		{"object", map[string]interface{}{"team": `pay"ments`}, `map[team:pay\"ments]`},
+		{"struct", BlastRadiusAsset{Name: `a"`}, `map[asset_type: depth:0 name:a\"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			escaped, err := escapeQueryParameter(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := template.Must(template.New("query").Parse("{{ .value }}")).Execute(&out, map[string]interface{}{"value": escaped}); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, out.String())
+			}
+		})
+	}
+
+	if _, err := escapeQueryParameter(func() {}); err == nil {
+		t.Error("expected an error for a value that is not JSON")
+	}
+
+	// Parameters keep their values for template logic and are rendered as JavaScript
+	// literals with js
+	viz := newTestViz(t)
+	query := `{{ if .recursive }}{{ js .types }} {{ js .project }} {{ js .depth }}{{ end }}{{ if eq .project "a\"b" }} eq{{ end }}`
+	parameters := map[string]interface{}{"recursive": true, "types": []interface{}{`a"`, float64(1)}, "project": `a"b`, "depth": float64(2)}
+	rendered, err := viz.prepareQuery(query, parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `["a\"",1] "a\"b" 2 eq`; rendered != expected {
+		t.Errorf("expected %s, got %s", expected, rendered)
+	}
+	parameters["recursive"] = false
+	if rendered, err := viz.prepareQuery(query, parameters); err != nil || rendered != " eq" {
+		t.Errorf("expected false to be kept for template logic, got %q (%v)", rendered, err)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	viz := loadFixture(t)
+	query, err := ioutil.ReadFile("queries/everything.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parameters cannot break out of string literals in queries
+	gizmoQ, err := viz.prepareQuery(`g.V("{{ .project }}").all();`, map[string]interface{}{"project": `x"); g.V("y`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gizmoQ != `g.V("x\"); g.V(\"y").all();` {
+		t.Errorf("parameter not escaped in query: %s", gizmoQ)
+	}
+
+	viz.QueryLimit = 3
+	var wg sync.WaitGroup
+	wg.Add(1)
+	err = viz.GenerateNodes(&wg, context.Background(), string(query), map[string]interface{}{"Title": "limit"}, ioutil.Discard)
+	if !errors.Is(err, ErrQueryLimit) {
+		t.Errorf("expected the query limit to be exceeded, got %v", err)
+	}
+
+	viz.QueryLimit = 0
+	viz.QueryTimeout = time.Nanosecond
+	wg.Add(1)
+	err = viz.GenerateNodes(&wg, context.Background(), string(query), map[string]interface{}{"Title": "timeout"}, ioutil.Discard)
+	if !errors.Is(err, ErrQueryTimeout) {
+		t.Errorf("expected the query timeout to be exceeded, got %v", err)
+	}
+}
+
+func TestComponentPartitions(t *testing.T) {
+	resources := map[string]*TemplateResource{
+		"org":        {AssetType: "cloudresourcemanager.googleapis.com/Organization"},
+		"project":    {AssetType: "cloudresourcemanager.googleapis.com/Project"},
+		"network":    {AssetType: "compute.googleapis.com/Network"},
+		"subnetwork": {AssetType: "compute.googleapis.com/Subnetwork"},
+		"instance":   {AssetType: "compute.googleapis.com/Instance"},
+		"dataset":    {AssetType: "bigquery.googleapis.com/Dataset"},
+		"table":      {AssetType: "bigquery.googleapis.com/Table"},
+		"topic":      {AssetType: "pubsub.googleapis.com/Topic"},
+		"label":      {AssetType: labelAssetType},
+	}
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tests := []struct {
+		name     string
+		edges    [][2]string
+		expected map[string]string
+	}{
+		{
+			"no edges",
+			nil,
+			map[string]string{"org": hierarchyPartition, "project": hierarchyPartition, "network": unconnectedPartition, "subnetwork": unconnectedPartition, "instance": unconnectedPartition, "dataset": unconnectedPartition, "table": unconnectedPartition, "topic": unconnectedPartition, "label": unconnectedPartition},
+		},
+		{
+			"largest component first",
+			[][2]string{{"subnetwork", "network"}, {"instance", "subnetwork"}, {"table", "dataset"}},
+			map[string]string{"org": hierarchyPartition, "project": hierarchyPartition, "network": "component-1", "subnetwork": "component-1", "instance": "component-1", "dataset": "component-2", "table": "component-2", "topic": unconnectedPartition, "label": unconnectedPartition},
+		},
+		{
+			// The resource hierarchy and labels would join everything
+			"hierarchy and labels do not connect",
+			[][2]string{{"network", "project"}, {"topic", "project"}, {"project", "org"}, {"network", "label"}, {"topic", "label"}, {"table", "dataset"}},
+			map[string]string{"org": hierarchyPartition, "project": hierarchyPartition, "network": unconnectedPartition, "subnetwork": unconnectedPartition, "instance": unconnectedPartition, "dataset": "component-1", "table": "component-1", "topic": unconnectedPartition, "label": unconnectedPartition},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edges := make([]tileEdge, 0, len(tt.edges))
+			for _, edge := range tt.edges {
+				edges = append(edges, tileEdge{user: edge[0], used: edge[1]})
+			}
+			partitions, order := componentPartitions(names, resources, edges)
+			if !reflect.DeepEqual(partitions, tt.expected) {
+				t.Errorf("expected partitions %v, got %v", tt.expected, partitions)
+			}
+			if order[hierarchyPartition] != 0 {
+				t.Errorf("expected the resource hierarchy to come first, got %v", order)
+			}
+			for partition := range order {
+				if partition != unconnectedPartition && order[partition] > order[unconnectedPartition] {
+					t.Errorf("expected unconnected resources to come last, got %v", order)
+				}
+			}
+		})
+	}
+}
+
+func TestTiles(t *testing.T) {
+	viz := loadFixture(t)
+	query, err := ioutil.ReadFile("queries/everything.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, partitionBy := range []string{PartitionByFolder, PartitionByProject, PartitionByComponent} {
+		t.Run(partitionBy, func(t *testing.T) {
+			dir := tempDir(t)
+			err := viz.GenerateTiles(context.Background(), string(query), map[string]interface{}{"Title": partitionBy}, dir, partitionBy)
+			if err != nil {
+				t.Fatalf("failed to generate tiles: %v", err)
+			}
+			tiles, err := filepath.Glob(filepath.Join(dir, "*.gv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tiles) < 2 {
+				t.Errorf("expected the graph to be split into tiles, got %v", tiles)
+			}
+			index, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tile := range tiles {
+				link := strings.TrimSuffix(filepath.Base(tile), ".gv") + ".svg"
+				if !bytes.Contains(index, []byte(link)) {
+					t.Errorf("expected index to link to %s", link)
+				}
+			}
+		})
+	}
+
+	if err := viz.GenerateTiles(context.Background(), string(query), nil, tempDir(t), "region"); err == nil {
+		t.Error("expected an error for an unknown partition")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	vm2 := "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-2"
+	dir := tempDir(t)
+	graphFile := filepath.Join(dir, "graph.db")
+
+	// The second snapshot is taken after vm-2 has been deleted
+	inventory, err := ioutil.ReadFile(fixtureInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var later bytes.Buffer
+	for _, line := range bytes.SplitAfter(inventory, []byte("\n")) {
+		if !bytes.Contains(line, []byte(`"name": "`+vm2+`"`)) {
+			later.Write(line)
+		}
+	}
+	if later.Len() == len(inventory) {
+		t.Fatalf("%s not found in %s", vm2, fixtureInventory)
+	}
+	laterInventory := filepath.Join(dir, "later.json")
+	if err := ioutil.WriteFile(laterInventory, later.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+	snapshots := []struct {
+		inventory string
+		at        time.Time
+	}{
+		{fixtureInventory, first},
+		{laterInventory, second},
+		// Snapshots can only be appended
+		{fixtureInventory, first},
+	}
+	for idx, snapshot := range snapshots {
+		generator := newTestViz(t)
+		generator.SnapshotTime = snapshot.at
+		err := generator.Create(graphFile)
+		if idx == len(snapshots)-1 {
+			if err == nil {
+				generator.Abort()
+				t.Error("expected an error for a snapshot older than the latest one")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to create snapshot %s: %v", snapshot.at, err)
+		}
+		if err := generator.ReadAssetsFromFile(context.Background(), snapshot.inventory, ""); err != nil {
+			generator.Abort()
+			t.Fatalf("failed to read assets: %v", err)
+		}
+		if err := generator.EnrichAssets(context.Background()); err != nil {
+			t.Fatalf("failed to enrich assets: %v", err)
+		}
+		if err := generator.Save(); err != nil {
+			t.Fatalf("failed to save snapshot: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		asOf     time.Time
+		snapshot string
+		exists   bool
+	}{
+		{"latest", time.Time{}, "", false},
+		{"first snapshot", first, "2020-06-01T00:00:00Z", true},
+		{"between snapshots", first.Add(24 * time.Hour), "2020-06-01T00:00:00Z", true},
+		{"second snapshot", second, "2020-07-01T00:00:00Z", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := make([]string, 0)
+			viz, err := New(WithRelationsFile("relations.yaml"), WithLabelsFile("labels.yaml"), WithStyleFiles("style.yaml"), WithProgress(func(event ProgressEvent) {
+				if event.Phase == PhaseLoad {
+					messages = append(messages, event.Message)
+				}
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			viz.AsOf = tt.asOf
+			if err := viz.Load(graphFile); err != nil {
+				t.Fatalf("failed to load graph: %v", err)
+			}
+			defer viz.AssetDatabase.Close()
+
+			if tt.snapshot != "" && !contains(messages, fmt.Sprintf("Using snapshot %s.", tt.snapshot)) {
+				t.Errorf("expected snapshot %s to be used, got %v", tt.snapshot, messages)
+			}
+			if exists := contains(linked(viz, appProject, "child"), vm2); exists != tt.exists {
+				t.Errorf("expected %s to be in the graph: %v, got %v", vm2, tt.exists, exists)
+			}
+			if _, err := viz.getAsset(vm2); (err == nil) != tt.exists {
+				t.Errorf("expected %s to be an asset: %v, got %v", vm2, tt.exists, err)
+			}
+		})
+	}
+
+	viz := newTestViz(t)
+	viz.AsOf = first.Add(-time.Hour)
+	if err := viz.Load(graphFile); err == nil {
+		viz.AssetDatabase.Close()
+		t.Error("expected an error for a time before the first snapshot")
+	}
+}
+
+func TestLenient(t *testing.T) {
+	inventory, err := ioutil.ReadFile(fixtureInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(inventory, []byte("\n"))
+	broken := bytes.Join(append(lines[:2:2], append([][]byte{[]byte("{\"name\": \n")}, lines[2:]...)...), nil)
+	brokenInventory := filepath.Join(tempDir(t), "broken.json")
+	if err := ioutil.WriteFile(brokenInventory, broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	generator := newTestViz(t)
+	if err := generator.Create(filepath.Join(tempDir(t), "graph.db")); err != nil {
+		t.Fatal(err)
+	}
+	err = generator.ReadAssetsFromFile(context.Background(), brokenInventory, "")
+	generator.Abort()
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected an error on line 3, got %v", err)
+	}
+
+	graphFile, generator := generateGraph(t, false, func(ctx context.Context, generator *GcpViz) error {
+		generator.Lenient = true
+		return generator.ReadAssetsFromFile(ctx, brokenInventory, "")
+	})
+	report := generator.Report
+	if !report.Lenient || report.SkippedAssets != 1 {
+		t.Errorf("expected one skipped asset in a lenient report, got %d (lenient: %v)", report.SkippedAssets, report.Lenient)
+	}
+	if len(report.ParseFailures) != 1 || report.ParseFailures[0].File != brokenInventory || report.ParseFailures[0].Line != 3 {
+		t.Errorf("expected a parse failure on line 3 of %s, got %+v", brokenInventory, report.ParseFailures)
+	}
+	if _, err := loadGraph(t, graphFile).getAsset(organization); err != nil {
+		t.Errorf("expected the other assets to be read: %v", err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	viz := loadFixture(t)
+	tx, err := viz.AssetDatabase.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets := tx.Bucket([]byte("Assets")).Stats().KeyN
+	tx.Rollback()
+
+	t.Run("json", func(t *testing.T) {
+		dir := tempDir(t)
+		if err := viz.Export(context.Background(), dir, "json"); err != nil {
+			t.Fatalf("failed to export: %v", err)
+		}
+		nodes, err := ioutil.ReadFile(filepath.Join(dir, "nodes.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.Split(bytes.TrimSpace(nodes), []byte("\n"))
+		if len(lines) != assets {
+			t.Errorf("expected %d nodes, got %d", assets, len(lines))
+		}
+		var node map[string]interface{}
+		if err := json.Unmarshal(lines[0], &node); err != nil {
+			t.Errorf("expected newline delimited JSON, got %v", err)
+		}
+		if _, ok := node["data"].(string); !ok {
+			t.Errorf("expected data to be exported as a JSON string, got %v", node["data"])
+		}
+		for _, table := range []string{"nodes", "edges"} {
+			var schema []map[string]string
+			jsn, err := ioutil.ReadFile(filepath.Join(dir, table+".schema.json"))
+			if err == nil {
+				err = json.Unmarshal(jsn, &schema)
+			}
+			if err != nil || len(schema) == 0 {
+				t.Errorf("expected a BigQuery schema for %s, got %v", table, err)
+			}
+		}
+		if edges, err := ioutil.ReadFile(filepath.Join(dir, "edges.json")); err != nil || !bytes.Contains(edges, []byte(`"relation":"uses"`)) {
+			t.Errorf("expected edges to be exported, got %v", err)
+		}
+	})
+
+	t.Run("avro", func(t *testing.T) {
+		dir := tempDir(t)
+		if err := viz.Export(context.Background(), dir, "avro"); err != nil {
+			t.Fatalf("failed to export: %v", err)
+		}
+		for _, table := range []string{"nodes", "edges"} {
+			data, err := ioutil.ReadFile(filepath.Join(dir, table+".avro"))
+			if err != nil || !bytes.HasPrefix(data, []byte("Obj\x01")) {
+				t.Errorf("expected an Avro container file for %s, got %v", table, err)
+			}
+			var schema map[string]interface{}
+			jsn, err := ioutil.ReadFile(filepath.Join(dir, table+".avsc"))
+			if err == nil {
+				err = json.Unmarshal(jsn, &schema)
+			}
+			if err != nil || schema["type"] != "record" {
+				t.Errorf("expected an Avro schema for %s, got %v (%v)", table, schema, err)
+			}
+		}
+	})
+
+	if err := viz.Export(context.Background(), tempDir(t), "csv"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	viz := loadFixture(t)
+	problems, err := viz.ValidateConfig("relations.yaml", "labels.yaml", []string{"style.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		if problem.Severity == SeverityError {
+			t.Errorf("unexpected problem in shipped configuration: %+v", problem)
+		}
+	}
+
+	labels := filepath.Join(tempDir(t), "labels.yaml")
+	err = ioutil.WriteFile(labels, []byte(`compute.googleapis.com/Instance:
+  lable: "{{ .Resource.Data.name }}"
+compute.googleapis.com/Instanse:
+  label: "{{ .Resource.Data.name }}"
+Compute/Instance:
+  label: "instance"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err = viz.ValidateConfig("relations.yaml", labels, []string{"style.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigProblem{
+		{SeverityError, labels, "compute.googleapis.com/Instance.lable", `unknown key "lable" (expected label, headLabel, tailLabel or link)`},
+		{SeverityError, labels, "Compute/Instance", `"Compute/Instance" is not a valid asset type name`},
+		{SeverityWarning, "", "compute.googleapis.com/Instanse", "asset type does not occur in the graph, did you mean compute.googleapis.com/Instance?"},
+	}
+	for _, problem := range expected {
+		found := false
+		for _, p := range problems {
+			found = found || p == problem
+		}
+		if !found {
+			t.Errorf("expected problem %+v, got %+v", problem, problems)
+		}
+	}
+}
+
+func TestMergeAttributes(t *testing.T) {
+	tests := []struct {
+		attributes string
+		other      string
+		expected   string
+	}{
+		{`shape=tab,fontcolor=white,style="filled",fillcolor="#eee8d5",fontcolor="black"`, `fillcolor="#dc322f",color="#dc322f",fontcolor=white`, `shape=tab,fontcolor=white,style="filled",fillcolor="#dc322f",color="#dc322f"`},
+		{`label="a, b",fillcolor=red`, ` fillcolor=blue `, `label="a, b",fillcolor=blue`},
+		{`label=<<b>a, b</b>>, tooltip="\"x, y\""`, `label="c"`, `label="c",tooltip="\"x, y\""`},
+	}
+	for _, tt := range tests {
+		if merged := mergeAttributes(tt.attributes, tt.other); merged != tt.expected {
+			t.Errorf("expected %s, got %s", tt.expected, merged)
+		}
+	}
+}
+
+func TestThemes(t *testing.T) {
+	newStyle := func() GraphStyle {
+		return GraphStyle{
+			Global:    map[string]string{"graph": `bgcolor="#002b36", fontcolor="#93a1a1"`},
+			Relations: map[string]string{"uses": `color="#93a1a1"`},
+			Nodes: map[string]string{
+				"filled":   `style=filled, fillcolor="#268bd2", fontcolor="#ffffff"`,
+				"template": `style=filled, fillcolor="{{ .Color }}", fontcolor="#ffffff"`,
+				"outline":  `color="#dc322f", fontcolor="#93a1a1"`,
+				"gradient": `style=filled, fillcolor="#268bd2;0.3:#2aa198", fontcolor="#ffffff"`,
+				"hidden":   `color=none, fontcolor="#93a1a1"`,
+			},
+		}
+	}
+
+	tests := []struct {
+		theme    string
+		expected GraphStyle
+	}{
+		{"dark", newStyle()},
+		{"print", GraphStyle{
+			Global:    map[string]string{"graph": `bgcolor="white", fontcolor="black"`},
+			Relations: map[string]string{"uses": `color="black"`},
+			Nodes: map[string]string{
+				"filled": `style=filled, fillcolor="#eeeeee", fontcolor="black"`,
+				// Template actions are left as they are
+				"template": `style=filled, fillcolor="{{ .Color }}", fontcolor="#ffffff"`,
+				"outline":  `color="black", fontcolor="black"`,
+				"gradient": `style=filled, fillcolor="#eeeeee;0.3:#eeeeee", fontcolor="black"`,
+				// Transparent colors are not matched by "*"
+				"hidden": `color=none, fontcolor="black"`,
+			},
+		}},
+		{"colorblind", GraphStyle{
+			Global:    map[string]string{"graph": `bgcolor="#002b36", fontcolor="#93a1a1"`},
+			Relations: map[string]string{"uses": `color="#93a1a1"`},
+			Nodes: map[string]string{
+				"filled":   `style=filled, fillcolor="#0072b2", fontcolor="#ffffff"`,
+				"template": `style=filled, fillcolor="{{ .Color }}", fontcolor="#ffffff"`,
+				"outline":  `color="#d55e00", fontcolor="#93a1a1"`,
+				"gradient": `style=filled, fillcolor="#0072b2;0.3:#56b4e9", fontcolor="#ffffff"`,
+				"hidden":   `color=none, fontcolor="#93a1a1"`,
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.theme, func(t *testing.T) {
+			style := newStyle()
+			if err := style.ApplyTheme(tt.theme); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(style, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, style)
+			}
+		})
+	}
+
+	style := newStyle()
+	err := style.ApplyTheme("neon")
+	if err == nil {
+		t.Fatal("expected an error for an unknown theme")
+	}
+	if !strings.Contains(err.Error(), "available: colorblind, dark, light, print") {
+		t.Errorf("expected sorted theme names, got %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	vm1 := "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1"
+	metricsFile := filepath.Join(tempDir(t), "metrics.csv")
+	err := ioutil.WriteFile(metricsFile, []byte("name,cpu,team\n"+vm1+",10,payments\n"+vm1+",5,payments\napp,90,\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viz := newTestViz(t)
+	if err := viz.LoadMetrics(metricsFile, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	resources := []struct {
+		resource *TemplateResource
+		expected NodeMetrics
+	}{
+		// Numeric values of duplicate keys are summed up
+		{&TemplateResource{Name: vm1}, NodeMetrics{"cpu": float64(15), "team": "payments"}},
+		// Projects are also found by project ID
+		{&TemplateResource{Name: appProject, AssetType: "cloudresourcemanager.googleapis.com/Project", Resource: TemplateResourceResource{Data: map[string]interface{}{"projectId": "app"}}}, NodeMetrics{"cpu": float64(90), "team": ""}},
+		{&TemplateResource{Name: appNetwork}, nil},
+	}
+	for _, tt := range resources {
+		if metrics := viz.metricsFor(tt.resource); !reflect.DeepEqual(metrics, tt.expected) {
+			t.Errorf("expected metrics %v for %s, got %v", tt.expected, tt.resource.Name, metrics)
+		}
+	}
+	if viz.MetricMin("cpu") != 15 || viz.MetricMax("cpu") != 90 {
+		t.Errorf("expected cpu to range from 15 to 90, got %v", viz.MetricRanges["cpu"])
+	}
+	// Metrics are loaded per graph
+	if other := newTestViz(t); other.MetricMax("cpu") != 0 {
+		t.Errorf("expected no cpu range in another graph, got %v", other.MetricRanges["cpu"])
+	}
+
+	tests := []struct {
+		value interface{}
+		scale float64
+		color string
+	}{
+		{float64(15), 0, "#859900"},
+		{"52.5", 5, "#b58900"},
+		{int64(90), 10, "#dc322f"},
+		// Values are clamped to the range
+		{float64(200), 10, "#dc322f"},
+		{"n/a", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.value), func(t *testing.T) {
+			if scale := ScaleValue(tt.value, viz.MetricMin("cpu"), viz.MetricMax("cpu"), 0, 10); scale != tt.scale {
+				t.Errorf("expected %v to scale to %v, got %v", tt.value, tt.scale, scale)
+			}
+			if color := viz.HeatColor("cpu", tt.value); color != tt.color {
+				t.Errorf("expected %v to be colored %q, got %q", tt.value, tt.color, color)
+			}
+		})
+	}
+	if color := ColorScale(float64(0.5), 0, 1, "#000000", "#ffffff"); color != "#808080" {
+		t.Errorf("expected the color between black and white to be #808080, got %s", color)
+	}
+}
+
+func TestEnrichment(t *testing.T) {
+	viz := loadFixture(t)
+
+	network, err := viz.getAsset(hostNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := network.Resource.Data.(map[string]interface{})
+	subnetworks, ok := data["subnetworkConfig"].([]interface{})
+	if !ok || len(subnetworks) != 1 {
+		t.Fatalf("expected one enriched subnetwork in subnetworkConfig, got %v", data["subnetworkConfig"])
+	}
+	if cidr := subnetworks[0].(map[string]interface{})["ipCidrRange"]; cidr != "10.0.0.0/24" {
+		t.Errorf("unexpected range of enriched subnetwork: %v", cidr)
+	}
+
+	account, err := viz.getAsset(serviceAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, ok := account.Resource.Data.(map[string]interface{})["serviceAccountKeys"].([]interface{}); !ok || len(keys) != 2 {
+		t.Errorf("expected two enriched keys in serviceAccountKeys, got %v", keys)
+	}
+
+	tests := []struct {
+		name     string
+		asset    string
+		field    string
+		expected interface{}
+	}{
+		{"count", appSubnetwork, "instanceCount", float64(2)},
+		{"sum", "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1", "diskSizeGb", float64(50)},
+		{"distinct", appProject, "serviceAccounts", []interface{}{"app-sa@app.iam.gserviceaccount.com"}},
+		{"named relation", serviceAccount, "workloads", float64(5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asset, err := viz.getAsset(tt.asset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value := asset.Resource.Computed[tt.field]
+			if !reflect.DeepEqual(value, tt.expected) {
+				t.Errorf("computed field %s of %s: expected %#v, got %#v", tt.field, tt.asset, tt.expected, value)
+			}
+		})
+	}
+}
+
+func TestTemplateFunctions(t *testing.T) {
+	selfLink := "https://www.googleapis.com/compute/v1/projects/app/zones/europe-west1-b/instances/vm-1"
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{"GetProject", GetProject(selfLink), "app"},
+		{"GetZone", GetZone(selfLink), "europe-west1-b"},
+		{"GetPartAfter missing", GetPartAfter("regions", selfLink), ""},
+		{"GetPartFromEnd", GetPartFromEnd(selfLink, 2), "instances"},
+		{"GetPartFromEnd out of range", GetPartFromEnd("a/b", 5), ""},
+		{"Default empty", Default("none", ""), "none"},
+		{"Default value", Default("none", "value"), "value"},
+		{"GetLabel", GetLabel(map[string]interface{}{"env": "prod"}, "env", "-"), "prod"},
+		{"GetLabel missing", GetLabel(nil, "env", "-"), "-"},
+		{"HtmlEscape", HtmlEscape("<a & b>"), "&lt;a &amp; b&gt;"},
+		{"HumanizeBytes", HumanizeBytes(1536), "1.5 KiB"},
+		{"HumanizeBytes with unit", HumanizeBytes("2048", "GiB"), "2 TiB"},
+		{"HumanizeBytes invalid", HumanizeBytes("large"), ""},
+		{"HumanizeDuration seconds", HumanizeDuration(93600), "1d 2h"},
+		{"HumanizeDuration string", HumanizeDuration("90m"), "1h 30m"},
+		{"HumanizeDuration zero", HumanizeDuration(0), "0s"},
+		{"CidrSize", CidrSize("10.0.0.0/24"), int64(256)},
+		{"CidrSize invalid", CidrSize("10.0.0.0"), int64(0)},
+		{"CidrFirst", CidrFirst("10.0.1.17/20"), "10.0.0.0"},
+		{"CidrLast", CidrLast("10.0.0.0/20"), "10.0.15.255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.value, tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, tt.value)
+			}
+		})
+	}
+
+	// GetAsset looks up assets from the graph executing the template, even when
+	// another graph was created later
+	viz := loadFixture(t)
+	other := newTestViz(t)
+	getNetwork, err := template.New("network").Funcs(templateFuncMap).Parse(`{{ with GetAsset .Resource.Data.network }}{{ .Resource.Data.name }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnetwork, err := viz.getAsset(appSubnetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		viz      *GcpViz
+		expected string
+	}{{viz, "vpc-app"}, {other, ""}} {
+		var out bytes.Buffer
+		if err := tt.viz.executeTemplate(getNetwork, &out, subnetwork); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.expected {
+			t.Errorf("expected GetAsset to return %q, got %q", tt.expected, out.String())
+		}
+	}
+}
+
+func TestLayoutEdgeAttributes(t *testing.T) {
+	viz, err := New(WithRelationsFile("relations.yaml"), WithLabelsFile("labels.yaml"), WithStyleFiles("style.yaml"), WithLayout("hierarchical"), WithProgress(func(ProgressEvent) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	viz.layoutNodes = make(map[int64]layoutNode, 0)
+	nodes := []TemplateResource{
+		{AssetType: "cloudresourcemanager.googleapis.com/Organization", Ancestors: []string{"organizations/100"}},
+		{AssetType: "cloudresourcemanager.googleapis.com/Folder", Ancestors: []string{"folders/200", "organizations/100"}},
+		{AssetType: "cloudresourcemanager.googleapis.com/Folder", Ancestors: []string{"folders/202", "folders/200", "organizations/100"}},
+		{AssetType: "cloudresourcemanager.googleapis.com/Project", Ancestors: []string{"projects/302", "folders/202", "folders/200", "organizations/100"}},
+		{AssetType: "cloudresourcemanager.googleapis.com/Project", Ancestors: []string{"projects/303", "organizations/100"}},
+		{AssetType: "compute.googleapis.com/Network", Ancestors: []string{"projects/302"}},
+		{AssetType: "compute.googleapis.com/Network", Ancestors: []string{"projects/303"}},
+		{AssetType: "compute.googleapis.com/Instance", Ancestors: []string{"projects/302"}},
+	}
+	for idx := range nodes {
+		viz.addLayoutNode(int64(idx), &nodes[idx])
+	}
+
+	tests := []struct {
+		name     string
+		user     int64
+		used     int64
+		expected string
+	}{
+		{"folder in organization", 1, 0, "weight=10"},
+		{"folder in folder", 2, 1, "weight=10"},
+		{"project in folder", 3, 2, "weight=10"},
+		{"network in project", 5, 3, "weight=10"},
+		{"project in organization skips levels", 4, 0, "constraint=false"},
+		{"peering", 5, 6, "constraint=false"},
+		{"asset outside of the hierarchy", 7, 3, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if attributes := viz.layoutEdgeAttributes(tt.user, tt.used); attributes != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, attributes)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	viz := loadFixture(t)
+
+	stats, err := viz.Stats(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Assets != 68 {
+		t.Errorf("expected 68 assets, got %d", stats.Assets)
+	}
+	if len(stats.MostConnected) != 3 || stats.MostConnected[0].Name != serviceAccount {
+		t.Errorf("expected %s to be the most connected of 3 assets, got %v", serviceAccount, stats.MostConnected)
+	}
+	// The topic without subscriptions only uses its project, the resource hierarchy
+	// itself is never orphaned
+	orphans := make([]string, 0)
+	for _, orphan := range stats.Orphans {
+		orphans = append(orphans, orphan.Name)
+		if isHierarchyAssetType(orphan.AssetType) {
+			t.Errorf("resource hierarchy asset %s is orphaned", orphan.Name)
+		}
+	}
+	if !contains(orphans, "//pubsub.googleapis.com/projects/app/topics/unused") {
+		t.Errorf("expected the unused topic to be orphaned, got %v", orphans)
+	}
+	if contains(orphans, "//pubsub.googleapis.com/projects/app/topics/events") {
+		t.Errorf("topic with a subscription is orphaned: %v", orphans)
+	}
+	if len(stats.Components) == 0 || stats.Components[0].Root != appNetwork {
+		t.Errorf("expected the largest component to be around %s, got %v", appNetwork, stats.Components)
+	}
+	for _, component := range stats.Components {
+		for _, assetType := range component.AssetTypes {
+			if isHierarchyAssetType(assetType.Name) {
+				t.Errorf("component %s contains resource hierarchy assets", component.Root)
+			}
+		}
+	}
+	projects := make(map[string]int, 0)
+	for _, project := range stats.Projects {
+		projects[project.Title] = project.Count
+	}
+	if projects["host"] != 12 || projects["app"] != 48 {
+		t.Errorf("unexpected assets per project: %v", stats.Projects)
+	}
+
+	var out bytes.Buffer
+	if err := viz.WriteStats(context.Background(), &out, "csv", 0); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestBlastRadius(t *testing.T) {
+	viz := loadFixture(t)
+
+	forwardingRule := "//compute.googleapis.com/projects/app/global/forwardingRules/gfr-1"
+	instanceGroupManager := "//compute.googleapis.com/projects/app/zones/europe-west1-b/instanceGroupManagers/igm-1"
+	tests := []struct {
+		name      string
+		asset     string
+		depth     int
+		stop      []string
+		expected  []string
+		missing   []string
+		truncated bool
+	}{
+		{"transitive", appSubnetwork, 0, nil, []string{forwardingRule, instanceGroupManager}, []string{appNetwork}, false},
+		{"depth", appSubnetwork, 2, nil, []string{instanceGroupManager}, []string{forwardingRule}, true},
+		{"stop list", appSubnetwork, 0, []string{"compute.googleapis.com/BackendService"}, []string{"//compute.googleapis.com/projects/app/global/backendServices/bs-1"}, []string{forwardingRule}, false},
+		{"alias", "app-sa@app.iam.gserviceaccount.com", 0, nil, []string{"//compute.googleapis.com/projects/app/global/firewalls/allow-ssh"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			radius, err := viz.BlastRadius(context.Background(), tt.asset, tt.depth, tt.stop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			affected := make([]string, len(radius.Assets))
+			for idx, asset := range radius.Assets {
+				affected[idx] = asset.Name
+				if tt.depth > 0 && asset.Depth > tt.depth {
+					t.Errorf("%s is beyond depth %d", asset.Name, tt.depth)
+				}
+			}
+			for _, name := range tt.expected {
+				if !contains(affected, name) {
+					t.Errorf("expected %s in blast radius, got %v", name, affected)
+				}
+			}
+			for _, name := range tt.missing {
+				if contains(affected, name) {
+					t.Errorf("unexpected %s in blast radius", name)
+				}
+			}
+			if radius.Truncated != tt.truncated {
+				t.Errorf("expected truncated to be %v", tt.truncated)
+			}
+		})
+	}
+
+	// Dependents that are not assets do not truncate the radius
+	radius, err := viz.BlastRadius(context.Background(), appSubnetwork, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deepest := radius.Assets[len(radius.Assets)-1]
+	viz.QW.AddQuad(cayley.Quad("10.0.0.1", "uses", deepest.Name, ""))
+	if radius, err = viz.BlastRadius(context.Background(), appSubnetwork, deepest.Depth, nil); err != nil {
+		t.Fatal(err)
+	}
+	if radius.Truncated {
+		t.Errorf("expected blast radius up to depth %d not to be truncated", deepest.Depth)
+	}
+
+	if _, err := viz.BlastRadius(context.Background(), "//compute.googleapis.com/projects/app/global/networks/missing", 0, nil); err == nil {
+		t.Error("expected an error for an asset that is not in the graph")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	graphFile, _ := generateFixture(t, true)
+	hostSubnetwork := "//compute.googleapis.com/projects/host/regions/europe-west1/subnetworks/sub-host"
+	newAccount := "//iam.googleapis.com/projects/app/serviceAccounts/222"
+
+	// Changes as published by a feed: a deleted and an updated subnetwork, a new
+	// service account and a message that is not a temporal asset
+	changes := []string{
+		`{"asset": {"name": "` + appSubnetwork + `", "assetType": "compute.googleapis.com/Subnetwork"}, "deleted": true, "window": {"startTime": "2020-07-01T00:00:00Z"}}`,
+		`{"asset": {"name": "` + hostSubnetwork + `", "assetType": "compute.googleapis.com/Subnetwork", "ancestors": ["projects/301", "folders/201", "organizations/100"],
+			"resource": {"version": "v1", "discoveryName": "Subnetwork", "parent": "//cloudresourcemanager.googleapis.com/projects/301",
+			"data": {"name": "sub-host", "ipCidrRange": "10.0.8.0/22", "network": "https://www.googleapis.com/compute/v1/projects/host/global/networks/vpc-host"}},
+			"updateTime": "2020-07-01T00:00:00Z"}}`,
+		`{"asset": {"name": "` + newAccount + `", "assetType": "iam.googleapis.com/ServiceAccount", "ancestors": ["projects/302", "folders/202", "folders/200", "organizations/100"],
+			"resource": {"version": "v1", "discoveryName": "ServiceAccount", "parent": "` + appProject + `",
+			"data": {"email": "batch-sa@app.iam.gserviceaccount.com", "uniqueId": "222"}},
+			"updateTime": "2020-07-01T00:00:00Z"}}`,
+		`{"message": "not a temporal asset"}`,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pulled := false
+	acknowledged := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/p/subscriptions/s:pull":
+			received := make([]map[string]interface{}, 0)
+			if !pulled {
+				for idx, change := range changes {
+					received = append(received, map[string]interface{}{
+						"ackId":   fmt.Sprintf("ack-%d", idx),
+						"message": PubSubMessage{Data: []byte(change), MessageId: fmt.Sprint(idx)},
+					})
+				}
+				pulled = true
+			} else {
+				// Stop watching once the changes are applied
+				cancel()
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"receivedMessages": received})
+		case "/v1/projects/p/subscriptions/s:acknowledge":
+			var request struct {
+				AckIds []string `json:"ackIds"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			acknowledged = append(acknowledged, request.AckIds...)
+			w.Write([]byte("{}"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	watcher := newTestViz(t)
+	watcher.LabelVertexes = true
+	warnings := make([]string, 0)
+	watcher.Progress = func(event ProgressEvent) {
+		if event.Phase == PhaseWatch && event.Level == LevelWarning {
+			warnings = append(warnings, event.Message)
+		}
+	}
+	updates := 0
+	sub := &PubSubSubscription{Name: "projects/p/subscriptions/s", Endpoint: server.URL}
+	err := watcher.Watch(ctx, graphFile, sub, func() error {
+		updates++
+		_, err := watcher.getAsset(newAccount)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to watch: %v", err)
+	}
+	if updates != 1 {
+		t.Errorf("expected one update, got %d", updates)
+	}
+	if len(acknowledged) != len(changes) {
+		t.Errorf("expected all messages to be acknowledged, got %v", acknowledged)
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "skipping message 3") {
+		t.Errorf("expected a warning about the message that is not a temporal asset, got %v", warnings)
+	}
+
+	viz := newTestViz(t)
+	if err := viz.Load(graphFile); err != nil {
+		t.Fatalf("failed to load graph: %v", err)
+	}
+	defer viz.AssetDatabase.Close()
+
+	if _, err := viz.getAsset(appSubnetwork); err == nil {
+		t.Error("expected deleted subnetwork to be removed from assets")
+	}
+	children := linked(viz, appProject, "child")
+	if contains(children, appSubnetwork) || !contains(children, newAccount) {
+		t.Errorf("unexpected children of project: %v", children)
+	}
+	dangling := false
+	for _, references := range watcher.Report.DanglingReferences {
+		for _, reference := range references.Examples {
+			dangling = dangling || strings.HasSuffix(reference.To, "/subnetworks/sub-app")
+		}
+	}
+	if !dangling {
+		t.Error("expected references to deleted subnetwork to be reported as dangling")
+	}
+
+	network, err := viz.getAsset(hostNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnetworks, ok := network.Resource.Data.(map[string]interface{})["subnetworkConfig"].([]interface{})
+	if !ok || len(subnetworks) != 1 || subnetworks[0].(map[string]interface{})["ipCidrRange"] != "10.0.8.0/22" {
+		t.Errorf("expected network to be enriched with updated subnetwork, got %v", subnetworks)
+	}
+	if labels := linked(viz, appProject, "labelled"); !contains(labels, LabelVertex("team", "payments")) {
+		t.Errorf("expected labels to be linked again, got %v", labels)
+	}
+}
+
+// graphContents returns the sorted quads, the assets and the aliases of a graph.
+func graphContents(t *testing.T, viz *GcpViz) ([]string, map[string]interface{}, map[string]string) {
+	t.Helper()
+	quads := make([]string, 0)
+	it := viz.QS.QuadsAllIterator()
+	for it.Next(context.Background()) {
+		quads = append(quads, viz.QS.Quad(it.Result()).String())
+	}
+	sort.Strings(quads)
+
+	assets := make(map[string]interface{}, 0)
+	aliases := make(map[string]string, 0)
+	tx, err := viz.AssetDatabase.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		var asset interface{}
+		if err := json.Unmarshal(bv, &asset); err != nil {
+			return err
+		}
+		assets[string(k)] = asset
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Bucket([]byte("Aliases")).ForEach(func(k, bv []byte) error {
+		aliases[string(k)] = string(bv)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return quads, assets, aliases
+}
+
+func TestApplyChanges(t *testing.T) {
+	data, err := ioutil.ReadFile(fixtureInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inventory := make(map[string]map[string]interface{}, 0)
+	names := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var asset map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &asset); err != nil {
+			t.Fatal(err)
+		}
+		inventory[stringField(asset, "name")] = asset
+		names = append(names, stringField(asset, "name"))
+	}
+
+	// changed returns a copy of an asset of the inventory with its data modified
+	changed := func(name string, newName string, modify func(data map[string]interface{})) map[string]interface{} {
+		var asset map[string]interface{}
+		encoded, _ := json.Marshal(inventory[name])
+		json.Unmarshal(encoded, &asset)
+		asset["name"] = newName
+		asset["update_time"] = "2021-01-01T00:00:00Z"
+		modify(asset["resource"].(map[string]interface{})["data"].(map[string]interface{}))
+		return asset
+	}
+	vm1 := "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-1"
+	vm2 := "//compute.googleapis.com/projects/app/zones/europe-west1-b/instances/vm-2"
+	hostSubnetwork := "//compute.googleapis.com/projects/host/regions/europe-west1/subnetworks/sub-host"
+	tagBinding := "//cloudresourcemanager.googleapis.com/tagBindings/%2F%2Fcloudresourcemanager.googleapis.com%2Fprojects%2F302/tagValues/501"
+	newSubnetwork := strings.Replace(appSubnetwork, "sub-app", "sub-app2", 1)
+	newAccount := strings.Replace(serviceAccount, "111", "333", 1)
+
+	// The first batch deletes and replaces a subnetwork and the service account of
+	// the instances, updates an instance, a subnetwork and a tag binding and has
+	// an outdated change and deletion; the second one adds the service account again
+	// with a new unique ID, so the references to its email are only resolved by its
+	// alias, and has an outdated change of the deleted tag binding.
+	outdated := changed(vm2, vm2, func(data map[string]interface{}) { data["labels"] = map[string]interface{}{"env": "old"} })
+	outdated["update_time"] = "2000-01-01T00:00:00Z"
+	deletedBinding := changed(tagBinding, tagBinding, func(data map[string]interface{}) {})
+	deletedBinding["update_time"] = "2020-12-31T00:00:00Z"
+	batches := [][]map[string]interface{}{
+		{
+			{"name": appSubnetwork, "deleted": true},
+			changed(appSubnetwork, newSubnetwork, func(data map[string]interface{}) { data["name"] = "sub-app2" }),
+			{"name": serviceAccount, "deleted": true},
+			changed(vm1, vm1, func(data map[string]interface{}) { data["labels"] = map[string]interface{}{"env": "dev"} }),
+			changed(hostSubnetwork, hostSubnetwork, func(data map[string]interface{}) { data["ipCidrRange"] = "10.0.8.0/22" }),
+			{"name": tagBinding, "deleted": true},
+			{"name": vm2, "deleted": true, "update_time": "2000-01-01T00:00:00Z"},
+			outdated,
+		},
+		{
+			changed(serviceAccount, newAccount, func(data map[string]interface{}) { data["uniqueId"] = "333" }),
+			deletedBinding,
+		},
+	}
+
+	graphFile, _ := generateFixture(t, true)
+	for _, batch := range batches {
+		changes := make([]*AssetChange, 0)
+		for _, asset := range batch {
+			name := stringField(asset, "name")
+			outdated := asset["update_time"] == "2000-01-01T00:00:00Z" || asset["update_time"] == "2020-12-31T00:00:00Z"
+			if asset["deleted"] == true {
+				deletedAt := parseUpdateTime("2021-01-01T00:00:00Z")
+				if outdated {
+					deletedAt = parseUpdateTime(stringField(asset, "update_time"))
+				} else {
+					delete(inventory, name)
+				}
+				changes = append(changes, &AssetChange{Name: name, Deleted: true, Time: deletedAt})
+				continue
+			}
+			encoded, err := json.Marshal(asset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes = append(changes, &AssetChange{Name: name, AssetType: stringField(asset, "asset_type"), Asset: encoded})
+			if outdated {
+				continue
+			}
+			if _, found := inventory[name]; !found {
+				names = append(names, name)
+			}
+			inventory[name] = asset
+		}
+
+		watcher := newTestViz(t)
+		watcher.LabelVertexes = true
+		recreated, total := 0, 0
+		watcher.Progress = func(event ProgressEvent) {
+			fmt.Sscanf(event.Message, "Created references of %d of %d assets again.", &recreated, &total)
+		}
+		if err := watcher.Update(graphFile); err != nil {
+			t.Fatalf("failed to update graph: %v", err)
+		}
+		if err := watcher.ApplyChanges(context.Background(), changes); err != nil {
+			watcher.Abort()
+			t.Fatalf("failed to apply changes: %v", err)
+		}
+		if err := watcher.Save(); err != nil {
+			t.Fatalf("failed to save graph: %v", err)
+		}
+		if recreated == 0 || recreated >= total/2 {
+			t.Errorf("expected references of a few assets to be created again, got %d of %d", recreated, total)
+		}
+	}
+
+	// The updated graph is the same as one generated from the changed inventory
+	var b bytes.Buffer
+	for _, name := range names {
+		if asset, found := inventory[name]; found {
+			encoded, _ := json.Marshal(asset)
+			b.Write(append(encoded, '\n'))
+		}
+	}
+	changedInventory := filepath.Join(tempDir(t), "inventory.json")
+	if err := ioutil.WriteFile(changedInventory, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectedFile, _ := generateGraph(t, true, func(ctx context.Context, generator *GcpViz) error {
+		if err := generator.ReadAssetsFromFile(ctx, changedInventory, ""); err != nil {
+			return err
+		}
+		if err := generator.ReadAssetsFromKubernetes(ctx, []KubernetesFile{{Cluster: cluster, File: fixtureKubernetes}}); err != nil {
+			return err
+		}
+		return generator.ReadOnPremSites(ctx, fixtureOnPrem)
+	})
+
+	quads, assets, aliases := graphContents(t, loadGraph(t, graphFile))
+	expectedQuads, expectedAssets, expectedAliases := graphContents(t, loadGraph(t, expectedFile))
+	if !reflect.DeepEqual(quads, expectedQuads) {
+		t.Errorf("unexpected quads, got %d, expected %d", len(quads), len(expectedQuads))
+		for _, quad := range quads {
+			if !contains(expectedQuads, quad) {
+				t.Logf("unexpected quad %s", quad)
+			}
+		}
+		for _, quad := range expectedQuads {
+			if !contains(quads, quad) {
+				t.Logf("missing quad %s", quad)
+			}
+		}
+	}
+	for name, asset := range expectedAssets {
+		if !reflect.DeepEqual(assets[name], asset) {
+			t.Errorf("unexpected asset %s, got %v, expected %v", name, assets[name], asset)
+		}
+	}
+	for name := range assets {
+		if _, found := expectedAssets[name]; !found {
+			t.Errorf("unexpected asset %s", name)
+		}
+	}
+	if !reflect.DeepEqual(aliases, expectedAliases) {
+		t.Errorf("unexpected aliases, got %v, expected %v", aliases, expectedAliases)
+	}
+}
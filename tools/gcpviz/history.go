@@ -0,0 +1,265 @@
+package gcpviz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cayleygraph/cayley"
+	cquad "github.com/cayleygraph/quad"
+	"github.com/pkg/errors"
+)
+
+var historyBuckets = []string{"Snapshots", "QuadHistory", "AssetHistory"}
+
+// Interval is the validity of a quad or an asset version, as the times of the first
+// and last snapshots it was seen in.
+type Interval struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func (i Interval) Contains(t time.Time) bool {
+	return !t.Before(i.FirstSeen) && !t.After(i.LastSeen)
+}
+
+type AssetVersion struct {
+	Interval
+	Asset json.RawMessage `json:"asset"`
+}
+
+// ParseTime parses a date (2006-01-02) or a RFC 3339 timestamp.
+func ParseTime(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %s, use either YYYY-MM-DD or RFC 3339 format", s)
+	}
+	return t, nil
+}
+
+func quadValue(value cquad.Value) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := cquad.NativeOf(value).(string); ok {
+		return s
+	}
+	return cquad.StringOf(value)
+}
+
+func quadKey(q cquad.Quad) []byte {
+	key, _ := json.Marshal([]string{quadValue(q.Subject), quadValue(q.Predicate), quadValue(q.Object), quadValue(q.Label)})
+	return key
+}
+
+func quadFromKey(key []byte) (cquad.Quad, error) {
+	var parts []string
+	err := json.Unmarshal(key, &parts)
+	if err != nil || len(parts) != 4 {
+		return cquad.Quad{}, fmt.Errorf("invalid quad history key %s", string(key))
+	}
+	return cayley.Quad(parts[0], parts[1], parts[2], parts[3]), nil
+}
+
+// resetSnapshot removes the current graph from an existing database while keeping its
+// history, so that the next snapshot can be generated into it. Snapshots have to be
+// added in chronological order.
+func (v *GcpViz) resetSnapshot() error {
+	return v.AssetDatabase.Update(func(tx *bolt.Tx) error {
+		previous, _, err := latestSnapshot(tx, time.Time{})
+		if err != nil {
+			return err
+		}
+		if !previous.IsZero() && !v.SnapshotTime.After(previous) {
+			return fmt.Errorf("snapshot %s is not newer than the latest snapshot %s", v.SnapshotTime.UTC().Format(time.RFC3339), previous.Format(time.RFC3339))
+		}
+		for _, bucket := range []string{"Assets", "Graph", "Aliases", "Organizations"} {
+			if tx.Bucket([]byte(bucket)) == nil {
+				continue
+			}
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// latestSnapshot returns the time of the newest snapshot at or before t, or of the
+// newest snapshot if t is zero.
+func latestSnapshot(tx *bolt.Tx, t time.Time) (time.Time, []byte, error) {
+	var latest time.Time
+	var roots []byte
+	bucket := tx.Bucket([]byte("Snapshots"))
+	if bucket == nil {
+		return latest, nil, nil
+	}
+	err := bucket.ForEach(func(k, bv []byte) error {
+		snapshot, err := time.Parse(time.RFC3339, string(k))
+		if err != nil {
+			return err
+		}
+		if (t.IsZero() || !snapshot.After(t)) && snapshot.After(latest) {
+			latest = snapshot
+			roots = bv
+		}
+		return nil
+	})
+	return latest, roots, err
+}
+
+// extendIntervals extends the last interval if the previous snapshot was part of it,
+// otherwise a new interval is started.
+func extendIntervals(intervals []Interval, previous time.Time, snapshot time.Time) []Interval {
+	if len(intervals) > 0 && !previous.IsZero() && intervals[len(intervals)-1].LastSeen.Equal(previous) {
+		intervals[len(intervals)-1].LastSeen = snapshot
+		return intervals
+	}
+	return append(intervals, Interval{FirstSeen: snapshot, LastSeen: snapshot})
+}
+
+// recordSnapshot adds the current graph and assets to the history as they were at
+// SnapshotTime.
+func (v *GcpViz) recordSnapshot() error {
+	snapshot := v.SnapshotTime.UTC()
+	tx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	previous, _, err := latestSnapshot(tx, time.Time{})
+	if err != nil {
+		return err
+	}
+	if !previous.IsZero() && !snapshot.After(previous) {
+		return fmt.Errorf("snapshot %s is not newer than the latest snapshot %s", snapshot.Format(time.RFC3339), previous.Format(time.RFC3339))
+	}
+
+	quadHistory := tx.Bucket([]byte("QuadHistory"))
+	it := v.QS.QuadsAllIterator()
+	defer it.Close()
+	ctx := context.Background()
+	var quads int64
+	for it.Next(ctx) {
+		key := quadKey(v.QS.Quad(it.Result()))
+		var intervals []Interval
+		if existing := quadHistory.Get(key); existing != nil {
+			if err := json.Unmarshal(existing, &intervals); err != nil {
+				return errors.Wrap(err, "unmarshaling quad history")
+			}
+		}
+		jsn, err := json.Marshal(extendIntervals(intervals, previous, snapshot))
+		if err != nil {
+			return err
+		}
+		if err = quadHistory.Put(key, jsn); err != nil {
+			return err
+		}
+		quads++
+	}
+
+	assetHistory := tx.Bucket([]byte("AssetHistory"))
+	var changed int64
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		var versions []AssetVersion
+		if existing := assetHistory.Get(k); existing != nil {
+			if err := json.Unmarshal(existing, &versions); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("unmarshaling history of asset %s", string(k)))
+			}
+		}
+		last := len(versions) - 1
+		if last >= 0 && !previous.IsZero() && versions[last].LastSeen.Equal(previous) && bytes.Equal(versions[last].Asset, bv) {
+			versions[last].LastSeen = snapshot
+		} else {
+			versions = append(versions, AssetVersion{Interval: Interval{FirstSeen: snapshot, LastSeen: snapshot}, Asset: append([]byte{}, bv...)})
+			changed++
+		}
+		jsn, err := json.Marshal(versions)
+		if err != nil {
+			return err
+		}
+		return assetHistory.Put(k, jsn)
+	})
+	if err != nil {
+		return err
+	}
+
+	roots, err := json.Marshal(v.OrgRoots)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte("Snapshots")).Put([]byte(snapshot.Format(time.RFC3339)), roots)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseSave, Message: fmt.Sprintf("Recorded snapshot %s: %d quads, %d new or changed asset versions.", snapshot.Format(time.RFC3339), quads, changed)})
+	return nil
+}
+
+// loadSnapshot loads the graph as it was at AsOf, using the newest snapshot taken at
+// or before it.
+func (v *GcpViz) loadSnapshot(tx *bolt.Tx) error {
+	if tx.Bucket([]byte("QuadHistory")) == nil {
+		return errors.New("graph file has no history, generate it with -snapshot-time")
+	}
+	snapshot, roots, err := latestSnapshot(tx, v.AsOf)
+	if err != nil {
+		return err
+	}
+	if snapshot.IsZero() {
+		return fmt.Errorf("no snapshot found at or before %s", v.AsOf.Format(time.RFC3339))
+	}
+	v.snapshot = snapshot
+	v.progress(ProgressEvent{Phase: PhaseLoad, Message: fmt.Sprintf("Using snapshot %s.", snapshot.Format(time.RFC3339))})
+
+	v.OrgRoots = nil
+	if err = json.Unmarshal(roots, &v.OrgRoots); err != nil {
+		return errors.Wrap(err, "unmarshaling organization roots")
+	}
+
+	return tx.Bucket([]byte("QuadHistory")).ForEach(func(k, bv []byte) error {
+		var intervals []Interval
+		if err := json.Unmarshal(bv, &intervals); err != nil {
+			return errors.Wrap(err, "unmarshaling quad history")
+		}
+		for _, interval := range intervals {
+			if interval.Contains(snapshot) {
+				q, err := quadFromKey(k)
+				if err != nil {
+					return err
+				}
+				return v.QW.AddQuad(q)
+			}
+		}
+		return nil
+	})
+}
+
+// assetAsOf returns the version of an asset that was valid in the loaded snapshot.
+func (v *GcpViz) assetAsOf(tx *bolt.Tx, name string) ([]byte, *Interval, error) {
+	history := tx.Bucket([]byte("AssetHistory")).Get([]byte(name))
+	if history == nil {
+		return nil, nil, nil
+	}
+	var versions []AssetVersion
+	if err := json.Unmarshal(history, &versions); err != nil {
+		return nil, nil, errors.Wrap(err, fmt.Sprintf("unmarshaling history of asset %s", name))
+	}
+	for _, version := range versions {
+		if version.Contains(v.snapshot) {
+			return version.Asset, &version.Interval, nil
+		}
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,455 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IP address usage is calculated for every subnetwork range after the references
+// have been created: addresses of instances (including alias IP ranges), internal
+// forwarding rules and reserved internal addresses are counted against the range of
+// the subnetwork they refer to. Ranges of networks that are connected via VPC
+// peering are checked for overlaps. The results are stored in the "ip_usage" field
+// of the subnetwork, so that they can be used in templates.
+
+// Addresses reserved by Google Cloud in every primary subnetwork range
+const reservedPrimaryAddresses = 4
+
+// IpUsage is the usage of the ranges of a subnetwork. Utilization is the highest
+// utilization of any of its ranges, in percent.
+type IpUsage struct {
+	Network     string         `json:"network"`
+	Ranges      []IpRangeUsage `json:"ranges"`
+	Utilization float64        `json:"utilization"`
+	Overlaps    []IpOverlap    `json:"overlaps,omitempty"`
+	Projects    []string       `json:"projects,omitempty"`
+}
+
+// IpRangeUsage is the usage of a primary or secondary subnetwork range. The primary
+// range has no name.
+type IpRangeUsage struct {
+	Name        string  `json:"name,omitempty"`
+	Cidr        string  `json:"cidr"`
+	Size        int64   `json:"size"`
+	Used        int64   `json:"used"`
+	Utilization float64 `json:"utilization"`
+}
+
+// IpOverlap is a subnetwork range that overlaps with a range of another subnetwork in
+// the same or a peered network.
+type IpOverlap struct {
+	Cidr       string `json:"cidr"`
+	Subnetwork string `json:"subnetwork"`
+	Network    string `json:"network"`
+	Range      string `json:"range"`
+}
+
+// SubnetworkOverlap is a subnetwork range that overlaps with a range of another
+// subnetwork in the same or a peered network.
+type SubnetworkOverlap struct {
+	Subnetwork string `json:"subnetwork"`
+	Cidr       string `json:"cidr"`
+	Other      string `json:"other"`
+	Range      string `json:"range"`
+}
+
+type subnetworkRange struct {
+	subnetwork string
+	network    string
+	name       string
+	ipNet      *net.IPNet
+	size       int64
+	ips        map[string]bool
+	ranges     map[string]int64
+}
+
+type subnetworkUsage struct {
+	asset    map[string]interface{}
+	network  string
+	ranges   []*subnetworkRange
+	projects map[string]bool
+	overlaps []IpOverlap
+}
+
+// normalizeComputeLink converts a compute API self link to a resource name.
+func normalizeComputeLink(link string) string {
+	return strings.Replace(link, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1)
+}
+
+// ipRangeSize returns the number of addresses in an IPv4 range, or zero for IPv6.
+func ipRangeSize(ipNet *net.IPNet) int64 {
+	ones, bits := ipNet.Mask.Size()
+	if bits != 32 {
+		return 0
+	}
+	return int64(1) << uint(bits-ones)
+}
+
+func (r *subnetworkRange) used() int64 {
+	used := int64(len(r.ips))
+	for _, size := range r.ranges {
+		used += size
+	}
+	return used
+}
+
+func (r *subnetworkRange) usable() int64 {
+	if r.name == "" && r.size > reservedPrimaryAddresses {
+		return r.size - reservedPrimaryAddresses
+	}
+	return r.size
+}
+
+// ipConsumer is an address or alias IP range that is allocated from a subnetwork.
+type ipConsumer struct {
+	subnetwork string
+	rangeName  string
+	address    string
+	project    string
+}
+
+// ipConsumers returns the addresses that an asset allocates from subnetworks.
+func ipConsumers(asset map[string]interface{}) []ipConsumer {
+	consumers := make([]ipConsumer, 0)
+	data := mapField(asset, "resource", "data")
+	project := ""
+	if ancestors, ok := asset["ancestors"].([]interface{}); ok && len(ancestors) > 0 {
+		project = fmt.Sprint(ancestors[0])
+	}
+	switch stringField(asset, "asset_type") {
+	case "compute.googleapis.com/Instance":
+		networkInterfaces, _ := data["networkInterfaces"].([]interface{})
+		for _, networkInterface := range networkInterfaces {
+			subnetwork := normalizeComputeLink(stringField(networkInterface, "subnetwork"))
+			consumers = append(consumers, ipConsumer{subnetwork: subnetwork, address: stringField(networkInterface, "networkIP"), project: project})
+			aliasIpRanges, _ := mapField(networkInterface)["aliasIpRanges"].([]interface{})
+			for _, aliasIpRange := range aliasIpRanges {
+				consumers = append(consumers, ipConsumer{subnetwork: subnetwork, rangeName: stringField(aliasIpRange, "subnetworkRangeName"), address: stringField(aliasIpRange, "ipCidrRange"), project: project})
+			}
+		}
+
+	case "compute.googleapis.com/ForwardingRule":
+		if subnetwork := stringField(data, "subnetwork"); subnetwork != "" {
+			consumers = append(consumers, ipConsumer{subnetwork: normalizeComputeLink(subnetwork), address: stringField(data, "IPAddress"), project: project})
+		}
+
+	case "compute.googleapis.com/Address":
+		// Addresses in use are counted once, together with the resource that uses them
+		if subnetwork := stringField(data, "subnetwork"); subnetwork != "" {
+			consumers = append(consumers, ipConsumer{subnetwork: normalizeComputeLink(subnetwork), address: stringField(data, "address"), project: project})
+		}
+	}
+	return consumers
+}
+
+// analyzeIpUsage calculates the IP address usage of subnetworks and finds overlapping
+// ranges in peered networks.
+func (v *GcpViz) analyzeIpUsage(ctx context.Context) error {
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	subnetworks := make(map[string]*subnetworkUsage, 0)
+	peerings := make(map[string][]string, 0)
+	consumers := make([]ipConsumer, 0)
+	ipAssetTypes := []string{
+		"compute.googleapis.com/Subnetwork",
+		"compute.googleapis.com/Network",
+		"compute.googleapis.com/Instance",
+		"compute.googleapis.com/ForwardingRule",
+		"compute.googleapis.com/Address",
+	}
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		isIpAsset := false
+		for _, ipAssetType := range ipAssetTypes {
+			// Simple optimization to avoid unmarshaling tons of JSON
+			if strings.Contains(string(bv), ipAssetType) {
+				isIpAsset = true
+				break
+			}
+		}
+		if !isIpAsset {
+			return nil
+		}
+		var asset map[string]interface{}
+		if err := json.Unmarshal(bv, &asset); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", string(k)))
+		}
+		name := string(k)
+		data := mapField(asset, "resource", "data")
+		switch stringField(asset, "asset_type") {
+		case "compute.googleapis.com/Subnetwork":
+			usage := &subnetworkUsage{asset: asset, network: normalizeComputeLink(stringField(data, "network")), projects: make(map[string]bool, 0)}
+			ranges := []map[string]interface{}{{"ipCidrRange": data["ipCidrRange"]}}
+			if secondaryIpRanges, ok := data["secondaryIpRanges"].([]interface{}); ok {
+				for _, secondaryIpRange := range secondaryIpRanges {
+					ranges = append(ranges, mapField(secondaryIpRange))
+				}
+			}
+			for _, ipRange := range ranges {
+				_, ipNet, err := net.ParseCIDR(stringField(ipRange, "ipCidrRange"))
+				if err != nil {
+					continue
+				}
+				usage.ranges = append(usage.ranges, &subnetworkRange{
+					subnetwork: name,
+					network:    usage.network,
+					name:       stringField(ipRange, "rangeName"),
+					ipNet:      ipNet,
+					size:       ipRangeSize(ipNet),
+					ips:        make(map[string]bool, 0),
+					ranges:     make(map[string]int64, 0),
+				})
+			}
+			subnetworks[name] = usage
+
+		case "compute.googleapis.com/Network":
+			if networkPeerings, ok := data["peerings"].([]interface{}); ok {
+				for _, peering := range networkPeerings {
+					if state := stringField(peering, "state"); state != "" && state != "ACTIVE" {
+						continue
+					}
+					peer := normalizeComputeLink(stringField(peering, "network"))
+					peerings[name] = append(peerings[name], peer)
+					peerings[peer] = append(peerings[peer], name)
+				}
+			}
+
+		default:
+			consumers = append(consumers, ipConsumers(asset)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(subnetworks) == 0 {
+		return nil
+	}
+	tx.Rollback()
+
+	v.progress(ProgressEvent{Phase: PhaseIps, Message: "Calculating IP address usage of subnetworks..."})
+	for _, consumer := range consumers {
+		usage, found := subnetworks[consumer.subnetwork]
+		if !found || consumer.address == "" {
+			continue
+		}
+		if consumer.project != "" {
+			usage.projects[consumer.project] = true
+		}
+		if strings.Contains(consumer.address, "/") {
+			_, ipNet, err := net.ParseCIDR(consumer.address)
+			if err != nil {
+				continue
+			}
+			for _, ipRange := range usage.ranges {
+				if ipRange.name == consumer.rangeName && ipRange.ipNet.Contains(ipNet.IP) {
+					ipRange.ranges[ipNet.String()] = ipRangeSize(ipNet)
+				}
+			}
+			continue
+		}
+		ip := net.ParseIP(consumer.address)
+		if ip == nil {
+			continue
+		}
+		for _, ipRange := range usage.ranges {
+			if ipRange.ipNet.Contains(ip) {
+				ipRange.ips[ip.String()] = true
+				break
+			}
+		}
+	}
+
+	// Networks connected via peering share their address space
+	components := make(map[string]string, 0)
+	var visit func(network string, component string)
+	visit = func(network string, component string) {
+		if _, found := components[network]; found {
+			return
+		}
+		components[network] = component
+		for _, peer := range peerings[network] {
+			visit(peer, component)
+		}
+	}
+	names := make([]string, 0, len(subnetworks))
+	for name := range subnetworks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rangesByComponent := make(map[string][]*subnetworkRange, 0)
+	for _, name := range names {
+		usage := subnetworks[name]
+		visit(usage.network, usage.network)
+		component := components[usage.network]
+		rangesByComponent[component] = append(rangesByComponent[component], usage.ranges...)
+	}
+	var overlaps int
+	for _, ranges := range rangesByComponent {
+		for idx, ipRange := range ranges {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			for _, other := range ranges[idx+1:] {
+				if ipRange.subnetwork == other.subnetwork || !ipRangesOverlap(ipRange.ipNet, other.ipNet) {
+					continue
+				}
+				subnetworks[ipRange.subnetwork].overlaps = append(subnetworks[ipRange.subnetwork].overlaps, IpOverlap{Cidr: ipRange.ipNet.String(), Subnetwork: other.subnetwork, Network: other.network, Range: other.ipNet.String()})
+				subnetworks[other.subnetwork].overlaps = append(subnetworks[other.subnetwork].overlaps, IpOverlap{Cidr: other.ipNet.String(), Subnetwork: ipRange.subnetwork, Network: ipRange.network, Range: ipRange.ipNet.String()})
+				v.warn(PhaseIps, "range %s of %s overlaps with %s of %s.", ipRange.ipNet, ipRange.subnetwork, other.ipNet, other.subnetwork)
+				v.report().IpOverlaps = append(v.report().IpOverlaps, SubnetworkOverlap{Subnetwork: ipRange.subnetwork, Cidr: ipRange.ipNet.String(), Other: other.subnetwork, Range: other.ipNet.String()})
+				overlaps++
+			}
+		}
+	}
+
+	wrtx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer wrtx.Rollback()
+
+	for _, name := range names {
+		usage := subnetworks[name]
+		ipUsage := IpUsage{Network: usage.network, Ranges: make([]IpRangeUsage, 0, len(usage.ranges)), Overlaps: usage.overlaps}
+		for _, ipRange := range usage.ranges {
+			rangeUsage := IpRangeUsage{Name: ipRange.name, Cidr: ipRange.ipNet.String(), Size: ipRange.usable(), Used: ipRange.used()}
+			if rangeUsage.Size > 0 {
+				rangeUsage.Utilization = math.Round(float64(rangeUsage.Used)/float64(rangeUsage.Size)*1000) / 10
+			}
+			if rangeUsage.Utilization > ipUsage.Utilization {
+				ipUsage.Utilization = rangeUsage.Utilization
+			}
+			ipUsage.Ranges = append(ipUsage.Ranges, rangeUsage)
+		}
+		for project := range usage.projects {
+			ipUsage.Projects = append(ipUsage.Projects, project)
+		}
+		sort.Strings(ipUsage.Projects)
+		mapField(usage.asset, "resource")["ip_usage"] = ipUsage
+		if err = v.UpdateAsset(wrtx, name, usage.asset); err != nil {
+			return err
+		}
+	}
+	if err = wrtx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseIps, Message: fmt.Sprintf("IP address usage of %d subnetworks calculated, %d overlapping ranges found.", len(subnetworks), overlaps), Done: true})
+	return nil
+}
+
+// IpReportRow is the usage of one subnetwork range in the IP address report.
+type IpReportRow struct {
+	Subnetwork  string   `json:"subnetwork"`
+	Network     string   `json:"network"`
+	Project     string   `json:"project"`
+	Range       string   `json:"range,omitempty"`
+	Cidr        string   `json:"cidr"`
+	Size        int64    `json:"size"`
+	Used        int64    `json:"used"`
+	Utilization float64  `json:"utilization"`
+	Exhausted   bool     `json:"exhausted"`
+	Overlaps    []string `json:"overlaps,omitempty"`
+	Projects    []string `json:"projects,omitempty"`
+}
+
+// WriteIpReport writes the IP address usage of all subnetwork ranges as newline
+// delimited JSON or CSV. Ranges with a utilization of at least threshold percent are
+// marked as exhausted.
+func (v *GcpViz) WriteIpReport(ctx context.Context, out io.Writer, format string, threshold float64) error {
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unknown report format %s, specify either json or csv", format)
+	}
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows := make([]IpReportRow, 0)
+	err = v.forEachAsset(ctx, tx, func(name string, asset []byte) error {
+		if !strings.Contains(string(asset), "\"ip_usage\"") {
+			return nil
+		}
+		var resource TemplateResource
+		if err := json.Unmarshal(asset, &resource); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", name))
+		}
+		ipUsage := resource.Resource.IpUsage
+		if ipUsage == nil {
+			return nil
+		}
+		for _, rangeUsage := range ipUsage.Ranges {
+			row := IpReportRow{
+				Subnetwork:  name,
+				Network:     ipUsage.Network,
+				Range:       rangeUsage.Name,
+				Cidr:        rangeUsage.Cidr,
+				Size:        rangeUsage.Size,
+				Used:        rangeUsage.Used,
+				Utilization: rangeUsage.Utilization,
+				Exhausted:   rangeUsage.Size > 0 && rangeUsage.Utilization >= threshold,
+				Overlaps:    make([]string, 0),
+				Projects:    ipUsage.Projects,
+			}
+			if len(resource.Ancestors) > 0 {
+				row.Project = resource.Ancestors[0]
+			}
+			for _, overlap := range ipUsage.Overlaps {
+				if overlap.Cidr == rangeUsage.Cidr {
+					row.Overlaps = append(row.Overlaps, fmt.Sprintf("%s (%s)", overlap.Range, overlap.Subnetwork))
+				}
+			}
+			rows = append(rows, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		for _, row := range rows {
+			if err = enc.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := csv.NewWriter(out)
+	w.Write([]string{"subnetwork", "network", "project", "range", "cidr", "size", "used", "utilization", "exhausted", "overlaps", "projects"})
+	for _, row := range rows {
+		w.Write([]string{
+			row.Subnetwork,
+			row.Network,
+			row.Project,
+			row.Range,
+			row.Cidr,
+			strconv.FormatInt(row.Size, 10),
+			strconv.FormatInt(row.Used, 10),
+			strconv.FormatFloat(row.Utilization, 'f', 1, 64),
+			strconv.FormatBool(row.Exhausted),
+			strings.Join(row.Overlaps, " "),
+			strings.Join(row.Projects, " "),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,491 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Kubernetes objects are read either from Cloud Asset Inventory (k8s.io/* and
+// *.k8s.io/* asset types) or from the output of "kubectl get -o json". Before the
+// references are created, the objects are linked to each other (pods to their
+// workloads, nodes and services, ingresses to services) and to the load balancing
+// resources that GKE created for them. The links are stored in the "kubernetes"
+// field of the resource, so that they can be referred to in relations.yaml.
+
+const containerResourcePrefix = "//container.googleapis.com/"
+
+// KubernetesFile is the output of "kubectl get -o json" for a GKE cluster.
+type KubernetesFile struct {
+	Cluster string
+	File    string
+}
+
+// ParseKubernetesFiles parses a comma separated list of cluster=file pairs, where
+// cluster is projects/PROJECT/locations/LOCATION/clusters/CLUSTER.
+func ParseKubernetesFiles(files string) ([]KubernetesFile, error) {
+	kubernetesFiles := make([]KubernetesFile, 0)
+	for _, file := range strings.Split(files, ",") {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		parts := strings.SplitN(file, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid Kubernetes file %s, use cluster=file format", file)
+		}
+		cluster, err := normalizeClusterName(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		kubernetesFiles = append(kubernetesFiles, KubernetesFile{Cluster: cluster, File: parts[1]})
+	}
+	return kubernetesFiles, nil
+}
+
+func normalizeClusterName(cluster string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(cluster, containerResourcePrefix), "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "clusters" {
+		return "", fmt.Errorf("invalid cluster %s, use projects/PROJECT/locations/LOCATION/clusters/CLUSTER format", cluster)
+	}
+	return containerResourcePrefix + strings.Join(parts, "/"), nil
+}
+
+// kubernetesAssetType returns the Cloud Asset Inventory asset type and the API group
+// of a Kubernetes object.
+func kubernetesAssetType(apiVersion string, kind string) (string, string) {
+	group := ""
+	if idx := strings.Index(apiVersion, "/"); idx > -1 {
+		group = apiVersion[:idx]
+	}
+	switch {
+	case group == "":
+		return fmt.Sprintf("k8s.io/%s", kind), group
+	case strings.HasSuffix(group, ".k8s.io"):
+		return fmt.Sprintf("%s/%s", group, kind), group
+	default:
+		return fmt.Sprintf("%s.k8s.io/%s", group, kind), group
+	}
+}
+
+func isKubernetesAssetType(assetType string) bool {
+	return strings.HasPrefix(assetType, "k8s.io/") || strings.Contains(assetType, ".k8s.io/")
+}
+
+func kubernetesPlural(kind string) string {
+	plural := strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(plural, "ss"):
+		return plural + "es"
+	case strings.HasSuffix(plural, "s"):
+		return plural
+	case strings.HasSuffix(plural, "y"):
+		return strings.TrimSuffix(plural, "y") + "ies"
+	}
+	return plural + "s"
+}
+
+// kubernetesObjectName returns the full resource name of a Kubernetes object, as
+// used by Cloud Asset Inventory.
+func kubernetesObjectName(cluster string, group string, kind string, namespace string, name string) string {
+	path := cluster + "/k8s"
+	if namespace != "" && kind != "Namespace" {
+		path = fmt.Sprintf("%s/namespaces/%s", path, namespace)
+	}
+	if group != "" {
+		path = fmt.Sprintf("%s/%s", path, group)
+	}
+	return fmt.Sprintf("%s/%s/%s", path, kubernetesPlural(kind), name)
+}
+
+// clusterProject returns the project ID of a GKE cluster.
+func clusterProject(cluster string) string {
+	return strings.Split(strings.TrimPrefix(cluster, containerResourcePrefix), "/")[1]
+}
+
+// clusterRegion returns the region of a regional cluster, or the region of the zone
+// of a zonal cluster.
+func clusterRegion(cluster string) string {
+	location := strings.Split(strings.TrimPrefix(cluster, containerResourcePrefix), "/")[3]
+	if parts := strings.Split(location, "-"); len(parts) == 3 {
+		return strings.Join(parts[:2], "-")
+	}
+	return location
+}
+
+func stringField(data interface{}, path ...string) string {
+	for _, key := range path {
+		m, ok := data.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		data = m[key]
+	}
+	s, _ := data.(string)
+	return s
+}
+
+func mapField(data interface{}, path ...string) map[string]interface{} {
+	for _, key := range path {
+		m, ok := data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		data = m[key]
+	}
+	m, _ := data.(map[string]interface{})
+	return m
+}
+
+// ReadAssetsFromKubernetes reads the objects of GKE clusters from the output of
+// "kubectl get -o json". The clusters themselves should be part of the resource
+// inventory, otherwise the objects will not be connected to their projects.
+func (v *GcpViz) ReadAssetsFromKubernetes(ctx context.Context, inputs []KubernetesFile) error {
+	for _, input := range inputs {
+		v.progress(ProgressEvent{Phase: PhaseKubernetes, Message: fmt.Sprintf("Reading Kubernetes objects of %s from %s...", input.Cluster, input.File)})
+		err := v.readKubernetesFile(ctx, input)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("reading %s", input.File))
+		}
+	}
+	return nil
+}
+
+func (v *GcpViz) readKubernetesFile(ctx context.Context, input KubernetesFile) error {
+	file, err := ioutil.ReadFile(input.File)
+	if err != nil {
+		return err
+	}
+	var list struct {
+		Kind  string                   `json:"kind"`
+		Items []map[string]interface{} `json:"items"`
+	}
+	if err = json.Unmarshal(file, &list); err != nil {
+		return errors.Wrap(err, "parsing Kubernetes JSON output")
+	}
+	if list.Kind != "List" && !strings.HasSuffix(list.Kind, "List") {
+		var item map[string]interface{}
+		if err = json.Unmarshal(file, &item); err != nil {
+			return err
+		}
+		list.Items = []map[string]interface{}{item}
+	}
+
+	tx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ancestors := []string{fmt.Sprintf("projects/%s", clusterProject(input.Cluster))}
+	if cluster := tx.Bucket([]byte("Assets")).Get([]byte(input.Cluster)); cluster != nil {
+		var resource TemplateResource
+		if err = json.Unmarshal(cluster, &resource); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", input.Cluster))
+		}
+		ancestors = resource.Ancestors
+	} else {
+		v.warn(PhaseKubernetes, "GKE cluster %s not found in assets, its Kubernetes objects will not be connected to a project.", input.Cluster)
+	}
+
+	var added int
+	namespaces := make(map[string]bool, 0)
+	definedNamespaces := make(map[string]bool, 0)
+	for _, item := range list.Items {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		apiVersion := stringField(item, "apiVersion")
+		kind := stringField(item, "kind")
+		name := stringField(item, "metadata", "name")
+		namespace := stringField(item, "metadata", "namespace")
+		if kind == "" || name == "" {
+			continue
+		}
+		assetType, group := kubernetesAssetType(apiVersion, kind)
+
+		parent := input.Cluster
+		if namespace != "" {
+			parent = kubernetesObjectName(input.Cluster, "", "Namespace", "", namespace)
+			namespaces[namespace] = true
+		}
+		if kind == "Namespace" {
+			definedNamespaces[name] = true
+		}
+		version := apiVersion[strings.Index(apiVersion, "/")+1:]
+		err = v.addAssetFromMap(tx, map[string]interface{}{
+			"name":       kubernetesObjectName(input.Cluster, group, kind, namespace, name),
+			"asset_type": assetType,
+			"resource": map[string]interface{}{
+				"version":        version,
+				"discovery_name": kind,
+				"parent":         parent,
+				"data":           item,
+			},
+			"ancestors": ancestors,
+			"source":    "kubernetes",
+		})
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("adding Kubernetes object %s/%s", kind, name))
+		}
+		added++
+	}
+
+	// Namespaces that were not part of the output are added as placeholders
+	for namespace := range namespaces {
+		name := kubernetesObjectName(input.Cluster, "", "Namespace", "", namespace)
+		if definedNamespaces[namespace] || tx.Bucket([]byte("Assets")).Get([]byte(name)) != nil {
+			continue
+		}
+		err = v.addAssetFromMap(tx, map[string]interface{}{
+			"name":       name,
+			"asset_type": "k8s.io/Namespace",
+			"resource": map[string]interface{}{
+				"version":        "v1",
+				"discovery_name": "Namespace",
+				"parent":         input.Cluster,
+				"data": map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Namespace",
+					"metadata":   map[string]interface{}{"name": namespace},
+				},
+			},
+			"ancestors": ancestors,
+			"source":    "kubernetes",
+		})
+		if err != nil {
+			return err
+		}
+		added++
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseKubernetes, Message: fmt.Sprintf("Kubernetes objects: %d added.", added), Done: true})
+	return nil
+}
+
+type kubernetesObject struct {
+	name      string
+	assetType string
+	kind      string
+	cluster   string
+	namespace string
+	objName   string
+	asset     map[string]interface{}
+	data      map[string]interface{}
+}
+
+func kubernetesKey(cluster string, namespace string, kind string, name string) string {
+	return strings.Join([]string{cluster, namespace, kind, name}, "|")
+}
+
+// linkKubernetesObjects resolves the references of Kubernetes objects that are not
+// plain resource names (owner references, label selectors and GKE annotations) and
+// stores them in the "kubernetes" field of the resource.
+func (v *GcpViz) linkKubernetesObjects(ctx context.Context) error {
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	objects := make([]*kubernetesObject, 0)
+	index := make(map[string]*kubernetesObject, 0)
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Simple optimization to avoid unmarshaling tons of JSON
+		if !strings.Contains(string(bv), "k8s.io/") {
+			return nil
+		}
+		var asset map[string]interface{}
+		if err := json.Unmarshal(bv, &asset); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", string(k)))
+		}
+		name := string(k)
+		assetType := stringField(asset, "asset_type")
+		idx := strings.Index(name, "/k8s/")
+		if !isKubernetesAssetType(assetType) || idx == -1 {
+			return nil
+		}
+		data := mapField(asset, "resource", "data")
+		object := &kubernetesObject{
+			name:      name,
+			assetType: assetType,
+			kind:      assetType[strings.LastIndex(assetType, "/")+1:],
+			cluster:   name[:idx],
+			namespace: stringField(data, "metadata", "namespace"),
+			objName:   stringField(data, "metadata", "name"),
+			asset:     asset,
+			data:      data,
+		}
+		objects = append(objects, object)
+		index[kubernetesKey(object.cluster, object.namespace, object.kind, object.objName)] = object
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+	tx.Rollback()
+
+	v.progress(ProgressEvent{Phase: PhaseKubernetes, Message: "Linking Kubernetes objects..."})
+	lookup := func(object *kubernetesObject, namespace string, kind string, name string) string {
+		if target, found := index[kubernetesKey(object.cluster, namespace, kind, name)]; found {
+			return target.name
+		}
+		return ""
+	}
+
+	wrtx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer wrtx.Rollback()
+
+	var linked int
+	for _, object := range objects {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		links := make(map[string][]string, 0)
+		add := func(field string, target string) {
+			if target == "" {
+				return
+			}
+			for _, existing := range links[field] {
+				if existing == target {
+					return
+				}
+			}
+			links[field] = append(links[field], target)
+		}
+
+		if owners, ok := mapField(object.data, "metadata")["ownerReferences"].([]interface{}); ok {
+			for _, owner := range owners {
+				kind, name := stringField(owner, "kind"), stringField(owner, "name")
+				target := lookup(object, object.namespace, kind, name)
+				// Pods of deployments refer to replica sets, which are often left out
+				if target == "" && kind == "ReplicaSet" && strings.Contains(name, "-") {
+					target = lookup(object, object.namespace, "Deployment", name[:strings.LastIndex(name, "-")])
+				}
+				add("owners", target)
+			}
+		}
+
+		annotations := mapField(object.data, "metadata", "annotations")
+		project := clusterProject(object.cluster)
+		switch object.assetType {
+		case "k8s.io/Pod":
+			add("node", lookup(object, "", "Node", stringField(object.data, "spec", "nodeName")))
+
+		case "k8s.io/Service":
+			selector := mapField(object.data, "spec", "selector")
+			if len(selector) > 0 {
+				for _, pod := range objects {
+					if pod.assetType != "k8s.io/Pod" || pod.cluster != object.cluster || pod.namespace != object.namespace {
+						continue
+					}
+					labels := mapField(pod.data, "metadata", "labels")
+					matches := true
+					for key, value := range selector {
+						if labels[key] != value {
+							matches = false
+							break
+						}
+					}
+					if matches {
+						add("pods", pod.name)
+					}
+				}
+			}
+			if status, ok := annotations["cloud.google.com/neg-status"].(string); ok {
+				var negStatus struct {
+					NetworkEndpointGroups map[string]string `json:"network_endpoint_groups"`
+					Zones                 []string          `json:"zones"`
+				}
+				if err := json.Unmarshal([]byte(status), &negStatus); err == nil {
+					for _, zone := range negStatus.Zones {
+						for _, neg := range negStatus.NetworkEndpointGroups {
+							add("networkEndpointGroups", fmt.Sprintf("//compute.googleapis.com/projects/%s/zones/%s/networkEndpointGroups/%s", project, zone, neg))
+						}
+					}
+				}
+			}
+
+		case "networking.k8s.io/Ingress", "extensions.k8s.io/Ingress":
+			spec := mapField(object.data, "spec")
+			backends := []interface{}{spec["defaultBackend"], spec["backend"]}
+			if rules, ok := spec["rules"].([]interface{}); ok {
+				for _, rule := range rules {
+					if paths, ok := mapField(rule, "http")["paths"].([]interface{}); ok {
+						for _, path := range paths {
+							backends = append(backends, mapField(path, "backend"))
+						}
+					}
+				}
+			}
+			for _, backend := range backends {
+				service := stringField(backend, "service", "name")
+				if service == "" {
+					service = stringField(backend, "serviceName")
+				}
+				if service != "" {
+					add("services", lookup(object, object.namespace, "Service", service))
+				}
+			}
+
+			// Internal ingresses create regional load balancers
+			location := "global"
+			if annotations["kubernetes.io/ingress.class"] == "gce-internal" {
+				location = fmt.Sprintf("regions/%s", clusterRegion(object.cluster))
+			}
+			for _, annotation := range []string{"ingress.kubernetes.io/forwarding-rule", "ingress.kubernetes.io/https-forwarding-rule"} {
+				if rule, ok := annotations[annotation].(string); ok && rule != "" {
+					add("forwardingRules", fmt.Sprintf("//compute.googleapis.com/projects/%s/%s/forwardingRules/%s", project, location, rule))
+				}
+			}
+			if status, ok := annotations["ingress.kubernetes.io/backends"].(string); ok {
+				var backendServices map[string]string
+				if err := json.Unmarshal([]byte(status), &backendServices); err == nil {
+					names := make([]string, 0, len(backendServices))
+					for backendService := range backendServices {
+						names = append(names, backendService)
+					}
+					sort.Strings(names)
+					for _, backendService := range names {
+						add("backendServices", fmt.Sprintf("//compute.googleapis.com/projects/%s/%s/backendServices/%s", project, location, backendService))
+					}
+				}
+			}
+		}
+
+		resource := mapField(object.asset, "resource")
+		if len(links) == 0 && resource["kubernetes"] == nil {
+			continue
+		}
+		linked++
+		if v.update != nil && sameJson(resource["kubernetes"], links) {
+			continue
+		}
+		resource["kubernetes"] = links
+		if err = v.UpdateAsset(wrtx, object.name, object.asset); err != nil {
+			return err
+		}
+		v.affect(object.name)
+	}
+	if err = wrtx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseKubernetes, Message: fmt.Sprintf("Linked %d of %d Kubernetes objects.", linked, len(objects)), Done: true})
+	return nil
+}
@@ -0,0 +1,271 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cayleygraph/cayley"
+	cquad "github.com/cayleygraph/quad"
+	"github.com/pkg/errors"
+)
+
+// Resource labels and tags are only part of the resource data, so they cannot be
+// followed in queries. With LabelVertexes set, every distinct label (key=value) is
+// added as a synthetic asset and linked from the resources that have it with a
+// "labelled" relationship, and resources are linked to the tag values bound to them
+// (via cloudresourcemanager.googleapis.com/TagBinding assets) with a "tagged"
+// relationship. Like named relationships in relations.yaml, the links are stored as
+// "uses" edges too, so they can be rendered.
+
+const (
+	labelAssetType         = "labels.gcpviz/Label"
+	labelPrefix            = "//labels.gcpviz/labels/"
+	tagBindingAssetType    = "cloudresourcemanager.googleapis.com/TagBinding"
+	resourceManagerService = "//cloudresourcemanager.googleapis.com/"
+)
+
+// Fields of the resource data that hold labels: most resources use "labels", GKE
+// clusters "resourceLabels" and Cloud SQL instances "settings.userLabels".
+var labelFields = [][]string{
+	{"labels"},
+	{"resourceLabels"},
+	{"settings", "userLabels"},
+}
+
+// LabelVertex returns the name of the vertex of a label.
+func LabelVertex(key string, value string) string {
+	return fmt.Sprintf("%s%s=%s", labelPrefix, key, value)
+}
+
+// ParseLabelKeys splits a comma separated list of label keys.
+func ParseLabelKeys(keys string) []string {
+	return strings.FieldsFunc(keys, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+type labelledAsset struct {
+	assetType string
+	project   string
+	labels    []string
+}
+
+type tagBinding struct {
+	name     string
+	resource string
+	tagValue string
+}
+
+// linkLabels adds label vertexes and links resources to their labels and tag values,
+// if LabelVertexes is set. When applying changes, only affected resources are linked
+// again and label vertexes that are no longer used are removed.
+func (v *GcpViz) linkLabels(ctx context.Context) error {
+	if !v.LabelVertexes {
+		return nil
+	}
+	labelKeys := make(map[string]bool, len(v.LabelKeys))
+	for _, key := range v.LabelKeys {
+		labelKeys[key] = true
+	}
+
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	labelled := make(map[string]*labelledAsset, 0)
+	labels := make(map[string][]string, 0)
+	bindings := make([]tagBinding, 0)
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := string(k)
+		// Simple optimization to avoid unmarshaling tons of JSON, matches all label fields
+		isLabelled := v.update.isAffected(name) && strings.Contains(string(bv), "abels\"")
+		if !isLabelled && !strings.Contains(string(bv), tagBindingAssetType) {
+			return nil
+		}
+		var asset map[string]interface{}
+		if err := json.Unmarshal(bv, &asset); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", name))
+		}
+		assetType := stringField(asset, "asset_type")
+		data := mapField(asset, "resource", "data")
+		if assetType == tagBindingAssetType {
+			tagValue := stringField(data, "tagValue")
+			if !strings.HasPrefix(tagValue, "//") {
+				tagValue = resourceManagerService + tagValue
+			}
+			bindings = append(bindings, tagBinding{name: name, resource: stringField(data, "parent"), tagValue: tagValue})
+			return nil
+		}
+
+		la := &labelledAsset{assetType: assetType}
+		if ancestors, ok := asset["ancestors"].([]interface{}); ok && len(ancestors) > 0 {
+			if project := fmt.Sprint(ancestors[0]); strings.HasPrefix(project, "projects/") {
+				la.project = resourceManagerService + project
+			}
+		}
+		for _, field := range labelFields {
+			for key, value := range mapField(data, field...) {
+				if len(labelKeys) > 0 && !labelKeys[key] {
+					continue
+				}
+				label := LabelVertex(key, fmt.Sprint(value))
+				if _, found := labels[label]; !found {
+					labels[label] = []string{key, fmt.Sprint(value)}
+				}
+				la.labels = append(la.labels, label)
+			}
+		}
+		if len(la.labels) > 0 {
+			sort.Strings(la.labels)
+			labelled[name] = la
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tx.Rollback()
+
+	v.progress(ProgressEvent{Phase: PhaseLabels, Message: "Linking resources to labels and tags..."})
+	names := make([]string, 0, len(labelled))
+	for name := range labelled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Labels are added under the organization, or the project they are first seen in
+	// when there is no organization in assets
+	labelParents := make(map[string]string, len(labels))
+	for _, name := range names {
+		for _, label := range labelled[name].labels {
+			if _, found := labelParents[label]; found {
+				continue
+			}
+			if len(v.OrgRoots) > 0 {
+				labelParents[label] = v.OrgRoots[0]
+			} else {
+				labelParents[label] = labelled[name].project
+			}
+		}
+	}
+
+	tx, err = v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, label := range sortedKeys(labelParents) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if v.update != nil && tx.Bucket([]byte("Assets")).Get([]byte(label)) != nil {
+			continue
+		}
+		parent := labelParents[label]
+		ancestors := []string{strings.TrimPrefix(parent, resourceManagerService)}
+		if existing := tx.Bucket([]byte("Assets")).Get([]byte(parent)); existing != nil {
+			var resource TemplateResource
+			if err = json.Unmarshal(existing, &resource); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", parent))
+			}
+			ancestors = resource.Ancestors
+		} else {
+			v.warn(PhaseLabels, "parent %s of label %s not found in assets.", parent, label)
+		}
+		err = v.addAssetFromMap(tx, map[string]interface{}{
+			"name":       label,
+			"asset_type": labelAssetType,
+			"resource": map[string]interface{}{
+				"version":        "v1",
+				"discovery_name": "Label",
+				"parent":         parent,
+				"data": map[string]interface{}{
+					"key":   labels[label][0],
+					"value": labels[label][1],
+				},
+			},
+			"ancestors": ancestors,
+			"source":    "labels",
+		})
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("adding label %s", label))
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		for _, label := range labelled[name].labels {
+			v.QW.AddQuad(cayley.Quad(name, "uses", label, labelled[name].assetType))
+			v.QW.AddQuad(cayley.Quad(name, "labelled", label, labelled[name].assetType))
+			v.TotalEdges++
+		}
+	}
+
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].name < bindings[j].name })
+	for _, binding := range bindings {
+		if !v.update.isAffected(binding.resource) {
+			continue
+		}
+		resource, err := v.getAsset(binding.resource)
+		if err != nil {
+			v.report().addDanglingReference(tagBindingAssetType, binding.name, binding.resource)
+			continue
+		}
+		if _, err := v.getAsset(binding.tagValue); err != nil {
+			v.report().addDanglingReference(tagBindingAssetType, binding.name, binding.tagValue)
+		}
+		v.QW.AddQuad(cayley.Quad(binding.resource, "uses", binding.tagValue, resource.AssetType))
+		v.QW.AddQuad(cayley.Quad(binding.resource, "tagged", binding.tagValue, resource.AssetType))
+		v.TotalEdges++
+	}
+	if err = v.removeUnusedLabels(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseLabels, Message: fmt.Sprintf("Labels: %d added, %d resources labelled, %d tag bindings.", len(labelParents), len(names), len(bindings)), Done: true})
+	return nil
+}
+
+// removeUnusedLabels removes the label vertexes that affected resources were linked to
+// before applying changes, if no resource is linked to them anymore.
+func (v *GcpViz) removeUnusedLabels() error {
+	if v.update == nil || len(v.update.labels) == 0 {
+		return nil
+	}
+	tx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, label := range sortedNames(v.update.labels) {
+		used := false
+		for _, q := range v.quadsOf(cquad.Object, label) {
+			used = used || quadValue(q.Predicate) == "labelled"
+		}
+		if used {
+			continue
+		}
+		bv := tx.Bucket([]byte("Assets")).Get([]byte(label))
+		if bv == nil {
+			continue
+		}
+		var resource TemplateResource
+		if err = json.Unmarshal(bv, &resource); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", label))
+		}
+		if err = tx.Bucket([]byte("Assets")).Delete([]byte(label)); err != nil {
+			return err
+		}
+		v.QW.RemoveQuad(cayley.Quad(resource.Resource.Parent, "child", label, resource.AssetType))
+		v.TotalVertexes--
+		v.TotalEdges--
+	}
+	return tx.Commit()
+}
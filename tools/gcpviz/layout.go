@@ -0,0 +1,165 @@
+package gcpviz
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// LayoutProfile adds graph options for a Graphviz layout engine on top of the style.
+// With Hierarchy, nodes are ranked by the resource hierarchy (organization, folders,
+// projects, networks and subnetworks) and edges that do not follow the hierarchy do
+// not affect the ranking.
+type LayoutProfile struct {
+	Options   map[string]string
+	Hierarchy bool
+}
+
+var Layouts = map[string]LayoutProfile{
+	"default": LayoutProfile{},
+	"hierarchical": LayoutProfile{
+		// Edges point from the user to the used resource (ie. project to folder), so
+		// ranks go from bottom to top to place the organization on top
+		Options: map[string]string{
+			"layout":  "dot",
+			"rankdir": "BT",
+			"newrank": "true",
+			"ranksep": "1.2",
+			"nodesep": "0.4",
+		},
+		Hierarchy: true,
+	},
+}
+
+// Weight of edges between levels of the hierarchy, to keep them short and straight
+const hierarchyEdgeWeight = 10
+
+type layoutNode struct {
+	assetType   string
+	folderDepth int
+}
+
+func layoutProfile(name string) (LayoutProfile, error) {
+	if name == "" {
+		return Layouts["default"], nil
+	}
+	profile, found := Layouts[name]
+	if !found {
+		layouts := make([]string, 0, len(Layouts))
+		for k := range Layouts {
+			layouts = append(layouts, k)
+		}
+		sort.Strings(layouts)
+		return profile, fmt.Errorf("unknown layout %s (available: %s)", name, strings.Join(layouts, ", "))
+	}
+	return profile, nil
+}
+
+// WithLayout selects a layout profile (default or hierarchical).
+func WithLayout(layout string) Option {
+	return func(c *config) error {
+		if _, err := layoutProfile(layout); err != nil {
+			return err
+		}
+		c.layout = layout
+		return nil
+	}
+}
+
+// addLayoutNode records a rendered node for ranking.
+func (v *GcpViz) addLayoutNode(id int64, resource *TemplateResource) {
+	if !v.layout.Hierarchy {
+		return
+	}
+	node := layoutNode{assetType: resource.AssetType}
+	switch resource.AssetType {
+	case "cloudresourcemanager.googleapis.com/Folder":
+		for _, ancestor := range resource.Ancestors {
+			if strings.HasPrefix(ancestor, "folders/") {
+				node.folderDepth++
+			}
+		}
+		if node.folderDepth == 0 {
+			node.folderDepth = 1
+		}
+		if node.folderDepth > v.maxFolderDepth {
+			v.maxFolderDepth = node.folderDepth
+		}
+	case "cloudresourcemanager.googleapis.com/Organization",
+		"cloudresourcemanager.googleapis.com/Project",
+		"compute.googleapis.com/Network",
+		"compute.googleapis.com/Subnetwork":
+	default:
+		return
+	}
+	v.layoutNodes[id] = node
+}
+
+// layoutRank returns the rank of a node in the hierarchy, or -1 if the node is not
+// part of the hierarchy. All projects share a rank below the deepest folder.
+func (v *GcpViz) layoutRank(id int64) int {
+	node, found := v.layoutNodes[id]
+	if !found {
+		return -1
+	}
+	projectRank := v.maxFolderDepth + 1
+	switch node.assetType {
+	case "cloudresourcemanager.googleapis.com/Organization":
+		return 0
+	case "cloudresourcemanager.googleapis.com/Folder":
+		return node.folderDepth
+	case "cloudresourcemanager.googleapis.com/Project":
+		return projectRank
+	case "compute.googleapis.com/Network":
+		return projectRank + 1
+	case "compute.googleapis.com/Subnetwork":
+		return projectRank + 2
+	}
+	return -1
+}
+
+// layoutEdgeAttributes returns the attributes of an edge from user to used: a weight
+// for edges to the next level up in the hierarchy and constraint=false for other edges
+// between nodes of the hierarchy, which would otherwise pull levels together. Those
+// are peerings and edges that skip levels (ie. a project directly in the organization
+// while other projects are in folders), whose nodes are kept in place by the ranks.
+func (v *GcpViz) layoutEdgeAttributes(userId int64, usedId int64) string {
+	if !v.layout.Hierarchy {
+		return ""
+	}
+	userRank, usedRank := v.layoutRank(userId), v.layoutRank(usedId)
+	if userRank < 0 || usedRank < 0 {
+		return ""
+	}
+	if usedRank == userRank-1 {
+		return fmt.Sprintf("weight=%d", hierarchyEdgeWeight)
+	}
+	return "constraint=false"
+}
+
+// writeLayoutRanks writes the nodes of each level of the hierarchy as rank=same groups.
+func (v *GcpViz) writeLayoutRanks(out io.Writer) {
+	if !v.layout.Hierarchy {
+		return
+	}
+	ranks := make(map[int][]int64, 0)
+	for id := range v.layoutNodes {
+		rank := v.layoutRank(id)
+		ranks[rank] = append(ranks[rank], id)
+	}
+	levels := make([]int, 0, len(ranks))
+	for rank := range ranks {
+		levels = append(levels, rank)
+	}
+	sort.Ints(levels)
+	for _, rank := range levels {
+		ids := ranks[rank]
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		nodes := make([]string, len(ids))
+		for idx, id := range ids {
+			nodes[idx] = fmt.Sprintf("N_%d;", id)
+		}
+		fmt.Fprintf(out, "  { rank=same; %s }\n", strings.Join(nodes, " "))
+	}
+}
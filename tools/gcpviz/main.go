@@ -1,7 +1,6 @@
 package gcpviz
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
@@ -13,6 +12,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -52,12 +52,70 @@ type GcpViz struct {
 	transaction   *bolt.Tx
 	bfilter       *bloom.BloomFilter
 
-	OrgRoots []string
+	// Layout profile and the nodes ranked by the resource hierarchy while rendering
+	layout         LayoutProfile
+	layoutNodes    map[int64]layoutNode
+	maxFolderDepth int
+
+	// Copies of the label, link and style templates bound to this graph
+	boundTemplates     map[*template.Template]*template.Template
+	boundTemplatesLock sync.Mutex
+
+	// Label, link and style templates by asset type (edge styles by asset type pair and
+	// by relation), parsed from the labels and style files
+	Labels        map[string]*template.Template
+	HeadLabels    map[string]*template.Template
+	TailLabels    map[string]*template.Template
+	Links         map[string]*template.Template
+	Style         GraphStyle
+	Nodes         map[string]*template.Template
+	Edges         map[string]map[string]*template.Template
+	RelationEdges map[string]*template.Template
+	Conditions    map[string][]NodeConditionTemplate
 
-	TotalVertexes int64
-	TotalEdges    int64
-	TotalAliases  int64
-	TotalIps      int64
+	OrgRoots []string
+	Metrics  map[string]NodeMetrics
+	// Minimum and maximum of every numeric metric, used by the color scale functions
+	MetricRanges map[string][2]float64
+
+	// Progress receives progress events of long-running phases
+	Progress ProgressFunc
+
+	// Queries are stopped when they run longer than QueryTimeout or emit more than
+	// QueryLimit results, unless zero
+	QueryTimeout time.Duration
+	QueryLimit   int
+
+	// Skip assets that cannot be parsed instead of failing, the problems found while
+	// generating are collected in Report
+	Lenient      bool
+	Report       *Report
+	rawRelations RawResourceRelations
+
+	// Add resource labels and tag values as vertexes linked to the resources they are
+	// attached to, optionally only labels with one of LabelKeys
+	LabelVertexes bool
+	LabelKeys     []string
+
+	// Graph file being generated, and the temporary file it is generated into
+	dbFile  string
+	tmpFile string
+
+	// Assets affected by the batch of changes being applied, nil when generating
+	update *graphUpdate
+
+	// Time of the snapshot to record when generating, and the time to render the graph
+	// as of when visualizing
+	SnapshotTime time.Time
+	AsOf         time.Time
+	snapshot     time.Time
+
+	TotalVertexes   int64
+	TotalEdges      int64
+	TotalAliases    int64
+	TotalIps        int64
+	TotalDuplicates int64
+	TotalCrossOrg   int64
 }
 
 type TemplateResourceResource struct {
@@ -66,13 +124,28 @@ type TemplateResourceResource struct {
 	DiscoveryName        string      `json:"discovery:name"`
 	Version              string      `json:"version"`
 	Parent               string      `json:"parent"`
+
+	// Links of Kubernetes objects to other objects and resources, by field
+	Kubernetes map[string][]string `json:"kubernetes,omitempty"`
+	// Links of on-premises sites to hybrid connectivity resources, by field
+	OnPrem map[string][]string `json:"onprem,omitempty"`
+	// IP address usage and overlapping ranges of subnetworks
+	IpUsage *IpUsage `json:"ip_usage,omitempty"`
+	// Fields computed from linked assets, by field name
+	Computed map[string]interface{} `json:"computed,omitempty"`
 }
 
 type TemplateResource struct {
-	Name      string                   `json:"name"`
-	AssetType string                   `json:"asset_type"`
-	Resource  TemplateResourceResource `json:"resource"`
-	Ancestors []string                 `json:"ancestors"`
+	Name       string                   `json:"name"`
+	AssetType  string                   `json:"asset_type"`
+	Resource   TemplateResourceResource `json:"resource"`
+	Ancestors  []string                 `json:"ancestors"`
+	Planned    string                   `json:"planned,omitempty"`
+	Source     string                   `json:"source,omitempty"`
+	UpdateTime string                   `json:"update_time,omitempty"`
+	FirstSeen  *time.Time               `json:"-"`
+	LastSeen   *time.Time               `json:"-"`
+	Metrics    NodeMetrics              `json:"-"`
 }
 
 type ResourceRelations struct {
@@ -80,20 +153,40 @@ type ResourceRelations struct {
 	Aliases     map[string][]jsonpath.FilterFunc
 	Enrich      map[string]map[string]map[string]jsonpath.FilterFunc
 	IpAddresses map[string][]jsonpath.FilterFunc
+	Computed    map[string]map[string]*computedField
+
+	// Names of the relationships of asset types, by index of the JSONPath expression
+	Predicates map[string][]string
 }
 
 type RawResourceRelations struct {
-	AssetTypes  map[string][]string                     `yaml:"asset_types"`
+	AssetTypes  map[string][]RelationPath               `yaml:"asset_types"`
 	Aliases     map[string][]string                     `yaml:"aliases"`
 	Enrich      map[string]map[string]map[string]string `yaml:"enrich"`
 	IpAddresses map[string][]string                     `yaml:"ip_addresses"`
+	Computed    map[string]map[string]ComputedField     `yaml:"computed"`
 }
 
 type GraphStyle struct {
-	Global  map[string]string            `yaml:"global" json:"global"`
-	Options map[string]string            `yaml:"options" json:"options"`
-	Edges   map[string]map[string]string `yaml:"edges" json:"edges"`
-	Nodes   map[string]string            `yaml:"nodes" json:"nodes"`
+	Global     map[string]string            `yaml:"global" json:"global"`
+	Options    map[string]string            `yaml:"options" json:"options"`
+	Edges      map[string]map[string]string `yaml:"edges" json:"edges"`
+	Relations  map[string]string            `yaml:"relations" json:"relations"`
+	Nodes      map[string]string            `yaml:"nodes" json:"nodes"`
+	Conditions map[string][]NodeCondition   `yaml:"conditions" json:"conditions"`
+}
+
+// NodeCondition merges Style into the node style of an asset when the When template
+// evaluates to "true", replacing attributes with the same key. Both templates receive
+// the same data as node styles.
+type NodeCondition struct {
+	When  string `yaml:"when" json:"when"`
+	Style string `yaml:"style" json:"style"`
+}
+
+type NodeConditionTemplate struct {
+	When  *template.Template
+	Style *template.Template
 }
 
 type NodeStyle struct {
@@ -102,6 +195,10 @@ type NodeStyle struct {
 	TailLabel string `json:"tailLabel"`
 	Link      string `json:"link"`
 	Resource  *TemplateResourceResource
+	Planned   string
+	Metrics   NodeMetrics
+	// Name of the relationship for edges, ie. peers_with ("uses" for plain references)
+	Relation string `json:"relation,omitempty"`
 }
 
 type IpAddressLink struct {
@@ -110,25 +207,34 @@ type IpAddressLink struct {
 	AssetType string
 }
 
-var Labels map[string]*template.Template
-var HeadLabels map[string]*template.Template
-var TailLabels map[string]*template.Template
-var Links map[string]*template.Template
-var Style GraphStyle
-var Nodes map[string]*template.Template
-var Edges map[string]map[string]*template.Template
-
 var templateFuncMap = template.FuncMap{
 	// The name "title" is what the function will be called in the template text.
-	"GetLastPart":    GetLastPart,
-	"GetPartFromEnd": GetPartFromEnd,
-	"GetRegion":      GetRegion,
-	"Join":           Join,
-	"JoinNicely":     JoinNicely,
-	"ToLower":        ToLower,
-	"DaysLeft":       DaysLeft,
-	"NotLast":        NotLast,
-	"Replace":        Replace,
+	"GetLastPart":      GetLastPart,
+	"GetPartFromEnd":   GetPartFromEnd,
+	"GetRegion":        GetRegion,
+	"Join":             Join,
+	"JoinNicely":       JoinNicely,
+	"ToLower":          ToLower,
+	"DaysLeft":         DaysLeft,
+	"NotLast":          NotLast,
+	"Replace":          Replace,
+	"MetricMin":        unboundMetricMin,
+	"MetricMax":        unboundMetricMax,
+	"ScaleValue":       ScaleValue,
+	"ColorScale":       ColorScale,
+	"HeatColor":        unboundHeatColor,
+	"GetPartAfter":     GetPartAfter,
+	"GetProject":       GetProject,
+	"GetZone":          GetZone,
+	"Default":          Default,
+	"GetLabel":         GetLabel,
+	"HtmlEscape":       HtmlEscape,
+	"HumanizeBytes":    HumanizeBytes,
+	"HumanizeDuration": HumanizeDuration,
+	"CidrSize":         CidrSize,
+	"CidrFirst":        CidrFirst,
+	"CidrLast":         CidrLast,
+	"GetAsset":         unboundGetAsset,
 }
 
 func NotLast(x int, a interface{}) bool {
@@ -174,52 +280,60 @@ func GetLastPart(s string) string {
 
 func GetPartFromEnd(s string, idx int) string {
 	sp := strings.Split(s, "/")
+	if idx < 1 || idx > len(sp) {
+		return ""
+	}
 	return sp[len(sp)-idx]
 }
 
 func GetRegion(s string) string {
-	sp := strings.Split(s, "/")
-	for i := 0; i < len(sp); i++ {
-		if sp[i] == "regions" {
-			return sp[i+1]
-		}
-	}
-
-	return ""
+	return GetPartAfter("regions", s)
 }
 
 func Replace(from string, to string, input string) string {
 	return strings.Replace(input, from, to, -1)
 }
 
+// NewGcpViz creates a graph engine from a relations, labels and style file. Use New for
+// the other options.
 func NewGcpViz(relationsFile string, labelsFile string, styleFile string, override map[string]string) (*GcpViz, error) {
-	qs, _ := graph.NewQuadStore("memstore", "", nil)
-	qw, _ := graph.NewQuadWriter("single", qs, nil)
-
-	gcpViz := GcpViz{QS: qs, QW: qw}
+	return New(WithRelationsFile(relationsFile), WithLabelsFile(labelsFile), WithStyleFiles(styleFile), WithStyleOverrides(override))
+}
 
-	err := gcpViz.loadRelationsMap(relationsFile)
-	if err != nil {
-		return nil, fmt.Errorf("error loading relations map: %v", err)
-	}
-	err = gcpViz.loadLabelsMap(labelsFile)
-	if err != nil {
-		return nil, fmt.Errorf("error loading labels map: %v", err)
-	}
-	err = gcpViz.loadStyleMap(styleFile, override)
-	if err != nil {
-		return nil, fmt.Errorf("error loading styles map: %v", err)
-	}
-	return &gcpViz, nil
+// NewGcpVizWithStyles creates a graph engine with layered style files, where later
+// files override earlier ones, and an optional built-in theme.
+func NewGcpVizWithStyles(relationsFile string, labelsFile string, styleFiles []string, theme string, override map[string]string) (*GcpViz, error) {
+	return New(WithRelationsFile(relationsFile), WithLabelsFile(labelsFile), WithStyleFiles(styleFiles...), WithTheme(theme), WithStyleOverrides(override))
 }
 
 func (v *GcpViz) Create(dbFile string) error {
-	db, err := bolt.Open(dbFile, 0600, nil)
+	// The graph is generated into a temporary file that replaces dbFile when saved, so
+	// that an interrupted or failed run leaves the previous graph file intact
+	v.dbFile = dbFile
+	v.tmpFile = dbFile + ".tmp"
+	os.Remove(v.tmpFile)
+
+	_, statErr := os.Stat(dbFile)
+	if !v.SnapshotTime.IsZero() && statErr == nil {
+		if err := copyFile(dbFile, v.tmpFile); err != nil {
+			return err
+		}
+	}
+
+	db, err := bolt.Open(v.tmpFile, 0600, nil)
 	if err != nil {
 		return err
 	}
 	v.AssetDatabase = db
 
+	// New snapshots are added to an existing graph file
+	if !v.SnapshotTime.IsZero() && statErr == nil {
+		err = v.resetSnapshot()
+		if err != nil {
+			return err
+		}
+	}
+
 	err = v.initializeBolt()
 	if err != nil {
 		return err
@@ -256,6 +370,22 @@ func (v *GcpViz) Load(dbFile string) error {
 		return errors.New("could not find bucket Aliases in database")
 	}
 
+	if !v.AsOf.IsZero() {
+		return v.loadSnapshot(tx)
+	}
+
+	if err := v.readGraph(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Rollback(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readGraph adds the saved organization roots and quads of the graph.
+func (v *GcpViz) readGraph(tx *bolt.Tx) error {
 	rootBucket := tx.Bucket([]byte("Organizations"))
 	if rootBucket == nil {
 		return errors.New("could not find bucket OrgRoots in database")
@@ -273,33 +403,30 @@ func (v *GcpViz) Load(dbFile string) error {
 	var cstr cquad.String = "quad"
 	gob.Register(cstr)
 
-	graph := v.Graph.Get([]byte("Graph"))
+	graph := tx.Bucket([]byte("Graph")).Get([]byte("Graph"))
 
 	buffer = bytes.NewReader(graph)
 	dec = gob.NewDecoder(buffer)
 
+	var err error
 	for {
 		var q cquad.Quad
-		err := dec.Decode(&q)
-		if err != nil {
+		if err = dec.Decode(&q); err != nil {
 			break
 		}
-		err = v.QW.AddQuad(q)
-		if err != nil {
+		if err = v.QW.AddQuad(q); err != nil {
 			break
 		}
 	}
 	if err != io.EOF {
 		return err
 	}
-
-	if err := tx.Rollback(); err != nil {
-		return err
-	}
 	return nil
 }
 
 func (v *GcpViz) Save() error {
+	v.progress(ProgressEvent{Phase: PhaseSave, Message: "Saving graph..."})
+
 	// Insert resource to BoltDB
 	tx, err := v.AssetDatabase.Begin(true)
 	if err != nil {
@@ -346,13 +473,60 @@ func (v *GcpViz) Save() error {
 	if err = tx.Commit(); err != nil {
 		return err
 	}
+	if !v.SnapshotTime.IsZero() {
+		if err = v.recordSnapshot(); err != nil {
+			return err
+		}
+	}
 	if err = v.AssetDatabase.Close(); err != nil {
 		return err
 	}
+	v.AssetDatabase = nil
+
+	if v.tmpFile != "" {
+		if err = os.Rename(v.tmpFile, v.dbFile); err != nil {
+			return err
+		}
+		v.tmpFile = ""
+	}
+	v.progress(ProgressEvent{Phase: PhaseSave, Message: fmt.Sprintf("Saved graph to %s.", v.dbFile), Done: true})
+	return nil
+}
 
+// Abort discards a graph that is being generated, leaving the previous graph file
+// (if any) untouched.
+func (v *GcpViz) Abort() error {
+	if v.AssetDatabase != nil {
+		v.AssetDatabase.Close()
+		v.AssetDatabase = nil
+	}
+	if v.tmpFile != "" {
+		err := os.Remove(v.tmpFile)
+		v.tmpFile = ""
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 func (v *GcpViz) EscapeLabel(label string) string {
 	if strings.HasPrefix(strings.Trim(label, " \n"), "<") && strings.HasSuffix(strings.Trim(label, " \n"), ">") {
 		return fmt.Sprintf("%s", strings.ReplaceAll(label, "\n", "<br/>"))
@@ -361,22 +535,38 @@ func (v *GcpViz) EscapeLabel(label string) string {
 }
 
 func (v *GcpViz) getAsset(node string) (*TemplateResource, error) {
-
-	if strings.HasPrefix(node, "https://www.googleapis.com/compute/v1/") {
-		node = strings.Replace(node, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1)
-	}
-
 	tx, err := v.AssetDatabase.Begin(false)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
+	return v.getAssetTx(tx, node)
+}
+
+// getAssetTx fetches an asset within an open transaction. Use it instead of getAsset
+// while a write transaction is open: Bolt cannot grow the database file while a read
+// transaction is open, so committing the write transaction would block forever.
+func (v *GcpViz) getAssetTx(tx *bolt.Tx, node string) (*TemplateResource, error) {
+	if strings.HasPrefix(node, "https://www.googleapis.com/compute/v1/") {
+		node = strings.Replace(node, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1)
+	}
+
 	v.Assets = tx.Bucket([]byte("Assets"))
 	if v.Assets == nil {
 		return nil, errors.New("could not find bucket Assets in database")
 	}
 
-	resource := v.Assets.Get([]byte(node))
+	var err error
+	var resource []byte
+	var interval *Interval
+	if !v.snapshot.IsZero() {
+		resource, interval, err = v.assetAsOf(tx, node)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		resource = v.Assets.Get([]byte(node))
+	}
 	if resource == nil {
 		return nil, fmt.Errorf("resource %s not found in database", node)
 	}
@@ -386,42 +576,131 @@ func (v *GcpViz) getAsset(node string) (*TemplateResource, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "marshaling resource to template resource")
 	}
+	if interval != nil {
+		templateResource.FirstSeen = &interval.FirstSeen
+		templateResource.LastSeen = &interval.LastSeen
+	}
 	return &templateResource, nil
 }
 
+// splitAttributes splits a comma separated Graphviz attribute list, leaving commas
+// inside quoted strings and HTML labels alone.
+func splitAttributes(attributes string) []string {
+	parts := make([]string, 0)
+	quoted, escaped, depth, last := false, false, 0, 0
+	for idx, c := range attributes {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			depth++
+		case c == '>' && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, attributes[last:idx])
+			last = idx + 1
+		}
+	}
+	parts = append(parts, attributes[last:])
+
+	split := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			split = append(split, part)
+		}
+	}
+	return split
+}
+
+// mergeAttributes merges a Graphviz attribute list into another one. An attribute
+// replaces all earlier attributes with the same key, in place of the first one.
+func mergeAttributes(attributes string, other string) string {
+	merged := splitAttributes(attributes)
+	for _, attribute := range splitAttributes(other) {
+		key := strings.TrimSpace(strings.SplitN(attribute, "=", 2)[0])
+		found := false
+		kept := merged[:0]
+		for _, existing := range merged {
+			if strings.TrimSpace(strings.SplitN(existing, "=", 2)[0]) != key {
+				kept = append(kept, existing)
+			} else if !found {
+				kept = append(kept, attribute)
+				found = true
+			}
+		}
+		merged = kept
+		if !found {
+			merged = append(merged, attribute)
+		}
+	}
+	return strings.Join(merged, ",")
+}
+
 func (v *GcpViz) renderNode(out io.Writer, node string, id int64) (bool, error) {
 	templateResource, err := v.getAsset(node)
 	if err != nil {
 		return false, errors.Wrapf(err, fmt.Sprintf("resource %s not found", node))
 	}
+	templateResource.Metrics = v.metricsFor(templateResource)
 
-	if _, found := Labels[templateResource.AssetType]; !found {
+	if _, found := v.Labels[templateResource.AssetType]; !found {
 		return false, fmt.Errorf("label template not found for resource type %s", templateResource.AssetType)
 	}
-	if Labels[templateResource.AssetType] != nil {
+	if v.Labels[templateResource.AssetType] != nil {
 		var label bytes.Buffer
-		Labels[templateResource.AssetType].Execute(&label, templateResource)
+		err = v.executeTemplate(v.Labels[templateResource.AssetType], &label, templateResource)
+		if err != nil {
+			v.warn(PhaseNodes, "error rendering label for resource %s: %v", node, err)
+		}
 
 		var link string = ""
-		if _, found := Links[templateResource.AssetType]; found {
+		if _, found := v.Links[templateResource.AssetType]; found {
 			var linkBuf bytes.Buffer
-			Links[templateResource.AssetType].Execute(&linkBuf, templateResource)
+			err = v.executeTemplate(v.Links[templateResource.AssetType], &linkBuf, templateResource)
+			if err != nil {
+				v.warn(PhaseNodes, "error rendering link for resource %s: %v", node, err)
+			}
 			link = linkBuf.String()
 		}
 
-		if _, found := Nodes[templateResource.AssetType]; !found {
+		if _, found := v.Nodes[templateResource.AssetType]; !found {
 			return false, fmt.Errorf("node style template not found for resource type %s", templateResource.AssetType)
 		}
 
 		var nodeOut bytes.Buffer
-		nodeStyle := NodeStyle{Resource: &templateResource.Resource, Label: v.EscapeLabel(strings.Trim(label.String(), "\n")), Link: v.EscapeLabel(strings.Trim(link, "\n"))}
-		err = Nodes[templateResource.AssetType].Execute(&nodeOut, nodeStyle)
+		nodeStyle := NodeStyle{Resource: &templateResource.Resource, Planned: templateResource.Planned, Metrics: templateResource.Metrics, Label: v.EscapeLabel(strings.Trim(label.String(), "\n")), Link: v.EscapeLabel(strings.Trim(link, "\n"))}
+		err = v.executeTemplate(v.Nodes[templateResource.AssetType], &nodeOut, nodeStyle)
 		if err != nil {
 			return false, errors.Wrapf(err, fmt.Sprintf("error rending resource %s node", node))
 		}
 
 		if strings.TrimSpace(nodeOut.String()) != "" {
-			fmt.Fprintf(out, "  N_%d [%s];\n", id, strings.Trim(nodeOut.String(), "\n"))
+			nodeAttributes := strings.Trim(nodeOut.String(), "\n")
+			// Conditions for all asset types ("*") are evaluated last
+			conditions := make([]NodeConditionTemplate, 0, len(v.Conditions[templateResource.AssetType])+len(v.Conditions["*"]))
+			conditions = append(append(conditions, v.Conditions[templateResource.AssetType]...), v.Conditions["*"]...)
+			for _, condition := range conditions {
+				var when bytes.Buffer
+				err = v.executeTemplate(condition.When, &when, nodeStyle)
+				if err != nil {
+					return false, errors.Wrapf(err, fmt.Sprintf("error evaluating style condition for resource %s", node))
+				}
+				if strings.TrimSpace(when.String()) == "true" {
+					var conditionOut bytes.Buffer
+					err = v.executeTemplate(condition.Style, &conditionOut, nodeStyle)
+					if err != nil {
+						return false, errors.Wrapf(err, fmt.Sprintf("error rendering style condition for resource %s", node))
+					}
+					nodeAttributes = mergeAttributes(nodeAttributes, conditionOut.String())
+				}
+			}
+			fmt.Fprintf(out, "  N_%d [%s];\n", id, nodeAttributes)
+			v.addLayoutNode(id, templateResource)
 			return true, nil
 		}
 	}
@@ -439,7 +718,7 @@ func (v *GcpViz) renderBothNodes(parent string, node string, parentId int64, id
 					v.bfilter.Add(pRaw)
 				}
 			} else {
-				fmt.Fprintf(os.Stderr, "Failed to render parent node %s: %v\n", parent, err)
+				v.warn(PhaseNodes, "failed to render parent node %s: %v", parent, err)
 			}
 		}
 	}
@@ -453,7 +732,7 @@ func (v *GcpViz) renderBothNodes(parent string, node string, parentId int64, id
 				v.bfilter.Add(nRaw)
 			}
 		} else {
-			fmt.Fprintf(os.Stderr, "Failed to render node %s: %v\n", node, err)
+			v.warn(PhaseNodes, "failed to render node %s: %v", node, err)
 		}
 	}
 	return nil
@@ -469,32 +748,58 @@ func (v *GcpViz) renderEdge(parent string, node string, parentId int64, id int64
 		return errors.Wrapf(err, fmt.Sprintf("target resource %s not found", node))
 	}
 
+	// Styles for named relationships are applied on top of the styles for asset types
+	relation := v.relationBetween(parent, node)
+	relationStyle := v.RelationEdges[relation]
+
 	var edgeStyle *template.Template = nil
-	if parentStyle, found := Edges[templateResourceParent.AssetType]; found {
+	if parentStyle, found := v.Edges[templateResourceParent.AssetType]; found {
 		if targetStyle, found := parentStyle[templateResourceTarget.AssetType]; found {
 			edgeStyle = targetStyle
-		} else {
-			fmt.Fprintf(os.Stderr, "Missing style %s -> %s (from %s TO %s)\n", templateResourceParent.AssetType, templateResourceTarget.AssetType, parent, node)
+		} else if relationStyle == nil {
+			v.warn(PhaseEdges, "missing style %s -> %s (from %s TO %s)", templateResourceParent.AssetType, templateResourceTarget.AssetType, parent, node)
 		}
-	} else {
-		fmt.Fprintf(os.Stderr, "Missing style %s -> %s (FROM %s to %s)\n", templateResourceParent.AssetType, templateResourceTarget.AssetType, parent, node)
+	} else if relationStyle == nil {
+		v.warn(PhaseEdges, "missing style %s -> %s (FROM %s to %s)", templateResourceParent.AssetType, templateResourceTarget.AssetType, parent, node)
 	}
 
-	if edgeStyle != nil {
+	if edgeStyle != nil || relationStyle != nil {
 		var headLabel bytes.Buffer
-		if _, found := HeadLabels[templateResourceParent.AssetType]; found {
-			HeadLabels[templateResourceParent.AssetType].Execute(&headLabel, templateResourceParent)
+		if _, found := v.HeadLabels[templateResourceParent.AssetType]; found {
+			err = v.executeTemplate(v.HeadLabels[templateResourceParent.AssetType], &headLabel, templateResourceParent)
+			if err != nil {
+				v.warn(PhaseEdges, "error rendering head label for resource %s: %v", parent, err)
+			}
 		}
 		var tailLabel bytes.Buffer
-		if _, found := TailLabels[templateResourceParent.AssetType]; found {
-			TailLabels[templateResourceParent.AssetType].Execute(&tailLabel, templateResourceParent)
+		if _, found := v.TailLabels[templateResourceParent.AssetType]; found {
+			err = v.executeTemplate(v.TailLabels[templateResourceParent.AssetType], &tailLabel, templateResourceParent)
+			if err != nil {
+				v.warn(PhaseEdges, "error rendering tail label for resource %s: %v", parent, err)
+			}
 		}
 
-		var edgeOut bytes.Buffer
-		nodeStyle := NodeStyle{TailLabel: v.EscapeLabel(strings.Trim(tailLabel.String(), "\n")), HeadLabel: v.EscapeLabel(strings.Trim(headLabel.String(), "\n"))}
-		edgeStyle.Execute(&edgeOut, nodeStyle)
+		nodeStyle := NodeStyle{TailLabel: v.EscapeLabel(strings.Trim(tailLabel.String(), "\n")), HeadLabel: v.EscapeLabel(strings.Trim(headLabel.String(), "\n")), Relation: relation}
+		attributes := make([]string, 0, 2)
+		for _, style := range []*template.Template{edgeStyle, relationStyle} {
+			if style == nil {
+				continue
+			}
+			var edgeOut bytes.Buffer
+			err = v.executeTemplate(style, &edgeOut, nodeStyle)
+			if err != nil {
+				return errors.Wrapf(err, fmt.Sprintf("error rendering edge %s -> %s", parent, node))
+			}
+			if attribute := strings.Trim(edgeOut.String(), "\n"); attribute != "" {
+				attributes = append(attributes, attribute)
+			}
+		}
 
-		edge := strings.Trim(edgeOut.String(), "\n")
+		if layoutAttributes := v.layoutEdgeAttributes(parentId, id); layoutAttributes != "" {
+			attributes = append(attributes, layoutAttributes)
+		}
+
+		edge := strings.Join(attributes, ",")
 		if edge != "" {
 			fmt.Fprintf(out, "  N_%d -> N_%d [%s];\n", parentId, id, edge)
 		} else {
@@ -512,11 +817,74 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 		return err
 	}
 	v.bfilter = bloom.New(uint(20*stats.Quads.Size), 5)
+	v.layoutNodes = make(map[int64]layoutNode, 0)
+	v.maxFolderDepth = 0
+
+	if err := v.writeGraphHeader(out, parameters); err != nil {
+		return err
+	}
+
+	gizmoQ, err := v.prepareQuery(gizmoQuery, parameters)
+	if err != nil {
+		return err
+	}
+
+	nodeProgress := v.newProgressCounter(PhaseNodes, "Rendering nodes", "results", 0, 1000)
+	err = v.executeQuery(ctx, gizmoQ, func(result queryResult) error {
+		err := v.renderBothNodes(result.parent, result.node, result.parentId, result.id, out)
+		if err != nil {
+			v.warn(PhaseNodes, "error rendering node (%s -> %s): %v", result.parent, result.node, err)
+		}
+		nodeProgress.Add(1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	nodeProgress.Done()
+
+	// Second pass, render edges
+	edgeProgress := v.newProgressCounter(PhaseEdges, "Rendering edges", "results", 0, 1000)
+	err = v.executeQuery(ctx, gizmoQ, func(result queryResult) error {
+		edgeProgress.Add(1)
+		var hadEdge bool = false
+		v.eachUser(result.node, func(target string, targetId int64) {
+			tRaw := make([]byte, 8)
+			binary.BigEndian.PutUint64(tRaw, uint64(targetId))
+
+			sRaw := make([]byte, 8)
+			binary.BigEndian.PutUint64(sRaw, uint64(result.id))
+
+			if v.bfilter.Test(sRaw) && v.bfilter.Test(tRaw) {
+				err := v.renderEdge(target, result.node, targetId, result.id, out) // Ignore errors, because some resources might be missing
+				if err == nil {
+					hadEdge = true
+				}
+			}
+		})
+		if !hadEdge { // Disconnected item
+			// We may want to do something here in the future, likely forcible connect to parent to avoid floating
+			// resources.
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	edgeProgress.Done()
+
+	v.writeLayoutRanks(out)
+	fmt.Fprintf(out, "}\n")
+	return nil
+}
 
+// writeGraphHeader writes the start of the graph with the global styles and options.
+func (v *GcpViz) writeGraphHeader(out io.Writer, parameters map[string]interface{}) error {
 	fmt.Fprintf(out, "digraph GCP {\n")
-	for k, v := range Style.Global {
+	// Keys are sorted to keep the output stable between runs
+	for _, k := range sortedKeys(v.Style.Global) {
 		var style bytes.Buffer
-		styleTemplate, err := template.New("style").Parse(v)
+		styleTemplate, err := template.New("style").Parse(v.Style.Global[k])
 		if err != nil {
 			return fmt.Errorf("error parsing style template: %v", err)
 		}
@@ -524,28 +892,69 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 
 		fmt.Fprintf(out, "  %s [%s];\n", k, style.String())
 	}
-	for k, v := range Style.Options {
-		fmt.Fprintf(out, "  %s=%s;\n", k, v)
+	for _, k := range sortedKeys(v.Style.Options) {
+		fmt.Fprintf(out, "  %s=%s;\n", k, v.Style.Options[k])
 	}
+	return nil
+}
+
+type queryResult struct {
+	node     string
+	id       int64
+	parent   string
+	parentId int64
+}
 
-	queryTemplate, err := template.New("query").Parse(gizmoQuery)
+func (v *GcpViz) prepareQuery(gizmoQuery string, parameters map[string]interface{}) (string, error) {
+	queryTemplate, err := template.New("query").Funcs(template.FuncMap{"js": queryJs}).Parse(gizmoQuery)
 	if err != nil {
-		return fmt.Errorf("error parsing query template: %v", err)
+		return "", fmt.Errorf("error parsing query template: %v", err)
 	}
 	var gizmoQ bytes.Buffer
 	parameters["Organizations"] = v.OrgRoots
-	queryTemplate.Execute(&gizmoQ, parameters)
+	escaped := make(map[string]interface{}, len(parameters))
+	for k, value := range parameters {
+		escaped[k], err = escapeQueryParameter(value)
+		if err != nil {
+			return "", fmt.Errorf("error escaping query parameter %s: %v", k, err)
+		}
+	}
+	err = queryTemplate.Execute(&gizmoQ, escaped)
+	if err != nil {
+		return "", fmt.Errorf("error rendering query template: %v", err)
+	}
+	return gizmoQ.String(), nil
+}
+
+// executeQuery runs a Gizmo query and calls fn for each emitted node, along with the
+// node tagged as its parent.
+func (v *GcpViz) executeQuery(ctx context.Context, gizmoQ string, fn func(queryResult) error) error {
+	queryCtx, cancel := v.queryContext(ctx)
+	defer cancel()
 
+	// One more result than the limit is requested to tell if the limit was exceeded
+	limit := -1
+	if v.QueryLimit > 0 {
+		limit = v.QueryLimit + 1
+	}
 	session := gizmo.NewSession(v.QS)
-	it, err := session.Execute(ctx, gizmoQ.String(), query.Options{
+	it, err := session.Execute(queryCtx, gizmoQ, query.Options{
 		Collation: query.Raw,
-		Limit:     -1,
+		Limit:     limit,
 	})
 	if err != nil {
 		return err
 	}
 	defer it.Close()
-	for it.Next(ctx) {
+	var count int
+	for it.Next(queryCtx) {
+		if err := queryCtx.Err(); err != nil {
+			return v.queryError(ctx, queryCtx, err)
+		}
+		count++
+		if v.QueryLimit > 0 && count > v.QueryLimit {
+			return errors.Wrap(ErrQueryLimit, fmt.Sprintf("query returned more than %d results", v.QueryLimit))
+		}
 		data := it.Result().(*gizmo.Result)
 
 		var (
@@ -595,83 +1004,27 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 			parentId = reflect.ValueOf(data.Tags["parent"]).Int()
 		}
 
-		err := v.renderBothNodes(parent, node, parentId, id, out)
+		err := fn(queryResult{node: node, id: id, parent: parent, parentId: parentId})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error rendering node (%s -> %s): %v\n", parent, node, err)
+			return err
 		}
 	}
 	if err := it.Err(); err != nil {
-		return err
-	}
-
-	// Second pass, render edges
-	session = gizmo.NewSession(v.QS)
-	it, err = session.Execute(ctx, gizmoQ.String(), query.Options{
-		Collation: query.Raw,
-		Limit:     -1,
-	})
-	if err != nil {
-		return err
+		return v.queryError(ctx, queryCtx, err)
 	}
-	defer it.Close()
-	for it.Next(ctx) {
-		data := it.Result().(*gizmo.Result)
-		var (
-			node string
-			id   int64
-			val  map[string]interface{}
-		)
-		if _, found := data.Tags[gizmo.TopResultTag]; !found {
-			val = data.Val.(map[string]interface{})
-			if _, found = val[gizmo.TopResultTag]; !found {
-				continue
-			} else {
-				node = val[gizmo.TopResultTag].(string)
-				qval, err := cquad.AsValue(node)
-				if !err {
-					continue
-				}
-				id = reflect.ValueOf(v.QS.ValueOf(qval).Key()).Int()
-			}
-		} else {
-			node = v.QS.NameOf(data.Tags[gizmo.TopResultTag]).Native().(string)
-			id = reflect.ValueOf(data.Tags[gizmo.TopResultTag]).Int()
-		}
-
-		qval, err := cquad.AsValue(node)
-		if !err {
-			continue
-		}
-		p := cayley.StartPath(v.QS, qval).In("uses")
-		var hadEdge bool = false
-		p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
-			targetId := reflect.ValueOf(v.QS.ValueOf(val).Key()).Int()
-
-			tRaw := make([]byte, 8)
-			binary.BigEndian.PutUint64(tRaw, uint64(targetId))
-
-			sRaw := make([]byte, 8)
-			binary.BigEndian.PutUint64(sRaw, uint64(id))
+	return v.queryError(ctx, queryCtx, queryCtx.Err())
+}
 
-			if v.bfilter.Test(sRaw) && v.bfilter.Test(tRaw) {
-				target := cquad.NativeOf(val).(string)
-				err := v.renderEdge(target, node, targetId, id, out) // Ignore errors, because some resources might be missing
-				if err == nil {
-					hadEdge = true
-				}
-			}
-		})
-		if !hadEdge { // Disconnected item
-			// We may want to do something here in the future, likely forcible connect to parent to avoid floating
-			// resources.
-		}
-	}
-	if err := it.Err(); err != nil {
-		return err
+// eachUser calls fn for every vertex that uses node.
+func (v *GcpViz) eachUser(node string, fn func(user string, userId int64)) {
+	qval, ok := cquad.AsValue(node)
+	if !ok {
+		return
 	}
-
-	fmt.Fprintf(out, "}\n")
-	return nil
+	p := cayley.StartPath(v.QS, qval).In("uses")
+	p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
+		fn(cquad.NativeOf(val).(string), reflect.ValueOf(v.QS.ValueOf(val).Key()).Int())
+	})
 }
 
 // Private methods
@@ -685,16 +1038,26 @@ func (v *GcpViz) loadRelationsMap(fileName string) error {
 	if err != nil {
 		return err
 	}
+	return v.setRelations(relations)
+}
 
+func (v *GcpViz) setRelations(relations RawResourceRelations) error {
+	v.rawRelations = relations
 	v.Relations.AssetTypes = make(map[string][]jsonpath.FilterFunc, len(relations.AssetTypes))
+	v.Relations.Predicates = make(map[string][]string, len(relations.AssetTypes))
 	for assetType, paths := range relations.AssetTypes {
 		v.Relations.AssetTypes[assetType] = make([]jsonpath.FilterFunc, len(paths))
+		v.Relations.Predicates[assetType] = make([]string, len(paths))
 		for idx, path := range paths {
-			preparedPath, err := jsonpath.Prepare(path)
+			preparedPath, err := jsonpath.Prepare(path.Path)
 			if err != nil {
 				return err
 			}
+			if err = checkRelationName(path.Relation); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("relation of %s", assetType))
+			}
 			v.Relations.AssetTypes[assetType][idx] = preparedPath
+			v.Relations.Predicates[assetType][idx] = path.Predicate()
 		}
 	}
 
@@ -737,6 +1100,18 @@ func (v *GcpViz) loadRelationsMap(fileName string) error {
 		}
 	}
 
+	v.Relations.Computed = make(map[string]map[string]*computedField, len(relations.Computed))
+	for assetType, fields := range relations.Computed {
+		v.Relations.Computed[assetType] = make(map[string]*computedField, len(fields))
+		for fieldName, field := range fields {
+			preparedField, err := prepareComputedField(field)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("computed field %s of %s", fieldName, assetType))
+			}
+			v.Relations.Computed[assetType][fieldName] = preparedField
+		}
+	}
+
 	return nil
 }
 
@@ -750,61 +1125,82 @@ func (v *GcpViz) loadLabelsMap(fileName string) error {
 	if err != nil {
 		return err
 	}
+	return v.setLabels(tempLabels)
+}
 
-	Labels = make(map[string]*template.Template, len(tempLabels))
-	HeadLabels = make(map[string]*template.Template, len(tempLabels))
-	TailLabels = make(map[string]*template.Template, len(tempLabels))
-	Links = make(map[string]*template.Template, len(tempLabels))
-	for k, v := range tempLabels {
-		if labelTemplate, ok := v["label"]; ok {
+func (v *GcpViz) setLabels(tempLabels map[string]map[string]string) error {
+	v.Labels = make(map[string]*template.Template, len(tempLabels))
+	v.HeadLabels = make(map[string]*template.Template, len(tempLabels))
+	v.TailLabels = make(map[string]*template.Template, len(tempLabels))
+	v.Links = make(map[string]*template.Template, len(tempLabels))
+	for k, templates := range tempLabels {
+		if labelTemplate, ok := templates["label"]; ok {
 			if labelTemplate != "" {
 				s, err := template.New(k).Funcs(templateFuncMap).Parse(labelTemplate)
 				if err != nil {
 					return errors.Wrap(err, fmt.Sprintf("error parsing label template for resource type %s", k))
 				}
-				Labels[k] = s
+				v.Labels[k] = s
 			} else {
-				Labels[k] = nil
+				v.Labels[k] = nil
 			}
 		}
-		if headLabelTemplate, ok := v["headLabel"]; ok {
+		if headLabelTemplate, ok := templates["headLabel"]; ok {
 			s, err := template.New(k).Funcs(templateFuncMap).Parse(headLabelTemplate)
 			if err != nil {
 				return errors.Wrap(err, fmt.Sprintf("error parsing head label template for resource type %s", k))
 			}
-			HeadLabels[k] = s
+			v.HeadLabels[k] = s
 		}
-		if tailLabelTemplate, ok := v["tailLabel"]; ok {
+		if tailLabelTemplate, ok := templates["tailLabel"]; ok {
 			s, err := template.New(k).Funcs(templateFuncMap).Parse(tailLabelTemplate)
 			if err != nil {
 				return errors.Wrap(err, fmt.Sprintf("error parsing head label template for resource type %s", k))
 			}
-			TailLabels[k] = s
+			v.TailLabels[k] = s
 		}
-		if linkTemplate, ok := v["link"]; ok {
+		if linkTemplate, ok := templates["link"]; ok {
 			s, err := template.New(k).Funcs(templateFuncMap).Parse(linkTemplate)
 			if err != nil {
 				return errors.Wrap(err, fmt.Sprintf("error parsing link template for resource type %s", k))
 			}
-			Links[k] = s
+			v.Links[k] = s
 		}
 	}
 
 	return nil
 }
 
-func (v *GcpViz) loadStyleMap(fileName string, override map[string]string) error {
-	yamlFile, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return err
+func (v *GcpViz) loadStyleMap(fileNames []string, theme string, override map[string]string) error {
+	layers := make([]GraphStyle, len(fileNames))
+	for idx, fileName := range fileNames {
+		yamlFile, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(yamlFile, &layers[idx])
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error parsing style file %s", fileName))
+		}
 	}
-	err = yaml.Unmarshal(yamlFile, &Style)
-	if err != nil {
-		return err
+	return v.setStyle(layers, theme, override)
+}
+
+func (v *GcpViz) setStyle(layers []GraphStyle, theme string, override map[string]string) error {
+	v.Style = GraphStyle{}
+	for _, layer := range layers {
+		v.Style.Merge(layer)
+	}
+
+	if theme != "" {
+		err := v.Style.ApplyTheme(theme)
+		if err != nil {
+			return err
+		}
 	}
 
 	if override != nil && len(override) > 0 {
-		jsn, err := json.Marshal(Style)
+		jsn, err := json.Marshal(v.Style)
 		if err != nil {
 			return errors.Wrap(err, "marshaling to json")
 		}
@@ -828,30 +1224,55 @@ func (v *GcpViz) loadStyleMap(fileName string, override map[string]string) error
 			return err
 		}
 
-		err = yaml.Unmarshal(updatedYaml, &Style)
+		err = yaml.Unmarshal(updatedYaml, &v.Style)
 		if err != nil {
 			return err
 		}
 	}
 
-	Nodes = make(map[string]*template.Template, len(Style.Nodes))
-	for k, v := range Style.Nodes {
-		s, err := template.New(k).Funcs(templateFuncMap).Parse(v)
+	v.Nodes = make(map[string]*template.Template, len(v.Style.Nodes))
+	for k, nodeStyle := range v.Style.Nodes {
+		s, err := template.New(k).Funcs(templateFuncMap).Parse(nodeStyle)
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("error parsing node style for resource type %s", k))
 		}
-		Nodes[k] = s
+		v.Nodes[k] = s
 	}
 
-	Edges = make(map[string]map[string]*template.Template, len(Style.Edges))
-	for k, v := range Style.Edges {
-		Edges[k] = make(map[string]*template.Template, len(v))
-		for kk, vv := range v {
+	v.Conditions = make(map[string][]NodeConditionTemplate, len(v.Style.Conditions))
+	for k, conditions := range v.Style.Conditions {
+		v.Conditions[k] = make([]NodeConditionTemplate, len(conditions))
+		for idx, condition := range conditions {
+			when, err := template.New(k).Funcs(templateFuncMap).Parse(condition.When)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error parsing style condition for resource type %s", k))
+			}
+			style, err := template.New(k).Funcs(templateFuncMap).Parse(condition.Style)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error parsing style condition for resource type %s", k))
+			}
+			v.Conditions[k][idx] = NodeConditionTemplate{When: when, Style: style}
+		}
+	}
+
+	v.RelationEdges = make(map[string]*template.Template, len(v.Style.Relations))
+	for k, edgeStyle := range v.Style.Relations {
+		s, err := template.New(k).Funcs(templateFuncMap).Parse(edgeStyle)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error parsing edge style for relation %s", k))
+		}
+		v.RelationEdges[k] = s
+	}
+
+	v.Edges = make(map[string]map[string]*template.Template, len(v.Style.Edges))
+	for k, edgeStyles := range v.Style.Edges {
+		v.Edges[k] = make(map[string]*template.Template, len(edgeStyles))
+		for kk, vv := range edgeStyles {
 			s, err := template.New(k).Funcs(templateFuncMap).Parse(vv)
 			if err != nil {
 				return errors.Wrap(err, fmt.Sprintf("error parsing edge style for resource type %s", k))
 			}
-			Edges[k][kk] = s
+			v.Edges[k][kk] = s
 		}
 	}
 
@@ -885,6 +1306,15 @@ func (v *GcpViz) initializeBolt() error {
 		return err
 	}
 
+	if !v.SnapshotTime.IsZero() {
+		for _, bucket := range historyBuckets {
+			_, err = tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return err
 	}
@@ -911,6 +1341,16 @@ func (v *GcpViz) jsonPathResultsToString(results interface{}) ([]string, error)
 	return nil, errors.New("unable to process JSON path results")
 }
 
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 /* Programmatic cross asset resolver:
  * Some references cannot be handled with simple references since their targets do not match the
  * name attribute of a resource. This method walks through the builds translations tables.
@@ -919,7 +1359,16 @@ func (v *GcpViz) jsonPathResultsToString(results interface{}) ([]string, error)
  * IDs are in in projects/proj-id/serviceAccounts/service-account-id format.
  */
 
-func (v *GcpViz) EnrichAssets() error {
+func (v *GcpViz) EnrichAssets(ctx context.Context) error {
+	err := v.linkKubernetesObjects(ctx)
+	if err != nil {
+		return err
+	}
+	err = v.linkOnPremSites(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Iterate BoltDB
 	tx, err := v.AssetDatabase.Begin(false)
 	if err != nil {
@@ -933,8 +1382,12 @@ func (v *GcpViz) EnrichAssets() error {
 		aliasAssetTypes = append(aliasAssetTypes, ak)
 	}
 
-	fmt.Fprintf(os.Stderr, "\nCreating reference aliases for assets...\n")
-	err = tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+	v.progress(ProgressEvent{Phase: PhaseAliases, Message: "Creating reference aliases for assets..."})
+	assetAliases := make(map[string]string, 0)
+	err = forEachAssetIn(tx, v.update.changedAssets(), func(bk, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		isAliasAsset := false
 		for _, aliasAssetType := range aliasAssetTypes {
 			// Simple optimization to avoid unmarshaling tons of JSON
@@ -956,28 +1409,19 @@ func (v *GcpViz) EnrichAssets() error {
 		assetType := asset.GetAssetType()
 		_resource := resource.(map[string]interface{})
 		if aliases, ok := v.Relations.Aliases[assetType]; ok {
-			for _, jsonPath := range aliases {
+			for idx, jsonPath := range aliases {
 				if res, ok := _resource["resource"]; ok {
 					_data := res.(map[string]interface{})
 					if _, ok := _data["data"]; ok {
 						targets, err := jsonPath(_data)
+						v.report().addJsonPathResult("aliases", assetType, v.rawRelations.Aliases[assetType][idx], err)
 						if err != nil {
 							continue
 						}
 
-						wrtx, err := v.AssetDatabase.Begin(true)
-						if err != nil {
-							return err
-						}
-						defer wrtx.Rollback()
-
 						_targets, err := v.jsonPathResultsToString(targets)
 						for _, vertex := range _targets {
-							err = wrtx.Bucket([]byte("Aliases")).Put([]byte(vertex), []byte(name))
-							v.TotalAliases++
-						}
-						if err = wrtx.Commit(); err != nil {
-							return err
+							assetAliases[vertex] = name
 						}
 					}
 				}
@@ -990,12 +1434,39 @@ func (v *GcpViz) EnrichAssets() error {
 		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "Creating references between assets...\n")
+	tx.Rollback()
+
+	// Aliases are written once all assets are read, as a write transaction cannot be
+	// committed while a read transaction is open
+	wrtx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer wrtx.Rollback()
+	for _, vertex := range sortedKeys(assetAliases) {
+		if err = wrtx.Bucket([]byte("Aliases")).Put([]byte(vertex), []byte(assetAliases[vertex])); err != nil {
+			return err
+		}
+		v.TotalAliases++
+		v.affectAliasUsers(vertex)
+	}
+	if err = wrtx.Commit(); err != nil {
+		return err
+	}
+
+	err = v.linkLabels(ctx)
+	if err != nil {
+		return err
+	}
+
+	v.progress(ProgressEvent{Phase: PhaseReferences, Message: "Creating references between assets..."})
 	tx, err = v.AssetDatabase.Begin(false)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
+	totalAssets := int64(tx.Bucket([]byte("Assets")).Stats().KeyN)
+	referenceProgress := v.newProgressCounter(PhaseReferences, "Creating references", "assets", totalAssets, totalAssets/20)
 
 	relationsAssetTypes := make([]string, 0, len(v.Relations.AssetTypes))
 	for rk, _ := range v.Relations.AssetTypes {
@@ -1011,13 +1482,20 @@ func (v *GcpViz) EnrichAssets() error {
 
 	/* Step 2: standard reference generation, configured via relations file */
 	err = tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		referenceProgress.Add(1)
 		isRelationsAsset := false
 		isIpAsset := false
-		for _, relationsAssetType := range relationsAssetTypes {
-			// Simple optimization to avoid unmarshaling tons of JSON
-			if strings.Contains(string(bv), relationsAssetType) {
-				isRelationsAsset = true
-				break
+		// When applying changes, only the references of affected assets are created again
+		if v.update.isAffected(string(bk)) {
+			for _, relationsAssetType := range relationsAssetTypes {
+				// Simple optimization to avoid unmarshaling tons of JSON
+				if strings.Contains(string(bv), relationsAssetType) {
+					isRelationsAsset = true
+					break
+				}
 			}
 		}
 		for _, ipAssetType := range ipAssetTypes {
@@ -1043,11 +1521,12 @@ func (v *GcpViz) EnrichAssets() error {
 		if isIpAsset {
 			_resource := resource.(map[string]interface{})
 			if relations, ok := v.Relations.IpAddresses[assetType]; ok {
-				for _, jsonPath := range relations {
+				for idx, jsonPath := range relations {
 					if res, ok := _resource["resource"]; ok {
 						_data := res.(map[string]interface{})
 						if _, ok := _data["data"]; ok {
 							targets, err := jsonPath(_data)
+							v.report().addJsonPathResult("ip_addresses", assetType, v.rawRelations.IpAddresses[assetType][idx], err)
 							if err != nil {
 								continue
 							}
@@ -1061,7 +1540,7 @@ func (v *GcpViz) EnrichAssets() error {
 								}
 								_, parsedIp, err := net.ParseCIDR(ipRange)
 								if err != nil {
-									fmt.Fprintf(os.Stderr, "Warning: Failed to parse IP %v for resource %v.\n", ipRange, name)
+									v.warn(PhaseIps, "failed to parse IP %v for resource %v.", ipRange, name)
 								}
 								ip := IpAddressLink{Ip: parsedIp, Resource: name, AssetType: assetType}
 								ipAddresses = append(ipAddresses, ip)
@@ -1076,11 +1555,12 @@ func (v *GcpViz) EnrichAssets() error {
 		if isRelationsAsset {
 			_resource := resource.(map[string]interface{})
 			if relations, ok := v.Relations.AssetTypes[assetType]; ok {
-				for _, jsonPath := range relations {
+				for idx, jsonPath := range relations {
 					if res, ok := _resource["resource"]; ok {
 						_data := res.(map[string]interface{})
 						if _, ok := _data["data"]; ok {
 							targets, err := jsonPath(_data)
+							v.report().addJsonPathResult("asset_types", assetType, v.rawRelations.AssetTypes[assetType][idx].Path, err)
 							if err != nil {
 								continue
 							}
@@ -1092,15 +1572,9 @@ func (v *GcpViz) EnrichAssets() error {
 								if !strings.HasPrefix(vertex, "//") && strings.Contains(vertex, ".googleapis.com/") {
 									vertex = fmt.Sprintf("//%s", vertex)
 								}
-								rotx, err := v.AssetDatabase.Begin(false)
-								if err != nil {
-									return err
-								}
-								defer rotx.Rollback()
-
-								target := rotx.Bucket([]byte("Assets")).Get([]byte(vertex))
+								target := tx.Bucket([]byte("Assets")).Get([]byte(vertex))
 								if target == nil {
-									alias := rotx.Bucket([]byte("Aliases")).Get([]byte(vertex))
+									alias := tx.Bucket([]byte("Aliases")).Get([]byte(vertex))
 									if alias != nil {
 										vertex = string(alias)
 									} else {
@@ -1111,7 +1585,19 @@ func (v *GcpViz) EnrichAssets() error {
 									}
 								}
 
+								if target == nil {
+									target = tx.Bucket([]byte("Assets")).Get([]byte(vertex))
+								}
+								if target == nil {
+									v.report().addDanglingReference(assetType, name, vertex)
+								} else if organizationOf(target) != organizationOf(bv) {
+									v.TotalCrossOrg++
+								}
+
 								v.QW.AddQuad(cayley.Quad(name, "uses", vertex, assetType))
+								if predicate := v.Relations.Predicates[assetType][idx]; predicate != "uses" {
+									v.QW.AddQuad(cayley.Quad(name, predicate, vertex, assetType))
+								}
 								v.TotalEdges++
 							}
 						}
@@ -1122,12 +1608,19 @@ func (v *GcpViz) EnrichAssets() error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	referenceProgress.Done()
 
 	/* Step 3: Link via IP addresses */
-	fmt.Fprintf(os.Stderr, "Processing resource IP addresses...\n")
+	v.progress(ProgressEvent{Phase: PhaseIps, Message: "Processing resource IP addresses..."})
 	for ik, ip := range ipAddresses {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		for sik, sip := range ipAddresses {
-			if ik != sik {
+			if ik != sik && v.update.linksIps(ip.Resource, sip.Resource) {
 				if ip.AssetType != sip.AssetType && sip.Ip.Contains(ip.Ip.IP) {
 					v.QW.AddQuad(cayley.Quad(ip.Resource, "uses", sip.Resource, ip.AssetType))
 					v.TotalEdges++
@@ -1142,8 +1635,12 @@ func (v *GcpViz) EnrichAssets() error {
 	}
 	enrichedAssets := make(map[string]map[string][]interface{}, 0)
 
-	fmt.Fprintf(os.Stderr, "Integrating subassets as part of main assets...\n")
-	err = tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+	v.progress(ProgressEvent{Phase: PhaseEnrich, Message: "Integrating subassets as part of main assets..."})
+	v.addEnrichedAssets()
+	err = forEachAssetIn(tx, v.update.enrichedAssets(), func(bk, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		isEnrichAsset := false
 		for _, enrichAssetType := range enrichAssetTypes {
 			// Simple optimization to avoid unmarshaling tons of JSON
@@ -1155,7 +1652,7 @@ func (v *GcpViz) EnrichAssets() error {
 		if !isEnrichAsset {
 			return nil
 		}
-		asset, _, err := v.parseJsonAsset(bv)
+		asset, resource, err := v.parseJsonAsset(bv)
 		if err != nil {
 			return err
 		}
@@ -1166,6 +1663,13 @@ func (v *GcpViz) EnrichAssets() error {
 		if !qerr {
 			return err
 		}
+		// Fields incorporated before are removed if no sub-asset uses the asset anymore
+		data := mapField(resource, "resource", "data")
+		for field := range v.Relations.Enrich[assetType] {
+			if _, found := data[field]; found {
+				enrichedAssets[name] = make(map[string][]interface{}, 0)
+			}
+		}
 
 		var subAssets []interface{}
 		subAssets = append(subAssets, nil)
@@ -1179,17 +1683,18 @@ func (v *GcpViz) EnrichAssets() error {
 		p := cayley.StartPath(v.QS, qval).LabelContext(subAssets...).In("uses")
 		p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
 			target := cquad.NativeOf(val).(string)
-			targetAsset, err := v.getAsset(target)
+			targetAsset, err := v.getAssetTx(tx, target)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: could not fetch sub-asset %v\n", target)
+				v.warn(PhaseEnrich, "could not fetch sub-asset %v", target)
 			} else {
 				_data := targetAsset.Resource.Data.(map[string]interface{})
 				for field, subAssetTypes := range v.Relations.Enrich[assetType] {
 					for subAssetType, jsonPath := range subAssetTypes {
 						if subAssetType == targetAsset.AssetType {
 							targets, err := jsonPath(_data)
+							v.report().addJsonPathResult("enrich", assetType, v.rawRelations.Enrich[assetType][field][subAssetType], err)
 							if err != nil {
-								fmt.Fprintf(os.Stderr, "Warning: JSON-Path error in enrichment: %v\n", err)
+								v.warn(PhaseEnrich, "JSON-Path error in enrichment: %v", err)
 								continue
 							}
 							if _, ok := newFields[field]; !ok {
@@ -1205,6 +1710,11 @@ func (v *GcpViz) EnrichAssets() error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	tx.Rollback()
 
 	tx, err = v.AssetDatabase.Begin(true)
 	if err != nil {
@@ -1213,8 +1723,11 @@ func (v *GcpViz) EnrichAssets() error {
 	defer tx.Rollback()
 
 	for name, newFields := range enrichedAssets {
-		asset, err := v.getAsset(name)
+		asset, err := v.getAssetTx(tx, name)
 		if err == nil {
+			for field := range v.Relations.Enrich[asset.AssetType] {
+				delete(asset.Resource.Data.(map[string]interface{}), field)
+			}
 			for k, v := range newFields {
 				asset.Resource.Data.(map[string]interface{})[k] = v
 			}
@@ -1230,7 +1743,20 @@ func (v *GcpViz) EnrichAssets() error {
 		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "\nTotal vertexes: %d, total edges: %d, total aliases: %d, total IPs: %d\n", v.TotalVertexes, v.TotalEdges, v.TotalAliases, v.TotalIps)
+	/* Step 5: IP address usage of subnetworks */
+	err = v.analyzeIpUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	/* Step 6: Compute fields from linked assets */
+	err = v.computeFields(ctx)
+	if err != nil {
+		return err
+	}
+
+	v.printReportSummary()
+	v.progress(ProgressEvent{Phase: PhaseEnrich, Message: fmt.Sprintf("Total vertexes: %d, total edges: %d, total aliases: %d, total IPs: %d, cross-organization references: %d", v.TotalVertexes, v.TotalEdges, v.TotalAliases, v.TotalIps, v.TotalCrossOrg), Done: true})
 	return nil
 }
 
@@ -1239,6 +1765,14 @@ func (v *GcpViz) AddAsset(tx *bolt.Tx, asset validator.Asset, resource interface
 	parent := asset.GetResource().GetParent()
 	assetType := asset.GetAssetType()
 
+	existing := tx.Bucket([]byte("Assets")).Get([]byte(name))
+	if existing != nil {
+		replace, err := v.mergeAsset(existing, name, parent, resource)
+		if err != nil || !replace {
+			return err
+		}
+	}
+
 	jsn, err := json.Marshal(resource)
 	if err != nil {
 		return errors.Wrap(err, "marshaling to json")
@@ -1247,6 +1781,11 @@ func (v *GcpViz) AddAsset(tx *bolt.Tx, asset validator.Asset, resource interface
 	if err != nil {
 		return err
 	}
+	if existing != nil {
+		// Adding an existing quad is a no-op
+		v.QW.AddQuad(cayley.Quad(parent, "child", name, assetType))
+		return nil
+	}
 	if assetType == "cloudresourcemanager.googleapis.com/Organization" {
 		v.OrgRoots = append(v.OrgRoots, name)
 	}
@@ -1270,11 +1809,14 @@ func (v *GcpViz) UpdateAsset(tx *bolt.Tx, name string, resource interface{}) err
 	return nil
 }
 
-func (v *GcpViz) ReadAssetsFromFile(input string) error {
+// ReadAssetsFromFile reads a Cloud Asset Inventory export. If source is set, it is
+// stored in each asset to tell apart assets from different exports.
+func (v *GcpViz) ReadAssetsFromFile(ctx context.Context, input string, source string) error {
 	file, err := os.Open(input)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	finfo, err := file.Stat()
 	if err != nil {
@@ -1282,18 +1824,21 @@ func (v *GcpViz) ReadAssetsFromFile(input string) error {
 	}
 	fileSize := finfo.Size()
 
-	var reader = bufio.NewReader(file)
-	const bufferSize = 5 * 1024 * 1024 // Length of one line is maximum 5 MB
-
-	scanner := bufio.NewScanner(reader)
-	buf := make([]byte, bufferSize)
-	scanner.Buffer(buf, bufferSize)
+	readProgress := v.newProgressCounter(PhaseRead, fmt.Sprintf("Reading assets from %s", input), "bytes", fileSize, fileSize/20)
+	iter := newReaderAssetIterator(file)
+	err = v.addAssets(ctx, iter, input, source, func() {
+		readProgress.Set(iter.position)
+	})
+	if err != nil {
+		return err
+	}
+	readProgress.Done()
+	return nil
+}
 
-	var (
-		lastPos        int64 = 0
-		printThreshold int64 = fileSize / 20
-		writes         int64 = 0
-	)
+func (v *GcpViz) addAssets(ctx context.Context, iter AssetIterator, input string, source string, progress func()) error {
+	var index int64 = 0
+	var writes int64 = 0
 	// Insert resource to BoltDB
 	tx, err := v.AssetDatabase.Begin(true)
 	if err != nil {
@@ -1301,7 +1846,10 @@ func (v *GcpViz) ReadAssetsFromFile(input string) error {
 	}
 	defer tx.Rollback()
 
-	for scanner.Scan() {
+	for iter.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 		if writes > 1000 {
 			// Commit, start new transaction
 			if err = tx.Commit(); err != nil {
@@ -1314,18 +1862,25 @@ func (v *GcpViz) ReadAssetsFromFile(input string) error {
 			defer tx.Rollback()
 			writes = 0
 		}
-		currentPos, err := file.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return err
-		}
-		if (currentPos - lastPos) >= printThreshold {
-			fmt.Fprintf(os.Stderr, "Reading assets: %d/%d bytes processed.\r", currentPos, fileSize)
-			lastPos = currentPos
+		if progress != nil {
+			progress()
 		}
 
-		pbAsset, resource, err := v.parseJsonAsset(scanner.Bytes())
+		index++
+		pbAsset, resource, err := v.parseJsonAsset(iter.Asset())
 		if err != nil {
-			return err
+			line := index
+			if reader, ok := iter.(*readerAssetIterator); ok {
+				line = reader.line
+			}
+			if v.Lenient {
+				v.report().addParseFailure(input, source, line, err)
+				continue
+			}
+			return errors.Wrap(err, fmt.Sprintf("parsing asset on line %d", line))
+		}
+		if source != "" {
+			resource.(map[string]interface{})["source"] = source
 		}
 
 		err = v.AddAsset(tx, *pbAsset, resource)
@@ -1334,6 +1889,9 @@ func (v *GcpViz) ReadAssetsFromFile(input string) error {
 		}
 		writes++
 	}
+	if err = iter.Err(); err != nil {
+		return err
+	}
 	if err = tx.Commit(); err != nil {
 		return err
 	}
@@ -0,0 +1,139 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cayleygraph/cayley"
+	"github.com/pkg/errors"
+)
+
+// InventoryFile is a Cloud Asset Inventory export, tagged with the source that is
+// stored in each of its assets.
+type InventoryFile struct {
+	Source string
+	File   string
+}
+
+// ParseInventoryFiles parses a comma separated list of inventory files, optionally
+// tagged as source=file. Untagged files use the file name without extension as tag.
+func ParseInventoryFiles(files string) []InventoryFile {
+	var inventoryFiles []InventoryFile
+	for _, file := range strings.Split(files, ",") {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		var source string
+		if parts := strings.SplitN(file, "=", 2); len(parts) == 2 {
+			source, file = parts[0], parts[1]
+		} else {
+			source = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		inventoryFiles = append(inventoryFiles, InventoryFile{Source: source, File: file})
+	}
+	return inventoryFiles
+}
+
+// ReadAssetsFromFiles reads and merges multiple inventory exports. Assets that occur
+// in several exports are only kept once, the one with the newest update time wins
+// (or the one from the later export, if they were updated at the same time).
+func (v *GcpViz) ReadAssetsFromFiles(ctx context.Context, inputs []InventoryFile) error {
+	for _, input := range inputs {
+		err := v.ReadAssetsFromFile(ctx, input.File, input.Source)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("reading %s", input.File))
+		}
+	}
+	if v.TotalDuplicates > 0 {
+		v.progress(ProgressEvent{Phase: PhaseRead, Message: fmt.Sprintf("Merged %d assets that were exported more than once.", v.TotalDuplicates), Done: true})
+	}
+	return v.ResolveRoots()
+}
+
+func parseUpdateTime(updateTime string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, updateTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// updateTimeOf returns the update time of an asset in the format of exports.
+func updateTimeOf(resource interface{}) time.Time {
+	var updateTime string
+	if r, ok := resource.(map[string]interface{}); ok {
+		updateTime, _ = r["update_time"].(string)
+	}
+	return parseUpdateTime(updateTime)
+}
+
+// mergeAsset decides whether an asset that already exists in the database should be
+// replaced, which it is unless it is older. The old parent edge is removed if the
+// asset has moved. Assets replaced by changes in watch mode are not duplicates.
+func (v *GcpViz) mergeAsset(existing []byte, name string, parent string, resource interface{}) (bool, error) {
+	var current TemplateResource
+	err := json.Unmarshal(existing, &current)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", name))
+	}
+
+	if v.update == nil {
+		v.TotalDuplicates++
+	}
+	if updateTimeOf(resource).Before(parseUpdateTime(current.UpdateTime)) {
+		return false, nil
+	}
+	if current.Resource.Parent != parent {
+		v.QW.RemoveQuad(cayley.Quad(current.Resource.Parent, "child", name, current.AssetType))
+		v.TotalEdges--
+	}
+	return true, nil
+}
+
+// ResolveRoots adds projects and folders whose parents are not part of any of the
+// exports (such as standalone projects) as additional roots of the graph.
+func (v *GcpViz) ResolveRoots() error {
+	return v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		assets := tx.Bucket([]byte("Assets"))
+		roots := make(map[string]bool, len(v.OrgRoots))
+		for _, root := range v.OrgRoots {
+			roots[root] = true
+		}
+		return assets.ForEach(func(k, bv []byte) error {
+			if !strings.Contains(string(bv), "cloudresourcemanager.googleapis.com/") {
+				return nil
+			}
+			var resource TemplateResource
+			err := json.Unmarshal(bv, &resource)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", string(k)))
+			}
+			if resource.AssetType != "cloudresourcemanager.googleapis.com/Project" && resource.AssetType != "cloudresourcemanager.googleapis.com/Folder" {
+				return nil
+			}
+			if resource.Resource.Parent != "" && assets.Get([]byte(resource.Resource.Parent)) != nil {
+				return nil
+			}
+			if !roots[resource.Name] {
+				roots[resource.Name] = true
+				v.OrgRoots = append(v.OrgRoots, resource.Name)
+			}
+			return nil
+		})
+	})
+}
+
+// organizationOf returns the topmost ancestor of an asset.
+func organizationOf(asset []byte) string {
+	var resource TemplateResource
+	if err := json.Unmarshal(asset, &resource); err != nil || len(resource.Ancestors) == 0 {
+		return ""
+	}
+	return resource.Ancestors[len(resource.Ancestors)-1]
+}
@@ -0,0 +1,278 @@
+package gcpviz
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// External metrics for assets, keyed by asset name, project ID or project number.
+type NodeMetrics map[string]interface{}
+
+var heatColors = []string{"#859900", "#b58900", "#dc322f"}
+
+func (m NodeMetrics) add(metric string, value interface{}) {
+	if f, ok := value.(float64); ok {
+		if existing, ok := m[metric].(float64); ok {
+			m[metric] = existing + f
+			return
+		}
+	}
+	m[metric] = value
+}
+
+func parseMetricValue(value string) interface{} {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return value
+	}
+	return f
+}
+
+// LoadMetrics reads a CSV (with a header row) or JSON metrics file. In CSV files the
+// key is the first column unless keyColumn is set. JSON files can either be an object
+// keyed by asset name or an array of records, where the key is read from keyColumn
+// (defaulting to "name"). Numeric values for duplicate keys are summed up.
+func (v *GcpViz) LoadMetrics(fileName string, keyColumn string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	v.Metrics = make(map[string]NodeMetrics, 0)
+	if strings.ToLower(filepath.Ext(fileName)) == ".json" {
+		err = v.readJsonMetrics(file, keyColumn)
+	} else {
+		err = v.readCsvMetrics(file, keyColumn)
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("reading metrics file %s", fileName))
+	}
+
+	v.MetricRanges = make(map[string][2]float64, 0)
+	for _, metrics := range v.Metrics {
+		for metric, value := range metrics {
+			f, ok := value.(float64)
+			if !ok {
+				continue
+			}
+			if r, found := v.MetricRanges[metric]; found {
+				v.MetricRanges[metric] = [2]float64{math.Min(r[0], f), math.Max(r[1], f)}
+			} else {
+				v.MetricRanges[metric] = [2]float64{f, f}
+			}
+		}
+	}
+	return nil
+}
+
+func (v *GcpViz) readCsvMetrics(file io.Reader, keyColumn string) error {
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	keyIdx := 0
+	if keyColumn != "" {
+		keyIdx = -1
+		for idx, column := range header {
+			if column == keyColumn {
+				keyIdx = idx
+			}
+		}
+		if keyIdx == -1 {
+			return fmt.Errorf("key column %s not found in header", keyColumn)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key := record[keyIdx]
+		if _, found := v.Metrics[key]; !found {
+			v.Metrics[key] = make(NodeMetrics, len(record)-1)
+		}
+		for idx, value := range record {
+			if idx != keyIdx {
+				v.Metrics[key].add(header[idx], parseMetricValue(value))
+			}
+		}
+	}
+	return nil
+}
+
+func (v *GcpViz) readJsonMetrics(file io.Reader, keyColumn string) error {
+	if keyColumn == "" {
+		keyColumn = "name"
+	}
+
+	var raw interface{}
+	err := json.NewDecoder(file).Decode(&raw)
+	if err != nil {
+		return err
+	}
+
+	switch raw.(type) {
+	case map[string]interface{}:
+		for key, metrics := range raw.(map[string]interface{}) {
+			values, ok := metrics.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("metrics for %s are not an object", key)
+			}
+			v.Metrics[key] = make(NodeMetrics, len(values))
+			for metric, value := range values {
+				v.Metrics[key].add(metric, value)
+			}
+		}
+	case []interface{}:
+		for idx, record := range raw.([]interface{}) {
+			values, ok := record.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("record %d is not an object", idx)
+			}
+			key, ok := values[keyColumn].(string)
+			if !ok {
+				return fmt.Errorf("record %d is missing key field %s", idx, keyColumn)
+			}
+			if _, found := v.Metrics[key]; !found {
+				v.Metrics[key] = make(NodeMetrics, len(values)-1)
+			}
+			for metric, value := range values {
+				if metric != keyColumn {
+					v.Metrics[key].add(metric, value)
+				}
+			}
+		}
+	default:
+		return errors.New("metrics must be an object or an array of objects")
+	}
+	return nil
+}
+
+// metricsFor finds the metrics of an asset by its name, or for projects also by
+// project ID and number.
+func (v *GcpViz) metricsFor(resource *TemplateResource) NodeMetrics {
+	if v.Metrics == nil {
+		return nil
+	}
+	if metrics, found := v.Metrics[resource.Name]; found {
+		return metrics
+	}
+	if resource.AssetType == "cloudresourcemanager.googleapis.com/Project" {
+		if data, ok := resource.Resource.Data.(map[string]interface{}); ok {
+			for _, field := range []string{"projectId", "projectNumber"} {
+				if id, ok := data[field].(string); ok {
+					if metrics, found := v.Metrics[id]; found {
+						return metrics
+					}
+					if metrics, found := v.Metrics[fmt.Sprintf("projects/%s", id)]; found {
+						return metrics
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch value.(type) {
+	case float64:
+		return value.(float64), true
+	case int:
+		return float64(value.(int)), true
+	case int64:
+		return float64(value.(int64)), true
+	case json.Number:
+		f, err := value.(json.Number).Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(value.(string), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (v *GcpViz) MetricMin(metric string) float64 {
+	return v.MetricRanges[metric][0]
+}
+
+func (v *GcpViz) MetricMax(metric string) float64 {
+	return v.MetricRanges[metric][1]
+}
+
+// ScaleValue maps a value linearly from [min, max] to [outMin, outMax].
+func ScaleValue(value interface{}, min float64, max float64, outMin float64, outMax float64) float64 {
+	f, ok := toFloat(value)
+	if !ok || max <= min {
+		return outMin
+	}
+	f = math.Max(min, math.Min(max, f))
+	return outMin + (f-min)/(max-min)*(outMax-outMin)
+}
+
+func parseHexColor(color string) ([3]int64, error) {
+	var rgb [3]int64
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) != 6 {
+		return rgb, fmt.Errorf("invalid color %s", color)
+	}
+	for i := 0; i < 3; i++ {
+		c, err := strconv.ParseInt(hex[i*2:i*2+2], 16, 32)
+		if err != nil {
+			return rgb, err
+		}
+		rgb[i] = c
+	}
+	return rgb, nil
+}
+
+// ColorScale interpolates a value in [min, max] between two or more hex colors.
+func ColorScale(value interface{}, min float64, max float64, colors ...string) string {
+	if len(colors) == 0 {
+		return ""
+	}
+	position := ScaleValue(value, min, max, 0, float64(len(colors)-1))
+	idx := int(math.Floor(position))
+	if idx >= len(colors)-1 {
+		return colors[len(colors)-1]
+	}
+
+	from, err := parseHexColor(colors[idx])
+	if err != nil {
+		return colors[idx]
+	}
+	to, err := parseHexColor(colors[idx+1])
+	if err != nil {
+		return colors[idx]
+	}
+	fraction := position - float64(idx)
+	result := "#"
+	for i := 0; i < 3; i++ {
+		result += fmt.Sprintf("%02x", int64(math.Round(float64(from[i])+fraction*float64(to[i]-from[i]))))
+	}
+	return result
+}
+
+// HeatColor colors a value of a metric from green to red, relative to the range of
+// the metric over all assets. Returns an empty string for missing values.
+func (v *GcpViz) HeatColor(metric string, value interface{}) string {
+	if _, ok := toFloat(value); !ok {
+		return ""
+	}
+	return ColorScale(value, v.MetricMin(metric), v.MetricMax(metric), heatColors...)
+}
@@ -0,0 +1,406 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// On-premises sites are not part of any inventory, so they are described in a YAML
+// file and added as synthetic assets. Before the references are created, each site
+// is linked to the VPN tunnels that connect to its peer IPs, the Cloud Routers that
+// have BGP sessions with its ASNs and the interconnect attachments behind those
+// sessions. The links are stored in the "onprem" field of the resource, so that they
+// can be referred to in relations.yaml.
+
+const (
+	onPremSiteAssetType = "onprem.gcpviz/Site"
+	onPremSitePrefix    = "//onprem.gcpviz/sites/"
+)
+
+// OnPremSites is the file format for on-premises sites.
+type OnPremSites struct {
+	Sites []OnPremSite `yaml:"sites"`
+}
+
+// OnPremSite is an on-premises location connected to Google Cloud via Cloud VPN or
+// Cloud Interconnect.
+type OnPremSite struct {
+	Name                    string   `yaml:"name" json:"name"`
+	Description             string   `yaml:"description" json:"description,omitempty"`
+	Parent                  string   `yaml:"parent" json:"-"`
+	Cidrs                   []string `yaml:"cidrs" json:"cidrs"`
+	PeerIps                 []string `yaml:"peer_ips" json:"peerIps"`
+	Asns                    []int64  `yaml:"asns" json:"asns"`
+	InterconnectAttachments []string `yaml:"interconnect_attachments" json:"interconnectAttachments"`
+}
+
+// RouteOverlap is an on-premises range that overlaps with a range in Google Cloud or
+// at another site.
+type RouteOverlap struct {
+	Site     string `json:"site"`
+	Cidr     string `json:"cidr"`
+	Resource string `json:"resource"`
+	Range    string `json:"range"`
+}
+
+// ReadOnPremSites reads on-premises sites from a YAML file. Sites without a parent
+// are added under the first organization, so the resource inventory should be read
+// first.
+func (v *GcpViz) ReadOnPremSites(ctx context.Context, fileName string) error {
+	v.progress(ProgressEvent{Phase: PhaseOnPrem, Message: fmt.Sprintf("Reading on-premises sites from %s...", fileName)})
+	file, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var sites OnPremSites
+	if err = yaml.Unmarshal(file, &sites); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("parsing on-premises sites in %s", fileName))
+	}
+
+	tx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, site := range sites.Sites {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if site.Name == "" {
+			return fmt.Errorf("on-premises site without a name in %s", fileName)
+		}
+		for _, cidr := range append(site.Cidrs, site.PeerIps...) {
+			if _, err := parseIpRange(cidr); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("on-premises site %s", site.Name))
+			}
+		}
+
+		parent := site.Parent
+		if parent == "" {
+			if len(v.OrgRoots) == 0 {
+				return fmt.Errorf("on-premises site %s has no parent and no organization was found in assets", site.Name)
+			}
+			parent = v.OrgRoots[0]
+		}
+		if !strings.HasPrefix(parent, "//") {
+			parent = "//cloudresourcemanager.googleapis.com/" + parent
+		}
+		ancestors := []string{strings.TrimPrefix(parent, "//cloudresourcemanager.googleapis.com/")}
+		if existing := tx.Bucket([]byte("Assets")).Get([]byte(parent)); existing != nil {
+			var resource TemplateResource
+			if err = json.Unmarshal(existing, &resource); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", parent))
+			}
+			ancestors = resource.Ancestors
+		} else {
+			v.warn(PhaseOnPrem, "parent %s of on-premises site %s not found in assets.", parent, site.Name)
+		}
+
+		// Round-trip via JSON to get the same representation as other assets
+		var data map[string]interface{}
+		jsn, err := json.Marshal(site)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(jsn, &data); err != nil {
+			return err
+		}
+		err = v.addAssetFromMap(tx, map[string]interface{}{
+			"name":       onPremSitePrefix + site.Name,
+			"asset_type": onPremSiteAssetType,
+			"resource": map[string]interface{}{
+				"version":        "v1",
+				"discovery_name": "Site",
+				"parent":         parent,
+				"data":           data,
+			},
+			"ancestors": ancestors,
+			"source":    "onprem",
+		})
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("adding on-premises site %s", site.Name))
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseOnPrem, Message: fmt.Sprintf("On-premises sites: %d added.", len(sites.Sites)), Done: true})
+	return nil
+}
+
+// parseIpRange parses an IP range in CIDR notation or a single IP address.
+func parseIpRange(ipRange string) (*net.IPNet, error) {
+	if !strings.Contains(ipRange, "/") {
+		if strings.Contains(ipRange, ":") {
+			ipRange = ipRange + "/128"
+		} else {
+			ipRange = ipRange + "/32"
+		}
+	}
+	_, parsed, err := net.ParseCIDR(ipRange)
+	return parsed, err
+}
+
+func ipRangesOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+type onPremSite struct {
+	name    string
+	asset   map[string]interface{}
+	cidrs   []*net.IPNet
+	peerIps []*net.IPNet
+	asns    map[string]bool
+	links   map[string][]string
+}
+
+func (s *onPremSite) add(field string, target string) {
+	for _, existing := range s.links[field] {
+		if existing == target {
+			return
+		}
+	}
+	s.links[field] = append(s.links[field], target)
+}
+
+func (s *onPremSite) isPeerIp(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, peerIp := range s.peerIps {
+		if peerIp.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// asnString formats an ASN, which is a number in JSON.
+func asnString(asn interface{}) string {
+	switch value := asn.(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case string:
+		return value
+	}
+	return ""
+}
+
+// linkOnPremSites links on-premises sites to the hybrid connectivity resources that
+// connect to them and checks their ranges for overlaps with subnetworks and other
+// sites.
+func (v *GcpViz) linkOnPremSites(ctx context.Context) error {
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sites := make([]*onPremSite, 0)
+	hybridAssets := make(map[string]map[string]interface{}, 0)
+	hybridAssetTypes := []string{
+		onPremSiteAssetType,
+		"compute.googleapis.com/VpnTunnel",
+		"compute.googleapis.com/Router",
+		"compute.googleapis.com/InterconnectAttachment",
+		"compute.googleapis.com/Subnetwork",
+	}
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		isHybridAsset := false
+		for _, hybridAssetType := range hybridAssetTypes {
+			// Simple optimization to avoid unmarshaling tons of JSON
+			if strings.Contains(string(bv), hybridAssetType) {
+				isHybridAsset = true
+				break
+			}
+		}
+		if !isHybridAsset {
+			return nil
+		}
+		var asset map[string]interface{}
+		if err := json.Unmarshal(bv, &asset); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", string(k)))
+		}
+		switch stringField(asset, "asset_type") {
+		case onPremSiteAssetType:
+		case "compute.googleapis.com/VpnTunnel", "compute.googleapis.com/Router", "compute.googleapis.com/InterconnectAttachment", "compute.googleapis.com/Subnetwork":
+			hybridAssets[string(k)] = asset
+			return nil
+		default:
+			return nil
+		}
+
+		data := mapField(asset, "resource", "data")
+		site := &onPremSite{name: string(k), asset: asset, asns: make(map[string]bool, 0), links: make(map[string][]string, 0)}
+		if cidrs, ok := data["cidrs"].([]interface{}); ok {
+			for _, cidr := range cidrs {
+				if parsed, err := parseIpRange(fmt.Sprint(cidr)); err == nil {
+					site.cidrs = append(site.cidrs, parsed)
+				}
+			}
+		}
+		if peerIps, ok := data["peerIps"].([]interface{}); ok {
+			for _, peerIp := range peerIps {
+				if parsed, err := parseIpRange(fmt.Sprint(peerIp)); err == nil {
+					site.peerIps = append(site.peerIps, parsed)
+				}
+			}
+		}
+		if asns, ok := data["asns"].([]interface{}); ok {
+			for _, asn := range asns {
+				site.asns[asnString(asn)] = true
+			}
+		}
+		sites = append(sites, site)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(sites) == 0 {
+		return nil
+	}
+	tx.Rollback()
+
+	v.progress(ProgressEvent{Phase: PhaseOnPrem, Message: "Linking on-premises sites..."})
+	names := make([]string, 0, len(hybridAssets))
+	for name := range hybridAssets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		asset := hybridAssets[name]
+		data := mapField(asset, "resource", "data")
+		switch stringField(asset, "asset_type") {
+		case "compute.googleapis.com/VpnTunnel":
+			for _, site := range sites {
+				if site.isPeerIp(stringField(data, "peerIp")) {
+					site.add("vpnTunnels", name)
+				}
+			}
+
+		case "compute.googleapis.com/Router":
+			interfaces := make(map[string]interface{}, 0)
+			if routerInterfaces, ok := data["interfaces"].([]interface{}); ok {
+				for _, routerInterface := range routerInterfaces {
+					interfaces[stringField(routerInterface, "name")] = routerInterface
+				}
+			}
+			bgpPeers, _ := data["bgpPeers"].([]interface{})
+			for _, bgpPeer := range bgpPeers {
+				peer, _ := bgpPeer.(map[string]interface{})
+				for _, site := range sites {
+					if !site.asns[asnString(peer["peerAsn"])] && !site.isPeerIp(stringField(peer, "peerIpAddress")) {
+						continue
+					}
+					site.add("routers", name)
+					// The interface of the BGP session tells whether it runs over VPN or Interconnect
+					routerInterface := interfaces[stringField(peer, "interfaceName")]
+					if tunnel := stringField(routerInterface, "linkedVpnTunnel"); tunnel != "" {
+						site.add("vpnTunnels", strings.Replace(tunnel, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1))
+					}
+					if attachment := stringField(routerInterface, "linkedInterconnectAttachment"); attachment != "" {
+						site.add("interconnectAttachments", strings.Replace(attachment, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1))
+					}
+				}
+			}
+
+		case "compute.googleapis.com/InterconnectAttachment":
+			for _, site := range sites {
+				attachments, _ := mapField(site.asset, "resource", "data")["interconnectAttachments"].([]interface{})
+				for _, attachment := range attachments {
+					if name == fmt.Sprint(attachment) || strings.HasSuffix(name, "/"+fmt.Sprint(attachment)) {
+						site.add("interconnectAttachments", name)
+					}
+				}
+			}
+
+		case "compute.googleapis.com/Subnetwork":
+			ranges := []string{stringField(data, "ipCidrRange")}
+			if secondaryRanges, ok := data["secondaryIpRanges"].([]interface{}); ok {
+				for _, secondaryRange := range secondaryRanges {
+					ranges = append(ranges, stringField(secondaryRange, "ipCidrRange"))
+				}
+			}
+			for _, ipRange := range ranges {
+				parsed, err := parseIpRange(ipRange)
+				if ipRange == "" || err != nil {
+					continue
+				}
+				for _, site := range sites {
+					for _, cidr := range site.cidrs {
+						if ipRangesOverlap(cidr, parsed) {
+							v.addRouteOverlap(site, cidr, name, parsed)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Overlaps between sites
+	for idx, site := range sites {
+		for _, other := range sites[idx+1:] {
+			for _, cidr := range site.cidrs {
+				for _, otherCidr := range other.cidrs {
+					if ipRangesOverlap(cidr, otherCidr) {
+						v.addRouteOverlap(site, cidr, other.name, otherCidr)
+						v.addRouteOverlap(other, otherCidr, site.name, cidr)
+					}
+				}
+			}
+		}
+	}
+
+	wrtx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer wrtx.Rollback()
+
+	var linked int
+	for _, site := range sites {
+		if len(site.links["vpnTunnels"])+len(site.links["routers"])+len(site.links["interconnectAttachments"]) > 0 {
+			linked++
+		} else {
+			v.warn(PhaseOnPrem, "on-premises site %s is not connected to any VPN tunnel, Cloud Router or interconnect attachment.", site.name)
+		}
+		resource := mapField(site.asset, "resource")
+		if v.update != nil && sameJson(resource["onprem"], site.links) {
+			continue
+		}
+		resource["onprem"] = site.links
+		if err = v.UpdateAsset(wrtx, site.name, site.asset); err != nil {
+			return err
+		}
+		v.affect(site.name)
+	}
+	if err = wrtx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseOnPrem, Message: fmt.Sprintf("Linked %d of %d on-premises sites.", linked, len(sites)), Done: true})
+	return nil
+}
+
+func (v *GcpViz) addRouteOverlap(site *onPremSite, cidr *net.IPNet, resource string, ipRange *net.IPNet) {
+	v.warn(PhaseOnPrem, "range %s of on-premises site %s overlaps with %s of %s.", cidr, site.name, ipRange, resource)
+	site.add("overlaps", fmt.Sprintf("%s overlaps %s (%s)", cidr, ipRange, GetLastPart(resource)))
+	v.report().RouteOverlaps = append(v.report().RouteOverlaps, RouteOverlap{Site: site.name, Cidr: cidr.String(), Resource: resource, Range: ipRange.String()})
+}
@@ -0,0 +1,128 @@
+package gcpviz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Phases reported in progress events
+const (
+	PhaseRead       = "read"
+	PhaseTerraform  = "terraform"
+	PhaseKubernetes = "kubernetes"
+	PhaseOnPrem     = "onprem"
+	PhaseLabels     = "labels"
+	PhaseWatch      = "watch"
+	PhaseAliases    = "aliases"
+	PhaseReferences = "references"
+	PhaseIps        = "ips"
+	PhaseEnrich     = "enrich"
+	PhaseSave       = "save"
+	PhaseLoad       = "load"
+	PhaseNodes      = "nodes"
+	PhaseEdges      = "edges"
+	PhaseExport     = "export"
+)
+
+// Level of progress events reporting a problem that does not stop the phase
+const LevelWarning = "warning"
+
+// ProgressEvent reports the progress of a long-running phase. Current and Total are
+// counted in Unit (bytes, assets, results or records); Total is zero if unknown.
+// Level is empty, or LevelWarning for problems such as assets that were not found.
+type ProgressEvent struct {
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase"`
+	Level   string    `json:"level,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Current int64     `json:"current,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Unit    string    `json:"unit,omitempty"`
+	Done    bool      `json:"done,omitempty"`
+}
+
+// ProgressFunc receives progress events. It is called from the goroutine running
+// the phase.
+type ProgressFunc func(ProgressEvent)
+
+// TextProgress writes progress events as lines of text, suitable for terminals and
+// CI logs.
+func TextProgress(w io.Writer) ProgressFunc {
+	return func(event ProgressEvent) {
+		switch {
+		case event.Level == LevelWarning:
+			fmt.Fprintf(w, "Warning: %s\n", event.Message)
+		case event.Total > 0:
+			fmt.Fprintf(w, "%s: %d/%d %s processed.\n", event.Message, event.Current, event.Total, event.Unit)
+		case event.Unit != "":
+			fmt.Fprintf(w, "%s: %d %s processed.\n", event.Message, event.Current, event.Unit)
+		default:
+			fmt.Fprintf(w, "%s\n", event.Message)
+		}
+	}
+}
+
+// JSONProgress writes progress events as newline delimited JSON.
+func JSONProgress(w io.Writer) ProgressFunc {
+	enc := json.NewEncoder(w)
+	return func(event ProgressEvent) {
+		enc.Encode(event)
+	}
+}
+
+// WithProgress sets the function that receives progress events. By default, events
+// are written to standard error as text.
+func WithProgress(progress ProgressFunc) Option {
+	return func(c *config) error {
+		c.progress = progress
+		return nil
+	}
+}
+
+func (v *GcpViz) progress(event ProgressEvent) {
+	event.Time = time.Now()
+	if v.Progress == nil {
+		v.Progress = TextProgress(os.Stderr)
+	}
+	v.Progress(event)
+}
+
+// warn reports a problem that does not stop the phase.
+func (v *GcpViz) warn(phase string, format string, args ...interface{}) {
+	v.progress(ProgressEvent{Phase: phase, Level: LevelWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// progressCounter reports every step of the counter, or on completion.
+type progressCounter struct {
+	v       *GcpViz
+	event   ProgressEvent
+	every   int64
+	lastPos int64
+}
+
+func (v *GcpViz) newProgressCounter(phase string, message string, unit string, total int64, every int64) *progressCounter {
+	if every <= 0 {
+		every = 1
+	}
+	return &progressCounter{v: v, event: ProgressEvent{Phase: phase, Message: message, Unit: unit, Total: total}, every: every}
+}
+
+func (c *progressCounter) Set(current int64) {
+	c.event.Current = current
+	if current-c.lastPos >= c.every {
+		c.lastPos = current
+		c.v.progress(c.event)
+	}
+}
+
+func (c *progressCounter) Add(n int64) {
+	c.Set(c.event.Current + n)
+}
+
+func (c *progressCounter) Done() {
+	c.event.Done = true
+	c.v.progress(c.event)
+}
@@ -0,0 +1,122 @@
+package gcpviz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+)
+
+// Messages are pulled from Pub/Sub via its REST API, which the Pub/Sub emulator
+// supports as well.
+
+const (
+	pubSubEndpoint = "https://pubsub.googleapis.com"
+	pubSubScope    = "https://www.googleapis.com/auth/pubsub"
+)
+
+// PubSubSubscription pulls messages from a Pub/Sub subscription. If the
+// PUBSUB_EMULATOR_HOST environment variable is set, the emulator on that host is
+// used without authentication.
+type PubSubSubscription struct {
+	// Name of the subscription: projects/PROJECT/subscriptions/SUBSCRIPTION
+	Name     string
+	Endpoint string
+	client   *http.Client
+}
+
+// PubSubMessage is a message pulled from a subscription, which is acknowledged by
+// AckId.
+type PubSubMessage struct {
+	AckId       string            `json:"-"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	MessageId   string            `json:"messageId"`
+	PublishTime string            `json:"publishTime"`
+}
+
+// NewPubSubSubscription returns a subscription using Application Default Credentials,
+// or the emulator.
+func NewPubSubSubscription(ctx context.Context, name string) (*PubSubSubscription, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "subscriptions" {
+		return nil, fmt.Errorf("invalid subscription %s, use projects/PROJECT/subscriptions/SUBSCRIPTION format", name)
+	}
+	if emulator := os.Getenv("PUBSUB_EMULATOR_HOST"); emulator != "" {
+		return &PubSubSubscription{Name: name, Endpoint: "http://" + emulator, client: http.DefaultClient}, nil
+	}
+	client, err := google.DefaultClient(ctx, pubSubScope)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting credentials for Pub/Sub")
+	}
+	return &PubSubSubscription{Name: name, Endpoint: pubSubEndpoint, client: client}, nil
+}
+
+func (s *PubSubSubscription) call(ctx context.Context, method string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s:%s", s.Endpoint, s.Name, method)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("calling %s on %s", method, s.Name))
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("calling %s on %s: %s: %s", method, s.Name, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if response == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(respBody, response), fmt.Sprintf("parsing response of %s", method))
+}
+
+// Pull returns up to maxMessages messages. It waits for messages to arrive, but may
+// return none.
+func (s *PubSubSubscription) Pull(ctx context.Context, maxMessages int) ([]PubSubMessage, error) {
+	var response struct {
+		ReceivedMessages []struct {
+			AckId   string        `json:"ackId"`
+			Message PubSubMessage `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	err := s.call(ctx, "pull", map[string]interface{}{"maxMessages": maxMessages}, &response)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]PubSubMessage, len(response.ReceivedMessages))
+	for idx, received := range response.ReceivedMessages {
+		messages[idx] = received.Message
+		messages[idx].AckId = received.AckId
+	}
+	return messages, nil
+}
+
+// Acknowledge acknowledges messages, so that they are not delivered again.
+func (s *PubSubSubscription) Acknowledge(ctx context.Context, ackIds []string) error {
+	if len(ackIds) == 0 {
+		return nil
+	}
+	return s.call(ctx, "acknowledge", map[string]interface{}{"ackIds": ackIds}, nil)
+}
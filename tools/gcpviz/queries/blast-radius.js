@@ -0,0 +1,8 @@
+// Renders the blast radius of an asset: the asset and everything that depends on it.
+// The affected assets are calculated by "-mode blast-radius" and passed as the
+// BlastRadius parameter, each asset is drawn below the asset it uses.
+var assets = {{ if .BlastRadius }}{{ js .BlastRadius }}{{ else }}[]{{ end }};
+
+assets.forEach(function (asset) {
+    g.emit({ id: asset.name, parent: asset.via ? asset.via : asset.name });
+});
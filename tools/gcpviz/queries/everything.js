@@ -10,7 +10,7 @@ var follow = function (n, depth) {
 };
 
 
-var root = g.V("{{ index .Organizations 0 }}");
+var root = g.V({{ range $idx, $root := .Organizations }}{{ if $idx }}, {{ end }}"{{ $root }}"{{ end }});
 follow(root, 1);
 root.tagArray().concat(nodes).forEach(function (node) {
     g.emit(node);
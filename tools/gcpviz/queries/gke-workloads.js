@@ -0,0 +1,131 @@
+var containerResourceTypes = [
+    "cloudresourcemanager.googleapis.com/Organization",
+    "cloudresourcemanager.googleapis.com/Folder",
+    "cloudresourcemanager.googleapis.com/Project",
+];
+var kubernetesResourceTypes = [
+    "k8s.io/Node",
+    "k8s.io/Namespace",
+    "k8s.io/Pod",
+    "k8s.io/Service",
+    "apps.k8s.io/Deployment",
+    "apps.k8s.io/ReplicaSet",
+    "apps.k8s.io/StatefulSet",
+    "apps.k8s.io/DaemonSet",
+    "networking.k8s.io/Ingress",
+    "extensions.k8s.io/Ingress",
+];
+// Load balancing resources are only shown if they are used by Kubernetes objects
+var loadBalancingResourceTypes = [
+    "compute.googleapis.com/NetworkEndpointGroup",
+    "compute.googleapis.com/BackendService",
+    "compute.googleapis.com/RegionBackendService",
+    "compute.googleapis.com/ForwardingRule",
+    "compute.googleapis.com/GlobalForwardingRule",
+];
+var wantedResourceTypes = [
+    "container.googleapis.com/Cluster",
+    "container.googleapis.com/NodePool",
+].concat(kubernetesResourceTypes, loadBalancingResourceTypes);
+var resourceTypes = containerResourceTypes.concat(wantedResourceTypes);
+
+var nodes = [];
+var follow = function (n, depth) {
+    var out = n.tag("parent").labelContext(resourceTypes, "type").out("child");
+    if (out.count() == 0) {
+        return;
+    }
+    nodes = nodes.concat(out.tagArray());
+    follow(out, depth + 1);
+};
+
+// Filters disconnected vertexes from results
+var filterEmptyNodes = function (nodes) {
+    var filteredNodes = [];
+    var m = g.Morphism().labelContext(resourceTypes, "type").in(["child", "uses"]);
+    nodes.forEach(function (node) {
+        if (wantedResourceTypes.indexOf(node.type) > -1) {
+            if (g.V(node.id).follow(m).count() > 0) {
+                filteredNodes.push(node);
+            }
+        } else {
+            filteredNodes.push(node);
+        }
+    });
+    return filteredNodes;
+}
+
+// Filters load balancing resources that were not created for Kubernetes objects
+var filterLoadBalancing = function (nodes) {
+    var filteredNodes = [];
+    var m = g.Morphism().labelContext(kubernetesResourceTypes).in("uses");
+    nodes.forEach(function (node) {
+        if (loadBalancingResourceTypes.indexOf(node.type) > -1) {
+            if (g.V(node.id).follow(m).count() > 0) {
+                filteredNodes.push(node);
+            }
+        } else {
+            filteredNodes.push(node);
+        }
+    });
+    return filteredNodes;
+}
+
+// Filters empty projects from results
+var filterEmptyProjects = function (nodes) {
+    var filteredNodes = [];
+    var projectM = g.Morphism().labelContext(resourceTypes, "type").in(["child", "uses"]);
+    nodes.forEach(function (node) {
+        if (node.type == "cloudresourcemanager.googleapis.com/Project") {
+            if (g.V(node.id).follow(projectM).count() > 1) {
+                filteredNodes.push(node);
+            }
+        } else {
+            filteredNodes.push(node);
+        }
+    });
+    return filteredNodes;
+}
+
+// Filters empty folders from results
+var filterEmptyFolders = function (nodes) {
+    var folderMap = {};
+    var folderItemCount = {};
+    var filteredNodes = [];
+
+    nodes.forEach(function (node) {
+        if (containerResourceTypes.indexOf(node.type) > -1) {
+            folderMap[node.id] = node;
+            if (node.type == "cloudresourcemanager.googleapis.com/Folder") {
+                folderItemCount[node.id] = 0;
+            }
+        }
+    });
+
+    nodes.forEach(function (node) {
+        if (node.type == "cloudresourcemanager.googleapis.com/Project") {
+            var iNode = node;
+            while (iNode && iNode.parent in folderMap) {
+                folderItemCount[iNode.parent] += 1;
+                iNode = folderMap[iNode.parent];
+            }
+        }
+    });
+
+    nodes.forEach(function (node) {
+        if (node.type == "cloudresourcemanager.googleapis.com/Folder") {
+            if (folderItemCount[node.id] > 0) {
+                filteredNodes.push(node);
+            }
+        } else {
+            filteredNodes.push(node);
+        }
+    });
+    return filteredNodes;
+}
+
+var root = g.V({{ range $idx, $root := .Organizations }}{{ if $idx }}, {{ end }}"{{ $root }}"{{ end }});
+follow(root, 1);
+filterEmptyFolders(filterEmptyProjects(filterLoadBalancing(root.tagArray().concat(nodes)))).forEach(function (node) {
+    g.emit(node);
+});
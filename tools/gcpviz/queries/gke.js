@@ -92,7 +92,7 @@ var filterEmptyFolders = function (nodes) {
     return filteredNodes;
 }
 
-var root = g.V("{{ index .Organizations 0 }}");
+var root = g.V({{ range $idx, $root := .Organizations }}{{ if $idx }}, {{ end }}"{{ $root }}"{{ end }});
 follow(root, 1);
 filterEmptyFolders(filterEmptyProjects(root.tagArray().concat(nodes))).forEach(function (node) {
     g.emit(node);
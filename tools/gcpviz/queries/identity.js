@@ -0,0 +1,98 @@
+/*
+ * Service accounts and what they are used by: the workloads (instances, GKE node pools,
+ * Cloud Functions and Cloud Run services) running as each service account, its
+ * user-managed keys and the firewall rules that target it or allow traffic from it.
+ */
+var containerResourceTypes = [
+    "cloudresourcemanager.googleapis.com/Organization",
+    "cloudresourcemanager.googleapis.com/Folder",
+    "cloudresourcemanager.googleapis.com/Project",
+];
+var resourceTypes = containerResourceTypes.concat([
+    "iam.googleapis.com/ServiceAccount",
+]);
+
+var nodes = [];
+var follow = function (n, depth) {
+    var out = n.tag("parent").labelContext(resourceTypes, "type").out("child");
+    if (out.count() == 0) {
+        return;
+    }
+    nodes = nodes.concat(out.tagArray());
+    follow(out, depth + 1);
+};
+
+// Adds the workloads, keys and firewall rules of each service account, with the
+// service account as their parent
+var followIdentities = function (nodes) {
+    var identities = [];
+    nodes.forEach(function (node) {
+        if (node.type != "iam.googleapis.com/ServiceAccount") {
+            return;
+        }
+        identities = identities.concat(g.V(node.id).tag("parent").in("runs_as").tagArray());
+        identities = identities.concat(g.V(node.id).tag("parent").in(["targets_sa", "sources_sa"]).tagArray());
+        identities = identities.concat(g.V(node.id).tag("parent").labelContext(["iam.googleapis.com/ServiceAccountKey"], "type").out("child").tagArray());
+    });
+    return nodes.concat(identities);
+};
+
+// Filters projects without service accounts from results
+var filterEmptyProjects = function (nodes) {
+    var projects = {};
+    nodes.forEach(function (node) {
+        if (node.type == "iam.googleapis.com/ServiceAccount") {
+            projects[node.parent] = true;
+        }
+    });
+    var filteredNodes = [];
+    nodes.forEach(function (node) {
+        if (node.type != "cloudresourcemanager.googleapis.com/Project" || projects[node.id]) {
+            filteredNodes.push(node);
+        }
+    });
+    return filteredNodes;
+};
+
+// Filters empty folders from results
+var filterEmptyFolders = function (nodes) {
+    var folderMap = {};
+    var folderItemCount = {};
+    var filteredNodes = [];
+
+    nodes.forEach(function (node) {
+        if (containerResourceTypes.indexOf(node.type) > -1) {
+            folderMap[node.id] = node;
+            if (node.type == "cloudresourcemanager.googleapis.com/Folder") {
+                folderItemCount[node.id] = 0;
+            }
+        }
+    });
+
+    nodes.forEach(function (node) {
+        if (node.type == "cloudresourcemanager.googleapis.com/Project") {
+            var iNode = node;
+            while (iNode && iNode.parent in folderMap) {
+                folderItemCount[iNode.parent] += 1;
+                iNode = folderMap[iNode.parent];
+            }
+        }
+    });
+
+    nodes.forEach(function (node) {
+        if (node.type == "cloudresourcemanager.googleapis.com/Folder") {
+            if (folderItemCount[node.id] > 0) {
+                filteredNodes.push(node);
+            }
+        } else {
+            filteredNodes.push(node);
+        }
+    });
+    return filteredNodes;
+};
+
+var root = g.V({{ range $idx, $root := .Organizations }}{{ if $idx }}, {{ end }}"{{ $root }}"{{ end }});
+follow(root, 1);
+followIdentities(filterEmptyFolders(filterEmptyProjects(root.tagArray().concat(nodes)))).forEach(function (node) {
+    g.emit(node);
+});
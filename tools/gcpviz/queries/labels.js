@@ -0,0 +1,16 @@
+/*
+ * Resources grouped by the values of a label, ie. the owners of resources with:
+ *   -query-parameter label=team
+ * Requires a graph generated with -label-vertexes.
+ */
+var root = g.V({{ range $idx, $root := .Organizations }}{{ if $idx }}, {{ end }}"{{ $root }}"{{ end }});
+var labels = root.tag("parent").labelContext(["labels.gcpviz/Label"], "type").out("child").filter(like("//labels.gcpviz/labels/{{ .label }}=%")).tagArray();
+
+// Adds the resources with each label, with the label as their parent
+var nodes = root.tagArray().concat(labels);
+labels.forEach(function (label) {
+    nodes = nodes.concat(g.V(label.id).tag("parent").in("labelled").tagArray());
+});
+nodes.forEach(function (node) {
+    g.emit(node);
+});
@@ -1,5 +1,5 @@
 var resourceTypes = [
-    "cloudresourcemanager.googleapis.com/Project"
+    "cloudresourcemanager.googleapis.com/Project",
     "compute.googleapis.com/Network",
     "compute.googleapis.com/Firewall",
     "iam.googleapis.com/ServiceAccount",
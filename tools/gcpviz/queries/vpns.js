@@ -9,6 +9,8 @@ var wantedResourceTypes = [
     "compute.googleapis.com/VpnTunnel",
     "compute.googleapis.com/VpnGateway",
     "compute.googleapis.com/TargetVpnGateway",
+    "compute.googleapis.com/InterconnectAttachment",
+    "onprem.gcpviz/Site",
 ];
 var resourceTypes = containerResourceTypes.concat(wantedResourceTypes);
 
@@ -115,7 +117,7 @@ var followSharedVpc = function (n, depth) {
     follow(out, depth + 1);
 };
 
-var root = g.V("{{ index .Organizations 0 }}");
+var root = g.V({{ range $idx, $root := .Organizations }}{{ if $idx }}, {{ end }}"{{ $root }}"{{ end }});
 follow(root, 1);
 filterEmptyFolders(filterEmptyProjects(filterEmptyNodes("compute.googleapis.com/Network", root.tagArray().concat(nodes)))).forEach(function (node) {
     g.emit(node);
@@ -0,0 +1,151 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query files are templates that are rendered with the query parameters before they
+// are run. To keep parameters from changing the query, strings are printed escaped for
+// use within JavaScript string literals (ie. "{{ .project }}"). Booleans and numbers
+// are passed as they are, and lists and objects as Go values with their strings
+// escaped, so they can be used in template logic. The js function renders any
+// parameter as a JavaScript literal (ie. {{ js .types }} for an array).
+
+var (
+	// ErrQueryTimeout is returned when a query runs longer than the query timeout
+	ErrQueryTimeout = errors.New("query timeout exceeded")
+	// ErrQueryLimit is returned when a query emits more results than the query limit
+	ErrQueryLimit = errors.New("query result limit exceeded")
+)
+
+// QueryLiteral is a query parameter that is rendered as is, ie. a JSON value.
+type QueryLiteral string
+
+// queryString is a string query parameter. It is printed escaped, but compares equal
+// to and is rendered by js as the original string.
+type queryString string
+
+func (s queryString) String() string {
+	return template.JSEscapeString(string(s))
+}
+
+// ParseQueryParameter parses a query parameter in name=value format, where value is a
+// string, or in name:=value format, where value is JSON (a number, boolean, string,
+// array or object).
+func ParseQueryParameter(parameter string) (string, interface{}, error) {
+	idx := strings.Index(parameter, "=")
+	if idx < 1 {
+		return "", nil, fmt.Errorf("invalid query parameter %s, use param=value or param:=json format", parameter)
+	}
+	name, value := parameter[:idx], parameter[idx+1:]
+	if !strings.HasSuffix(name, ":") {
+		return name, value, nil
+	}
+	name = strings.TrimSuffix(name, ":")
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		return "", nil, errors.Wrap(err, fmt.Sprintf("invalid JSON value for query parameter %s", name))
+	}
+	return name, parsed, nil
+}
+
+// escapeQueryParameter makes a parameter safe to use in a query template.
+func escapeQueryParameter(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case nil, bool, int, int64, float64, QueryLiteral:
+		return value, nil
+	case string:
+		return queryString(value), nil
+	case []string:
+		// Lists of strings, such as the organizations, are usually ranged over
+		escaped := make([]queryString, len(value))
+		for idx, s := range value {
+			escaped[idx] = queryString(s)
+		}
+		return escaped, nil
+	}
+
+	// Other values, such as structs, are passed as their JSON representation
+	jsn, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(jsn, &decoded); err != nil {
+		return nil, err
+	}
+	return escapeQueryStrings(decoded), nil
+}
+
+func escapeQueryStrings(value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		return queryString(value)
+	case []interface{}:
+		escaped := make([]interface{}, len(value))
+		for idx, item := range value {
+			escaped[idx] = escapeQueryStrings(item)
+		}
+		return escaped
+	case map[string]interface{}:
+		escaped := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			escaped[k] = escapeQueryStrings(item)
+		}
+		return escaped
+	}
+	return value
+}
+
+// queryJs renders a query parameter as a JavaScript literal. It replaces the js
+// function of templates, which only escapes strings.
+func queryJs(value interface{}) (QueryLiteral, error) {
+	if literal, ok := value.(QueryLiteral); ok {
+		return literal, nil
+	}
+	jsn, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return QueryLiteral(jsn), nil
+}
+
+// WithQueryTimeout stops queries that run longer than timeout. Visualizing runs the
+// query twice (for nodes and edges), the timeout applies to each run.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		c.queryTimeout = timeout
+		return nil
+	}
+}
+
+// WithQueryLimit stops queries that emit more than limit results.
+func WithQueryLimit(limit int) Option {
+	return func(c *config) error {
+		c.queryLimit = limit
+		return nil
+	}
+}
+
+// queryContext returns the context to run a query in, limited by the query timeout.
+func (v *GcpViz) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if v.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, v.QueryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// queryError tells apart query timeouts from the cancellation of the whole run.
+func (v *GcpViz) queryError(ctx context.Context, queryCtx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && queryCtx.Err() == context.DeadlineExceeded {
+		return errors.Wrap(ErrQueryTimeout, fmt.Sprintf("query stopped after %s", v.QueryTimeout))
+	}
+	return err
+}
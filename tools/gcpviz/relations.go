@@ -0,0 +1,91 @@
+package gcpviz
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	cquad "github.com/cayleygraph/quad"
+	"gopkg.in/yaml.v3"
+)
+
+// References between assets are stored as quads with the "uses" predicate. If the
+// relations file names the relationship (ie. peers_with), a second quad with the
+// name as predicate is stored, so existing queries that follow "uses" keep working
+// while new queries and edge styles can tell relationships apart.
+
+var relationNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// RelationPath is a JSONPath expression that refers to other assets, along with the
+// optional name of the relationship. In YAML, it is either the expression or a map
+// with path and relation keys.
+type RelationPath struct {
+	Path     string `yaml:"path" json:"path"`
+	Relation string `yaml:"relation,omitempty" json:"relation,omitempty"`
+}
+
+func (r *RelationPath) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		r.Path = value.Value
+		return nil
+	}
+	type relationPath RelationPath
+	return value.Decode((*relationPath)(r))
+}
+
+// MarshalYAML writes paths without a relationship name as plain expressions.
+func (r RelationPath) MarshalYAML() (interface{}, error) {
+	if r.Relation == "" {
+		return r.Path, nil
+	}
+	type relationPath RelationPath
+	return relationPath(r), nil
+}
+
+// Predicate returns the predicate of the quads for this relationship.
+func (r RelationPath) Predicate() string {
+	if r.Relation == "" {
+		return "uses"
+	}
+	return r.Relation
+}
+
+func checkRelationName(relation string) error {
+	if relation == "" {
+		return nil
+	}
+	if !relationNameRegexp.MatchString(relation) {
+		return fmt.Errorf("invalid relation name %q, use lowercase letters, digits and underscores", relation)
+	}
+	if relation == "child" {
+		return fmt.Errorf("relation name %q is reserved for the resource hierarchy", relation)
+	}
+	return nil
+}
+
+// relationBetween returns the name of the relationship of user to used, or "uses" for
+// plain references. If there are several, the first by name is returned.
+func (v *GcpViz) relationBetween(user string, used string) string {
+	ref := v.QS.ValueOf(cquad.String(user))
+	if ref == nil {
+		return "uses"
+	}
+	it := v.QS.QuadIterator(cquad.Subject, ref)
+	defer it.Close()
+
+	relations := make([]string, 0)
+	for it.Next(context.Background()) {
+		q := v.QS.Quad(it.Result())
+		predicate := quadValue(q.Predicate)
+		if predicate == "uses" || predicate == "child" || quadValue(q.Object) != used {
+			continue
+		}
+		relations = append(relations, predicate)
+	}
+	if len(relations) == 0 {
+		return "uses"
+	}
+	sort.Strings(relations)
+	return relations[0]
+}
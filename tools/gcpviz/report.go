@@ -0,0 +1,157 @@
+package gcpviz
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Maximum number of parse failures and dangling reference examples kept in the report
+const (
+	maxReportedFailures = 1000
+	maxReportedExamples = 10
+	maxErrorLength      = 500
+)
+
+// Report lists the problems found while generating a graph: assets that could not
+// be parsed, references to vertexes that are not assets, JSONPath expressions
+// from the relations file that could not be evaluated, subnetwork ranges that
+// overlap and on-premises ranges that overlap with ranges in Google Cloud.
+type Report struct {
+	Lenient            bool                           `json:"lenient"`
+	SkippedAssets      int64                          `json:"skipped_assets"`
+	ParseFailures      []ParseFailure                 `json:"parse_failures"`
+	DanglingReferences map[string]*DanglingReferences `json:"dangling_references"`
+	JsonPathErrors     []*JsonPathErrors              `json:"jsonpath_errors"`
+	IpOverlaps         []SubnetworkOverlap            `json:"ip_overlaps"`
+	RouteOverlaps      []RouteOverlap                 `json:"route_overlaps"`
+
+	jsonPathErrors map[string]*JsonPathErrors
+}
+
+type ParseFailure struct {
+	File   string `json:"file,omitempty"`
+	Source string `json:"source,omitempty"`
+	Line   int64  `json:"line"`
+	Error  string `json:"error"`
+}
+
+// DanglingReferences counts the references from assets of one type to vertexes that
+// are neither assets nor aliases of assets.
+type DanglingReferences struct {
+	Count    int64               `json:"count"`
+	Examples []DanglingReference `json:"examples"`
+}
+
+type DanglingReference struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// JsonPathErrors counts how often a JSONPath expression failed to evaluate, ie. because
+// a key did not exist. An expression that fails for every asset is likely wrong.
+type JsonPathErrors struct {
+	Section   string `json:"section"`
+	AssetType string `json:"asset_type"`
+	Path      string `json:"path"`
+	Evaluated int64  `json:"evaluated"`
+	Failed    int64  `json:"failed"`
+	Error     string `json:"error"`
+}
+
+func newReport() *Report {
+	return &Report{
+		ParseFailures:      make([]ParseFailure, 0),
+		DanglingReferences: make(map[string]*DanglingReferences, 0),
+		JsonPathErrors:     make([]*JsonPathErrors, 0),
+		IpOverlaps:         make([]SubnetworkOverlap, 0),
+		RouteOverlaps:      make([]RouteOverlap, 0),
+		jsonPathErrors:     make(map[string]*JsonPathErrors, 0),
+	}
+}
+
+func (v *GcpViz) report() *Report {
+	if v.Report == nil {
+		v.Report = newReport()
+	}
+	v.Report.Lenient = v.Lenient
+	return v.Report
+}
+
+func (r *Report) addParseFailure(file string, source string, line int64, err error) {
+	r.SkippedAssets++
+	if len(r.ParseFailures) < maxReportedFailures {
+		// Parse errors include the asset, which can be long
+		message := err.Error()
+		if len(message) > maxErrorLength {
+			message = message[:maxErrorLength] + "..."
+		}
+		r.ParseFailures = append(r.ParseFailures, ParseFailure{File: file, Source: source, Line: line, Error: message})
+	}
+}
+
+func (r *Report) addDanglingReference(assetType string, from string, to string) {
+	dangling, found := r.DanglingReferences[assetType]
+	if !found {
+		dangling = &DanglingReferences{Examples: make([]DanglingReference, 0)}
+		r.DanglingReferences[assetType] = dangling
+	}
+	dangling.Count++
+	if len(dangling.Examples) < maxReportedExamples {
+		dangling.Examples = append(dangling.Examples, DanglingReference{From: from, To: to})
+	}
+}
+
+// addJsonPathResult records the evaluation of a JSONPath expression.
+func (r *Report) addJsonPathResult(section string, assetType string, path string, err error) {
+	key := fmt.Sprintf("%s/%s/%s", section, assetType, path)
+	pathErrors, found := r.jsonPathErrors[key]
+	if !found {
+		pathErrors = &JsonPathErrors{Section: section, AssetType: assetType, Path: path}
+		r.jsonPathErrors[key] = pathErrors
+	}
+	pathErrors.Evaluated++
+	if err != nil {
+		pathErrors.Failed++
+		if pathErrors.Error == "" {
+			pathErrors.Error = err.Error()
+		}
+	}
+}
+
+// finish sorts the JSONPath errors and leaves out expressions that never failed.
+func (r *Report) finish() {
+	r.JsonPathErrors = make([]*JsonPathErrors, 0, len(r.jsonPathErrors))
+	for _, pathErrors := range r.jsonPathErrors {
+		if pathErrors.Failed > 0 {
+			r.JsonPathErrors = append(r.JsonPathErrors, pathErrors)
+		}
+	}
+	sort.Slice(r.JsonPathErrors, func(i, j int) bool {
+		a, b := r.JsonPathErrors[i], r.JsonPathErrors[j]
+		if a.AssetType != b.AssetType {
+			return a.AssetType < b.AssetType
+		}
+		if a.Section != b.Section {
+			return a.Section < b.Section
+		}
+		return a.Path < b.Path
+	})
+}
+
+func (v *GcpViz) printReportSummary() {
+	r := v.report()
+	var dangling int64
+	for _, references := range r.DanglingReferences {
+		dangling += references.Count
+	}
+	if r.SkippedAssets > 0 || dangling > 0 {
+		v.warn(PhaseEnrich, "%d assets skipped, %d dangling references from %d asset types.", r.SkippedAssets, dangling, len(r.DanglingReferences))
+	}
+}
+
+// WriteReport writes the report of the generated graph as JSON.
+func (v *GcpViz) WriteReport(fileName string) error {
+	r := v.report()
+	r.finish()
+	return writeJsonFile(fileName, r)
+}
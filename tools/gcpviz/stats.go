@@ -0,0 +1,329 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Graph statistics are calculated from the assets and the "uses" edges between them.
+// Edges to vertexes that are not assets (dangling references) are not counted, and
+// named relationships are counted once, as the "uses" edge they are stored with.
+// Label vertexes are not counted either: they would top the most connected assets
+// and join unrelated resources with the same label into one component.
+
+// GraphStats summarizes the assets and edges of a graph.
+type GraphStats struct {
+	Assets        int              `json:"assets"`
+	Edges         int              `json:"edges"`
+	AssetTypes    []StatsCount     `json:"asset_types"`
+	Projects      []StatsCount     `json:"projects"`
+	Folders       []StatsCount     `json:"folders"`
+	Degrees       []DegreeCount    `json:"degrees"`
+	MostConnected []ConnectedAsset `json:"most_connected"`
+	Orphans       []ConnectedAsset `json:"orphans"`
+	Components    []Component      `json:"components"`
+}
+
+// StatsCount is the number of assets of an asset type, or in a project or folder. For
+// projects and folders, Title is the project ID or display name of the folder.
+type StatsCount struct {
+	Name  string `json:"name"`
+	Title string `json:"title,omitempty"`
+	Count int    `json:"count"`
+}
+
+// DegreeCount is the number of assets with Degree edges (in or out).
+type DegreeCount struct {
+	Degree int `json:"degree"`
+	Assets int `json:"assets"`
+}
+
+// ConnectedAsset is an asset with the number of assets that use it (In) and that it
+// uses (Out). Orphans are assets that are only connected to the resource hierarchy, as
+// every asset uses its project.
+type ConnectedAsset struct {
+	Name      string `json:"name"`
+	AssetType string `json:"asset_type"`
+	In        int    `json:"in"`
+	Out       int    `json:"out"`
+}
+
+// Component is a set of assets connected by edges in either direction. The resource
+// hierarchy would connect everything, so organizations, folders and projects are not
+// part of components. Root is the asset with the most edges in the component.
+type Component struct {
+	Size       int          `json:"size"`
+	Root       string       `json:"root"`
+	AssetTypes []StatsCount `json:"asset_types"`
+}
+
+type statsAsset struct {
+	assetType string
+	project   string
+	folders   []string
+	in        map[string]bool
+	out       map[string]bool
+}
+
+func sortCounts(counts map[string]int, titles map[string]string) []StatsCount {
+	sorted := make([]StatsCount, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, StatsCount{Name: name, Title: titles[name], Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// Stats calculates the statistics of the graph. At most top most connected assets are
+// returned (all if top is zero).
+func (v *GcpViz) Stats(ctx context.Context, top int) (*GraphStats, error) {
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	assets := make(map[string]*statsAsset, 0)
+	titles := make(map[string]string, 0)
+	err = v.forEachAsset(ctx, tx, func(name string, asset []byte) error {
+		var resource TemplateResource
+		if err := json.Unmarshal(asset, &resource); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", name))
+		}
+		if resource.AssetType == labelAssetType {
+			return nil
+		}
+		sa := &statsAsset{assetType: resource.AssetType, in: make(map[string]bool, 0), out: make(map[string]bool, 0)}
+		for _, ancestor := range resource.Ancestors {
+			switch {
+			case strings.HasPrefix(ancestor, "projects/") && sa.project == "":
+				sa.project = ancestor
+			case strings.HasPrefix(ancestor, "folders/"):
+				sa.folders = append(sa.folders, ancestor)
+			}
+		}
+		switch resource.AssetType {
+		case "cloudresourcemanager.googleapis.com/Project":
+			if sa.project != "" {
+				titles[sa.project] = stringField(resource.Resource.Data, "projectId")
+			}
+		case "cloudresourcemanager.googleapis.com/Folder":
+			if len(sa.folders) > 0 {
+				titles[sa.folders[0]] = stringField(resource.Resource.Data, "displayName")
+			}
+		}
+		assets[name] = sa
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	tx.Rollback()
+
+	stats := &GraphStats{Assets: len(assets)}
+	it := v.QS.QuadsAllIterator()
+	defer it.Close()
+	for it.Next(ctx) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		q := v.QS.Quad(it.Result())
+		if quadValue(q.Predicate) != "uses" {
+			continue
+		}
+		user, used := quadValue(q.Subject), quadValue(q.Object)
+		userAsset, userFound := assets[user]
+		usedAsset, usedFound := assets[used]
+		if !userFound || !usedFound || user == used || userAsset.out[used] {
+			continue
+		}
+		userAsset.out[used] = true
+		usedAsset.in[user] = true
+		stats.Edges++
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(assets))
+	for name := range assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	assetTypes := make(map[string]int, 0)
+	projects := make(map[string]int, 0)
+	folders := make(map[string]int, 0)
+	degrees := make(map[int]int, 0)
+	connected := make([]ConnectedAsset, 0)
+	stats.Orphans = make([]ConnectedAsset, 0)
+	for _, name := range names {
+		sa := assets[name]
+		assetTypes[sa.assetType]++
+		if sa.project != "" {
+			projects[sa.project]++
+		}
+		for _, folder := range sa.folders {
+			folders[folder]++
+		}
+		degrees[len(sa.in)+len(sa.out)]++
+		asset := ConnectedAsset{Name: name, AssetType: sa.assetType, In: len(sa.in), Out: len(sa.out)}
+		// Every asset uses its project, so the resource hierarchy would top the list
+		if !isHierarchyAssetType(sa.assetType) && asset.In > 0 {
+			connected = append(connected, asset)
+		}
+	}
+	stats.AssetTypes = sortCounts(assetTypes, nil)
+	stats.Projects = sortCounts(projects, titles)
+	stats.Folders = sortCounts(folders, titles)
+
+	stats.Degrees = make([]DegreeCount, 0, len(degrees))
+	for degree, count := range degrees {
+		stats.Degrees = append(stats.Degrees, DegreeCount{Degree: degree, Assets: count})
+	}
+	sort.Slice(stats.Degrees, func(i, j int) bool { return stats.Degrees[i].Degree < stats.Degrees[j].Degree })
+
+	// Most connected assets are the ones most other assets depend on
+	sort.SliceStable(connected, func(i, j int) bool {
+		if connected[i].In != connected[j].In {
+			return connected[i].In > connected[j].In
+		}
+		return connected[i].Out > connected[j].Out
+	})
+	if top > 0 && len(connected) > top {
+		connected = connected[:top]
+	}
+	stats.MostConnected = connected
+
+	var orphans []string
+	stats.Components, orphans = statsComponents(names, assets)
+	for _, name := range orphans {
+		sa := assets[name]
+		stats.Orphans = append(stats.Orphans, ConnectedAsset{Name: name, AssetType: sa.assetType, In: len(sa.in), Out: len(sa.out)})
+	}
+	return stats, nil
+}
+
+// statsComponents returns the connected components with more than one asset, largest
+// first, and the sorted assets that are only connected to the resource hierarchy.
+func statsComponents(names []string, assets map[string]*statsAsset) ([]Component, []string) {
+	component := make(map[string]int, len(names))
+	members := make([][]string, 0)
+	for _, name := range names {
+		if _, found := component[name]; found || isHierarchyAssetType(assets[name].assetType) {
+			continue
+		}
+		idx := len(members)
+		component[name] = idx
+		queue := []string{name}
+		for i := 0; i < len(queue); i++ {
+			sa := assets[queue[i]]
+			for _, neighbours := range []map[string]bool{sa.in, sa.out} {
+				for neighbour := range neighbours {
+					if _, found := component[neighbour]; !found && !isHierarchyAssetType(assets[neighbour].assetType) {
+						component[neighbour] = idx
+						queue = append(queue, neighbour)
+					}
+				}
+			}
+		}
+		members = append(members, queue)
+	}
+
+	components := make([]Component, 0)
+	unconnected := make([]string, 0)
+	for _, assetNames := range members {
+		if len(assetNames) < 2 {
+			unconnected = append(unconnected, assetNames...)
+			continue
+		}
+		sort.Strings(assetNames)
+		assetTypes := make(map[string]int, 0)
+		root, rootDegree := "", -1
+		for _, name := range assetNames {
+			sa := assets[name]
+			assetTypes[sa.assetType]++
+			if degree := len(sa.in) + len(sa.out); degree > rootDegree {
+				root, rootDegree = name, degree
+			}
+		}
+		components = append(components, Component{Size: len(assetNames), Root: root, AssetTypes: sortCounts(assetTypes, nil)})
+	}
+	sort.SliceStable(components, func(i, j int) bool { return components[i].Size > components[j].Size })
+	sort.Strings(unconnected)
+	return components, unconnected
+}
+
+// WriteStats writes the statistics of the graph as tables of text or as JSON.
+func (v *GcpViz) WriteStats(ctx context.Context, out io.Writer, format string, top int) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown stats format %s, specify either table or json", format)
+	}
+	stats, err := v.Stats(ctx, top)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Assets:\t%d\n", stats.Assets)
+	fmt.Fprintf(w, "Edges:\t%d\n", stats.Edges)
+	fmt.Fprintf(w, "Orphaned assets:\t%d\n", len(stats.Orphans))
+	fmt.Fprintf(w, "Connected components:\t%d\n", len(stats.Components))
+
+	writeCounts := func(title string, header string, counts []StatsCount) {
+		fmt.Fprintf(w, "\n%s\n", title)
+		fmt.Fprintf(w, "COUNT\t%s\n", header)
+		for _, count := range counts {
+			if count.Title != "" {
+				fmt.Fprintf(w, "%d\t%s (%s)\n", count.Count, count.Title, count.Name)
+			} else {
+				fmt.Fprintf(w, "%d\t%s\n", count.Count, count.Name)
+			}
+		}
+	}
+	writeCounts("Assets per type", "ASSET TYPE", stats.AssetTypes)
+	writeCounts("Assets per project", "PROJECT", stats.Projects)
+	writeCounts("Assets per folder", "FOLDER", stats.Folders)
+
+	fmt.Fprintf(w, "\nDegree distribution\nDEGREE\tASSETS\n")
+	for _, degree := range stats.Degrees {
+		fmt.Fprintf(w, "%d\t%d\n", degree.Degree, degree.Assets)
+	}
+
+	fmt.Fprintf(w, "\nMost connected assets\nIN\tOUT\tASSET TYPE\tNAME\n")
+	for _, asset := range stats.MostConnected {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", asset.In, asset.Out, asset.AssetType, asset.Name)
+	}
+
+	fmt.Fprintf(w, "\nOrphaned assets\nASSET TYPE\tNAME\n")
+	for _, asset := range stats.Orphans {
+		fmt.Fprintf(w, "%s\t%s\n", asset.AssetType, asset.Name)
+	}
+
+	fmt.Fprintf(w, "\nConnected components\nSIZE\tROOT\tASSET TYPES\n")
+	for _, component := range stats.Components {
+		assetTypes := make([]string, len(component.AssetTypes))
+		for idx, assetType := range component.AssetTypes {
+			assetTypes[idx] = fmt.Sprintf("%s (%d)", assetType.Name, assetType.Count)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", component.Size, component.Root, strings.Join(assetTypes, ", "))
+	}
+	return w.Flush()
+}
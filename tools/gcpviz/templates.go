@@ -0,0 +1,273 @@
+package gcpviz
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Template functions for labels, links and styles. The functions return an empty
+// value instead of failing on unexpected input, as a single malformed asset should
+// not stop rendering the whole graph.
+
+var byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// GetPartAfter returns the part of a self-link or asset name after key, ie. the
+// project of ".../projects/my-project/zones/...".
+func GetPartAfter(key string, s string) string {
+	sp := strings.Split(s, "/")
+	for i := 0; i < len(sp)-1; i++ {
+		if sp[i] == key {
+			return sp[i+1]
+		}
+	}
+	return ""
+}
+
+// GetProject returns the project ID or number of a self-link or asset name.
+func GetProject(s string) string {
+	return GetPartAfter("projects", s)
+}
+
+// GetZone returns the zone of a self-link or asset name.
+func GetZone(s string) string {
+	return GetPartAfter("zones", s)
+}
+
+// Default returns value, or def if value is empty.
+func Default(def interface{}, value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return def
+	case string:
+		if v == "" {
+			return def
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return def
+		}
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return def
+		}
+	}
+	return value
+}
+
+// GetLabel returns the value of a resource label (ie. .Resource.Data.labels), or def
+// if the label is not set.
+func GetLabel(labels interface{}, key string, def string) string {
+	if m, ok := labels.(map[string]interface{}); ok {
+		if value, found := m[key]; found && value != nil && fmt.Sprint(value) != "" {
+			return fmt.Sprint(value)
+		}
+	}
+	return def
+}
+
+// HtmlEscape escapes a value for use in HTML-like labels (labels within < and >).
+func HtmlEscape(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return html.EscapeString(fmt.Sprint(value))
+}
+
+// HumanizeBytes formats a size with binary units, ie. 1.5 GiB. The optional unit
+// is the unit of the value, ie. "GiB" for disk sizes in GB.
+func HumanizeBytes(value interface{}, unit ...string) string {
+	f, ok := toFloat(value)
+	if !ok {
+		return ""
+	}
+	idx := 0
+	if len(unit) > 0 {
+		for i, u := range byteUnits {
+			// Sizes in Google Cloud APIs (ie. sizeGb) are in binary units
+			if strings.EqualFold(u, unit[0]) || strings.EqualFold(strings.Replace(u, "i", "", 1), unit[0]) {
+				idx = i
+			}
+		}
+	}
+	for math.Abs(f) >= 1024 && idx < len(byteUnits)-1 {
+		f /= 1024
+		idx++
+	}
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(math.Round(f*10)/10, 'f', -1, 64), byteUnits[idx])
+}
+
+// HumanizeDuration formats a duration in seconds, or a duration string such as
+// "3600s" or "1h30m", with the two largest units, ie. 1d 2h.
+func HumanizeDuration(value interface{}) string {
+	var d time.Duration
+	if s, ok := value.(string); ok {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			seconds, ok := toFloat(s)
+			if !ok {
+				return ""
+			}
+			parsed = time.Duration(seconds * float64(time.Second))
+		}
+		d = parsed
+	} else {
+		seconds, ok := toFloat(value)
+		if !ok {
+			return ""
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	units := []struct {
+		suffix string
+		length time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	parts := make([]string, 0, 2)
+	for _, unit := range units {
+		n := d / unit.length
+		d -= n * unit.length
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", n, unit.suffix))
+		}
+		if len(parts) == 2 || (len(parts) == 1 && n == 0) {
+			break
+		}
+	}
+	if len(parts) == 0 {
+		return "0s"
+	}
+	return sign + strings.Join(parts, " ")
+}
+
+func parseCidr(cidr interface{}) *net.IPNet {
+	s, ok := cidr.(string)
+	if !ok {
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil
+	}
+	return ipNet
+}
+
+// CidrSize returns the number of addresses in a CIDR range (capped for large IPv6
+// ranges), or 0 for invalid ranges.
+func CidrSize(cidr interface{}) int64 {
+	ipNet := parseCidr(cidr)
+	if ipNet == nil {
+		return 0
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones >= 63 {
+		return math.MaxInt64
+	}
+	return int64(1) << uint(bits-ones)
+}
+
+// CidrFirst returns the first address of a CIDR range.
+func CidrFirst(cidr interface{}) string {
+	ipNet := parseCidr(cidr)
+	if ipNet == nil {
+		return ""
+	}
+	return ipNet.IP.String()
+}
+
+// CidrLast returns the last address of a CIDR range.
+func CidrLast(cidr interface{}) string {
+	ipNet := parseCidr(cidr)
+	if ipNet == nil {
+		return ""
+	}
+	last := make(net.IP, len(ipNet.IP))
+	for i := range ipNet.IP {
+		last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+	return last.String()
+}
+
+// GetAsset returns another asset by name (or compute self-link), or nil if it is not
+// in the graph.
+func (v *GcpViz) GetAsset(name interface{}) *TemplateResource {
+	s, ok := name.(string)
+	if !ok || s == "" || v.AssetDatabase == nil {
+		return nil
+	}
+	asset, err := v.getAsset(s)
+	if err != nil {
+		return nil
+	}
+	return asset
+}
+
+// unboundGetAsset is GetAsset of parsed templates, which are shared by the package.
+// It is replaced by GetAsset of the graph that executes them in bindTemplate, as are
+// the metric functions below.
+func unboundGetAsset(name interface{}) *TemplateResource {
+	return nil
+}
+
+func unboundMetricMin(metric string) float64 {
+	return 0
+}
+
+func unboundMetricMax(metric string) float64 {
+	return 0
+}
+
+func unboundHeatColor(metric string, value interface{}) string {
+	return ""
+}
+
+// bindTemplate returns a copy of a parsed template with GetAsset and the metric
+// functions bound to this graph.
+// Copies are made once per template and graph.
+func (v *GcpViz) bindTemplate(t *template.Template) (*template.Template, error) {
+	v.boundTemplatesLock.Lock()
+	defer v.boundTemplatesLock.Unlock()
+	if bound, found := v.boundTemplates[t]; found {
+		return bound, nil
+	}
+	bound, err := t.Clone()
+	if err != nil {
+		return nil, err
+	}
+	bound.Funcs(template.FuncMap{
+		"GetAsset":  v.GetAsset,
+		"MetricMin": v.MetricMin,
+		"MetricMax": v.MetricMax,
+		"HeatColor": v.HeatColor,
+	})
+	if v.boundTemplates == nil {
+		v.boundTemplates = make(map[*template.Template]*template.Template, 0)
+	}
+	v.boundTemplates[t] = bound
+	return bound, nil
+}
+
+// executeTemplate executes a label, link or style template bound to this graph.
+func (v *GcpViz) executeTemplate(t *template.Template, out io.Writer, data interface{}) error {
+	bound, err := v.bindTemplate(t)
+	if err != nil {
+		return err
+	}
+	return bound.Execute(out, data)
+}
@@ -0,0 +1,623 @@
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+const computeSelfLinkPrefix = "https://www.googleapis.com/compute/v1/"
+
+// Mapping of Terraform Google provider resource types to Cloud Asset Inventory
+// asset types and resource names. Placeholders in names refer to (snake case)
+// Terraform attributes.
+//
+// The asset types and name formats follow the resource converters of
+// terraform-validator, which are not used directly: they are generated into the
+// Google provider, pull in the provider and all of its dependencies, and need a
+// provider configuration (ie. default project and region) to convert
+// resources. Here, resources are converted from the values in the state or plan
+// only, so supporting another resource type is one entry in this table.
+type terraformMapping struct {
+	AssetType string
+	Name      string
+}
+
+var terraformMappings = map[string]terraformMapping{
+	"google_project":                        {"cloudresourcemanager.googleapis.com/Project", "//cloudresourcemanager.googleapis.com/projects/{number}"},
+	"google_folder":                         {"cloudresourcemanager.googleapis.com/Folder", "//cloudresourcemanager.googleapis.com/{name}"},
+	"google_compute_network":                {"compute.googleapis.com/Network", "//compute.googleapis.com/projects/{project}/global/networks/{name}"},
+	"google_compute_subnetwork":             {"compute.googleapis.com/Subnetwork", "//compute.googleapis.com/projects/{project}/regions/{region}/subnetworks/{name}"},
+	"google_compute_firewall":               {"compute.googleapis.com/Firewall", "//compute.googleapis.com/projects/{project}/global/firewalls/{name}"},
+	"google_compute_route":                  {"compute.googleapis.com/Route", "//compute.googleapis.com/projects/{project}/global/routes/{name}"},
+	"google_compute_router":                 {"compute.googleapis.com/Router", "//compute.googleapis.com/projects/{project}/regions/{region}/routers/{name}"},
+	"google_compute_address":                {"compute.googleapis.com/Address", "//compute.googleapis.com/projects/{project}/regions/{region}/addresses/{name}"},
+	"google_compute_global_address":         {"compute.googleapis.com/GlobalAddress", "//compute.googleapis.com/projects/{project}/global/addresses/{name}"},
+	"google_compute_instance":               {"compute.googleapis.com/Instance", "//compute.googleapis.com/projects/{project}/zones/{zone}/instances/{name}"},
+	"google_compute_instance_template":      {"compute.googleapis.com/InstanceTemplate", "//compute.googleapis.com/projects/{project}/global/instanceTemplates/{name}"},
+	"google_compute_instance_group":         {"compute.googleapis.com/InstanceGroup", "//compute.googleapis.com/projects/{project}/zones/{zone}/instanceGroups/{name}"},
+	"google_compute_disk":                   {"compute.googleapis.com/Disk", "//compute.googleapis.com/projects/{project}/zones/{zone}/disks/{name}"},
+	"google_compute_vpn_gateway":            {"compute.googleapis.com/TargetVpnGateway", "//compute.googleapis.com/projects/{project}/regions/{region}/targetVpnGateways/{name}"},
+	"google_compute_ha_vpn_gateway":         {"compute.googleapis.com/VpnGateway", "//compute.googleapis.com/projects/{project}/regions/{region}/vpnGateways/{name}"},
+	"google_compute_vpn_tunnel":             {"compute.googleapis.com/VpnTunnel", "//compute.googleapis.com/projects/{project}/regions/{region}/vpnTunnels/{name}"},
+	"google_compute_forwarding_rule":        {"compute.googleapis.com/ForwardingRule", "//compute.googleapis.com/projects/{project}/regions/{region}/forwardingRules/{name}"},
+	"google_compute_global_forwarding_rule": {"compute.googleapis.com/GlobalForwardingRule", "//compute.googleapis.com/projects/{project}/global/forwardingRules/{name}"},
+	"google_compute_backend_service":        {"compute.googleapis.com/BackendService", "//compute.googleapis.com/projects/{project}/global/backendServices/{name}"},
+	"google_compute_health_check":           {"compute.googleapis.com/HealthCheck", "//compute.googleapis.com/projects/{project}/global/healthChecks/{name}"},
+	"google_compute_url_map":                {"compute.googleapis.com/UrlMap", "//compute.googleapis.com/projects/{project}/global/urlMaps/{name}"},
+	"google_compute_target_http_proxy":      {"compute.googleapis.com/TargetHttpProxy", "//compute.googleapis.com/projects/{project}/global/targetHttpProxies/{name}"},
+	"google_compute_target_https_proxy":     {"compute.googleapis.com/TargetHttpsProxy", "//compute.googleapis.com/projects/{project}/global/targetHttpsProxies/{name}"},
+	"google_container_cluster":              {"container.googleapis.com/Cluster", "//container.googleapis.com/projects/{project}/locations/{location}/clusters/{name}"},
+	"google_container_node_pool":            {"container.googleapis.com/NodePool", "//container.googleapis.com/projects/{project}/locations/{location}/clusters/{cluster}/nodePools/{name}"},
+	"google_storage_bucket":                 {"storage.googleapis.com/Bucket", "//storage.googleapis.com/{name}"},
+	"google_pubsub_topic":                   {"pubsub.googleapis.com/Topic", "//pubsub.googleapis.com/projects/{project}/topics/{name}"},
+	"google_pubsub_subscription":            {"pubsub.googleapis.com/Subscription", "//pubsub.googleapis.com/projects/{project}/subscriptions/{name}"},
+	"google_bigquery_dataset":               {"bigquery.googleapis.com/Dataset", "//bigquery.googleapis.com/projects/{project}/datasets/{dataset_id}"},
+	"google_service_account":                {"iam.googleapis.com/ServiceAccount", "//iam.googleapis.com/projects/{project}/serviceAccounts/{unique_id}"},
+	"google_sql_database_instance":          {"sqladmin.googleapis.com/Instance", "//cloudsql.googleapis.com/projects/{project}/instances/{name}"},
+	"google_dns_managed_zone":               {"dns.googleapis.com/ManagedZone", "//dns.googleapis.com/projects/{project}/managedZones/{name}"},
+	"google_kms_key_ring":                   {"cloudkms.googleapis.com/KeyRing", "//cloudkms.googleapis.com/projects/{project}/locations/{location}/keyRings/{name}"},
+}
+
+// Terraform attributes that are named differently in Cloud Asset Inventory
+var terraformFieldNames = map[string]string{
+	"network_interface":  "networkInterfaces",
+	"network_ip":         "networkIP",
+	"access_config":      "accessConfigs",
+	"alias_ip_range":     "aliasIpRanges",
+	"secondary_ip_range": "secondaryIpRanges",
+	"allow":              "allowed",
+	"deny":               "denied",
+	"protocol":           "IPProtocol",
+	"ip_address":         "IPAddress",
+	"health_checks":      "healthChecks",
+	"backend":            "backends",
+	"peer_ip":            "peerIp",
+	"interface":          "interfaces",
+	"path_matcher":       "pathMatchers",
+	"path_rule":          "pathRules",
+}
+
+// Nested Terraform blocks that are single objects in Cloud Asset Inventory
+var terraformSingleBlocks = map[string]bool{
+	"bgp":                       true,
+	"settings":                  true,
+	"ip_configuration":          true,
+	"private_visibility_config": true,
+	"autoscaling_policy":        true,
+	"node_config":               true,
+	"network_config":            true,
+	"versioning":                true,
+	"encryption":                true,
+}
+
+var terraformPlaceholderRegexp = regexp.MustCompile(`{([a-z_]+)}`)
+var terraformRelativeLinkRegexp = regexp.MustCompile(`^projects/[^/]+/(global|regions|zones)/`)
+var terraformIndexRegexp = regexp.MustCompile(`\[[^\]]*\]`)
+
+type terraformResource struct {
+	Address string                 `json:"address"`
+	Mode    string                 `json:"mode"`
+	Type    string                 `json:"type"`
+	Name    string                 `json:"name"`
+	Values  map[string]interface{} `json:"values"`
+}
+
+type terraformModule struct {
+	Address      string              `json:"address"`
+	Resources    []terraformResource `json:"resources"`
+	ChildModules []terraformModule   `json:"child_modules"`
+}
+
+type terraformValues struct {
+	RootModule terraformModule `json:"root_module"`
+}
+
+type terraformConfigResource struct {
+	Address     string                 `json:"address"`
+	Expressions map[string]interface{} `json:"expressions"`
+}
+
+type terraformConfigModule struct {
+	Resources   []terraformConfigResource `json:"resources"`
+	ModuleCalls map[string]struct {
+		Module terraformConfigModule `json:"module"`
+	} `json:"module_calls"`
+}
+
+// Output of terraform show -json, for either a state or a plan
+type terraformShow struct {
+	Values          *terraformValues `json:"values"`
+	PlannedValues   *terraformValues `json:"planned_values"`
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Type    string `json:"type"`
+		Change  struct {
+			Actions []string               `json:"actions"`
+			Before  map[string]interface{} `json:"before"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+	Configuration struct {
+		ProviderConfig map[string]struct {
+			Name        string                 `json:"name"`
+			Expressions map[string]interface{} `json:"expressions"`
+		} `json:"provider_config"`
+		RootModule terraformConfigModule `json:"root_module"`
+	} `json:"configuration"`
+}
+
+type terraformConverter struct {
+	defaultProject string
+	resources      map[string]terraformResource
+	actions        map[string]string
+	expressions    map[string]map[string]interface{}
+	names          map[string]string
+	selfLinks      map[string]string
+	projects       map[string]string
+}
+
+func (m terraformModule) allResources() []terraformResource {
+	resources := m.Resources
+	for _, child := range m.ChildModules {
+		resources = append(resources, child.allResources()...)
+	}
+	return resources
+}
+
+func (c *terraformConverter) addExpressions(prefix string, module terraformConfigModule) {
+	for _, resource := range module.Resources {
+		c.expressions[prefix+resource.Address] = resource.Expressions
+	}
+	for name, call := range module.ModuleCalls {
+		c.addExpressions(fmt.Sprintf("%smodule.%s.", prefix, name), call.Module)
+	}
+}
+
+func terraformCamelCase(s string) string {
+	if name, found := terraformFieldNames[s]; found {
+		return name
+	}
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// convertValues converts Terraform attributes into Cloud Asset Inventory style data.
+// Unknown values in plans are resolved from references to other resources in the
+// configuration expressions.
+func (c *terraformConverter) convertValues(values map[string]interface{}, expressions map[string]interface{}, modulePrefix string) map[string]interface{} {
+	data := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if v == nil {
+			continue
+		}
+		var expression interface{}
+		if expressions != nil {
+			expression = expressions[k]
+		}
+		data[terraformCamelCase(k)] = c.convertValue(k, v, expression, modulePrefix)
+	}
+	for k, expression := range expressions {
+		if _, found := values[k]; found && values[k] != nil {
+			continue
+		}
+		if resolved := c.resolveReference(expression, modulePrefix); resolved != nil {
+			data[terraformCamelCase(k)] = resolved
+		}
+	}
+	return data
+}
+
+func (c *terraformConverter) convertValue(key string, value interface{}, expression interface{}, modulePrefix string) interface{} {
+	switch value.(type) {
+	case map[string]interface{}:
+		expressions, _ := expression.(map[string]interface{})
+		return c.convertValues(value.(map[string]interface{}), expressions, modulePrefix)
+	case []interface{}:
+		list := value.([]interface{})
+		converted := make([]interface{}, len(list))
+		expressionList, _ := expression.([]interface{})
+		for idx, item := range list {
+			var itemExpression interface{}
+			if idx < len(expressionList) {
+				itemExpression = expressionList[idx]
+			}
+			converted[idx] = c.convertValue(key, item, itemExpression, modulePrefix)
+		}
+		if terraformSingleBlocks[key] {
+			if len(converted) == 0 {
+				return nil
+			}
+			return converted[0]
+		}
+		return converted
+	}
+	if link, ok := value.(string); ok && terraformRelativeLinkRegexp.MatchString(link) {
+		return computeSelfLinkPrefix + link
+	}
+	return value
+}
+
+func (c *terraformConverter) resolveReference(expression interface{}, modulePrefix string) interface{} {
+	switch expression.(type) {
+	case map[string]interface{}:
+		e := expression.(map[string]interface{})
+		references, ok := e["references"].([]interface{})
+		if !ok {
+			return nil
+		}
+		for _, reference := range references {
+			address := modulePrefix + fmt.Sprint(reference)
+			// Strip attribute (google_compute_network.vpc.id -> google_compute_network.vpc)
+			for {
+				if selfLink, found := c.selfLinks[address]; found {
+					return selfLink
+				}
+				if name, found := c.names[address]; found {
+					return name
+				}
+				idx := strings.LastIndex(address, ".")
+				if idx == -1 {
+					break
+				}
+				address = address[:idx]
+			}
+		}
+	case []interface{}:
+		var resolved []interface{}
+		for _, item := range expression.([]interface{}) {
+			if r := c.resolveReference(item, modulePrefix); r != nil {
+				resolved = append(resolved, r)
+			}
+		}
+		if len(resolved) > 0 {
+			return resolved
+		}
+	}
+	return nil
+}
+
+func (c *terraformConverter) project(values map[string]interface{}) string {
+	if project, ok := values["project"].(string); ok && project != "" {
+		return project
+	}
+	return c.defaultProject
+}
+
+func (c *terraformConverter) assetName(resource terraformResource) (string, error) {
+	mapping := terraformMappings[resource.Type]
+	values := resource.Values
+
+	var missing []string
+	name := terraformPlaceholderRegexp.ReplaceAllStringFunc(mapping.Name, func(placeholder string) string {
+		attribute := placeholder[1 : len(placeholder)-1]
+		if attribute == "project" {
+			if project := c.project(values); project != "" {
+				return project
+			}
+		}
+		if value, ok := values[attribute].(string); ok && value != "" {
+			return value[strings.LastIndex(value, "/")+1:]
+		}
+		// Fallbacks for attributes that are only known after apply
+		switch {
+		case resource.Type == "google_project" && attribute == "number":
+			if projectId, ok := values["project_id"].(string); ok {
+				return projectId
+			}
+		case resource.Type == "google_folder" && attribute == "name":
+			if displayName, ok := values["display_name"].(string); ok {
+				return fmt.Sprintf("folders/%s", displayName)
+			}
+		case resource.Type == "google_service_account" && attribute == "unique_id":
+			if accountId, ok := values["account_id"].(string); ok {
+				return fmt.Sprintf("%s@%s.iam.gserviceaccount.com", accountId, c.project(values))
+			}
+		}
+		missing = append(missing, attribute)
+		return placeholder
+	})
+	if resource.Type == "google_folder" {
+		if value, ok := values["name"].(string); ok && value != "" {
+			name = fmt.Sprintf("//cloudresourcemanager.googleapis.com/%s", value)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unable to determine asset name for %s, missing attributes: %s", resource.Address, strings.Join(missing, ", "))
+	}
+	return name, nil
+}
+
+func (c *terraformConverter) parent(resource terraformResource) string {
+	values := resource.Values
+	switch resource.Type {
+	case "google_project":
+		if folderId, ok := values["folder_id"].(string); ok && folderId != "" {
+			return fmt.Sprintf("//cloudresourcemanager.googleapis.com/folders/%s", strings.TrimPrefix(folderId, "folders/"))
+		}
+		if orgId, ok := values["org_id"].(string); ok && orgId != "" {
+			return fmt.Sprintf("//cloudresourcemanager.googleapis.com/organizations/%s", orgId)
+		}
+		return ""
+	case "google_folder":
+		if parent, ok := values["parent"].(string); ok {
+			return fmt.Sprintf("//cloudresourcemanager.googleapis.com/%s", parent)
+		}
+		return ""
+	}
+	project := c.project(values)
+	for _, r := range c.resources {
+		if r.Type == "google_project" && r.Values["project_id"] == project {
+			if name, found := c.names[r.Address]; found {
+				return name
+			}
+		}
+	}
+	if name, found := c.projects[project]; found {
+		return name
+	}
+	return fmt.Sprintf("//cloudresourcemanager.googleapis.com/projects/%s", project)
+}
+
+func (c *terraformConverter) convert(resource terraformResource) (map[string]interface{}, error) {
+	mapping := terraformMappings[resource.Type]
+	name := c.names[resource.Address]
+
+	// References in configuration expressions are relative to the module
+	modulePrefix := terraformIndexRegexp.ReplaceAllString(resource.Address[:strings.LastIndex(resource.Address, resource.Type+".")], "")
+	data := c.convertValues(resource.Values, c.expressions[terraformIndexRegexp.ReplaceAllString(resource.Address, "")], modulePrefix)
+
+	if strings.HasPrefix(name, "//compute.googleapis.com/") {
+		project := c.project(resource.Values)
+		for _, field := range []string{"region", "zone"} {
+			if value, ok := data[field].(string); ok && !strings.Contains(value, "/") {
+				data[field] = fmt.Sprintf("%sprojects/%s/%ss/%s", computeSelfLinkPrefix, project, field, value)
+			}
+		}
+		data["selfLink"] = c.selfLinks[resource.Address]
+	}
+	if resource.Type == "google_compute_instance" {
+		var disks []interface{}
+		for _, field := range []string{"bootDisk", "attachedDisk"} {
+			if d, ok := data[field].([]interface{}); ok {
+				disks = append(disks, d...)
+			}
+			delete(data, field)
+		}
+		data["disks"] = disks
+	}
+	if _, found := data["name"]; !found {
+		data["name"] = resource.Values["name"]
+	}
+
+	parent := c.parent(resource)
+	var ancestors []string
+	if strings.HasPrefix(parent, "//cloudresourcemanager.googleapis.com/") {
+		ancestors = append(ancestors, strings.TrimPrefix(parent, "//cloudresourcemanager.googleapis.com/"))
+	}
+	if resource.Type == "google_project" {
+		ancestors = append([]string{strings.TrimPrefix(name, "//cloudresourcemanager.googleapis.com/")}, ancestors...)
+	}
+
+	asset := map[string]interface{}{
+		"name":       name,
+		"asset_type": mapping.AssetType,
+		"resource": map[string]interface{}{
+			"version":                "v1",
+			"discovery_document_uri": "",
+			"discovery_name":         mapping.AssetType[strings.LastIndex(mapping.AssetType, "/")+1:],
+			"parent":                 parent,
+			"data":                   data,
+		},
+		"ancestors": ancestors,
+		"source":    "terraform",
+	}
+	if action, found := c.actions[resource.Address]; found {
+		asset["planned"] = action
+	}
+	return asset, nil
+}
+
+func terraformAction(actions []string) string {
+	switch strings.Join(actions, ",") {
+	case "no-op", "read", "":
+		return ""
+	case "delete,create", "create,delete":
+		return "replace"
+	}
+	return actions[0]
+}
+
+// ReadAssetsFromTerraform converts the output of "terraform show -json" (state or
+// plan) for the Google provider into assets. Resources that will be created,
+// updated, replaced or deleted by a plan are marked as planned. Resources that
+// already exist in the asset database are only marked as planned.
+func (v *GcpViz) ReadAssetsFromTerraform(ctx context.Context, input string) error {
+	v.progress(ProgressEvent{Phase: PhaseTerraform, Message: fmt.Sprintf("Reading Terraform resources from %s...", input)})
+	file, err := ioutil.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	var show terraformShow
+	err = json.Unmarshal(file, &show)
+	if err != nil {
+		return errors.Wrap(err, "parsing Terraform JSON output")
+	}
+
+	converter := terraformConverter{
+		resources:   make(map[string]terraformResource, 0),
+		actions:     make(map[string]string, 0),
+		expressions: make(map[string]map[string]interface{}, 0),
+		names:       make(map[string]string, 0),
+		selfLinks:   make(map[string]string, 0),
+		projects:    make(map[string]string, 0),
+	}
+	for _, provider := range show.Configuration.ProviderConfig {
+		if provider.Name != "google" && provider.Name != "google-beta" {
+			continue
+		}
+		if project, ok := provider.Expressions["project"].(map[string]interface{}); ok {
+			if value, ok := project["constant_value"].(string); ok {
+				converter.defaultProject = value
+			}
+		}
+	}
+	converter.addExpressions("", show.Configuration.RootModule)
+
+	values := show.Values
+	if show.PlannedValues != nil {
+		values = show.PlannedValues
+	}
+	if values != nil {
+		for _, resource := range values.RootModule.allResources() {
+			converter.resources[resource.Address] = resource
+		}
+	}
+	for _, change := range show.ResourceChanges {
+		action := terraformAction(change.Change.Actions)
+		if action == "" {
+			continue
+		}
+		converter.actions[change.Address] = action
+		// Resources to be deleted are only present in the prior state
+		if _, found := converter.resources[change.Address]; !found && action == "delete" {
+			converter.resources[change.Address] = terraformResource{Address: change.Address, Mode: "managed", Type: change.Type, Values: change.Change.Before}
+		}
+	}
+
+	tx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Projects from Cloud Asset Inventory are named by project number
+	err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+		if !strings.Contains(string(bv), "cloudresourcemanager.googleapis.com/Project") {
+			return nil
+		}
+		var project TemplateResource
+		if err := json.Unmarshal(bv, &project); err != nil || project.AssetType != "cloudresourcemanager.googleapis.com/Project" {
+			return nil
+		}
+		if data, ok := project.Resource.Data.(map[string]interface{}); ok {
+			if projectId, ok := data["projectId"].(string); ok {
+				converter.projects[projectId] = project.Name
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for address, resource := range converter.resources {
+		if _, found := terraformMappings[resource.Type]; !found || resource.Mode != "managed" {
+			delete(converter.resources, address)
+			continue
+		}
+		name, err := converter.assetName(resource)
+		if err != nil {
+			v.warn(PhaseTerraform, "%v", err)
+			delete(converter.resources, address)
+			continue
+		}
+		converter.names[address] = name
+		if strings.HasPrefix(name, "//compute.googleapis.com/") {
+			converter.selfLinks[address] = strings.Replace(name, "//compute.googleapis.com/", computeSelfLinkPrefix, 1)
+		}
+	}
+
+	var added, marked int
+	projects := make(map[string]bool, 0)
+	for _, name := range converter.names {
+		projects[name] = true
+	}
+	for address, resource := range converter.resources {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		name := converter.names[address]
+		if existing := tx.Bucket([]byte("Assets")).Get([]byte(name)); existing != nil {
+			if action, found := converter.actions[address]; found {
+				var asset map[string]interface{}
+				err = json.Unmarshal(existing, &asset)
+				if err != nil {
+					return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", name))
+				}
+				asset["planned"] = action
+				err = v.UpdateAsset(tx, name, asset)
+				if err != nil {
+					return err
+				}
+				marked++
+			}
+			continue
+		}
+
+		asset, err := converter.convert(resource)
+		if err != nil {
+			return err
+		}
+		// Projects that are not managed by Terraform are added as placeholders
+		parent := asset["resource"].(map[string]interface{})["parent"].(string)
+		if strings.HasPrefix(parent, "//cloudresourcemanager.googleapis.com/projects/") && !projects[parent] {
+			projects[parent] = true
+			if tx.Bucket([]byte("Assets")).Get([]byte(parent)) == nil {
+				projectId := strings.TrimPrefix(parent, "//cloudresourcemanager.googleapis.com/projects/")
+				err = v.addAssetFromMap(tx, map[string]interface{}{
+					"name":       parent,
+					"asset_type": "cloudresourcemanager.googleapis.com/Project",
+					"resource": map[string]interface{}{
+						"version":        "v1",
+						"discovery_name": "Project",
+						"data": map[string]interface{}{
+							"projectId":     projectId,
+							"projectNumber": projectId,
+							"name":          projectId,
+						},
+					},
+					"ancestors": []string{fmt.Sprintf("projects/%s", projectId)},
+				})
+				if err != nil {
+					return err
+				}
+				added++
+			}
+		}
+
+		err = v.addAssetFromMap(tx, asset)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("converting Terraform resource %s", address))
+		}
+		added++
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseTerraform, Message: fmt.Sprintf("Terraform resources: %d added, %d existing assets marked as planned.", added, marked), Done: true})
+	return v.ResolveRoots()
+}
+
+// addAssetFromMap adds an asset that was converted from another source.
+func (v *GcpViz) addAssetFromMap(tx *bolt.Tx, asset map[string]interface{}) error {
+	jsn, err := json.Marshal(asset)
+	if err != nil {
+		return errors.Wrap(err, "marshaling to json")
+	}
+	pbAsset, parsed, err := v.parseJsonAsset(jsn)
+	if err != nil {
+		return err
+	}
+	return v.AddAsset(tx, *pbAsset, parsed)
+}
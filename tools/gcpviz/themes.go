@@ -0,0 +1,250 @@
+package gcpviz
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Theme recolors a graph style. Colors drawn directly on the canvas (edges, unfilled
+// nodes, fonts outside of nodes) are replaced using Background and node fill colors
+// are replaced using Fill. If a node fill is replaced, its font color is treated as
+// being drawn on the canvas. The key "*" matches any color except none and
+// transparent.
+type Theme struct {
+	Canvas     string
+	Background map[string]string
+	Fill       map[string]string
+}
+
+var Themes = map[string]Theme{
+	"dark": Theme{},
+	"light": Theme{
+		Canvas: "#fdf6e3",
+		Background: map[string]string{
+			"#fdf6e3": "#002b36",
+			"#eee8d5": "#073642",
+			"#93a1a1": "#586e75",
+			"#aaaaaa": "#586e75",
+			"#ffffff": "#002b36",
+			"white":   "#002b36",
+		},
+		Fill: map[string]string{
+			"#002b36": "#fdf6e3",
+			"#073642": "#eee8d5",
+		},
+	},
+	"print": Theme{
+		Canvas: "white",
+		Background: map[string]string{
+			"*": "black",
+		},
+		Fill: map[string]string{
+			"*": "#eeeeee",
+		},
+	},
+	// Okabe-Ito palette
+	"colorblind": Theme{
+		Background: map[string]string{
+			"#268bd2": "#0072b2",
+			"#2aa198": "#56b4e9",
+			"#859900": "#009e73",
+			"#b58900": "#f0e442",
+			"#cb4b16": "#e69f00",
+			"#dc322f": "#d55e00",
+			"#d33682": "#cc79a7",
+			"#6c71c4": "#cc79a7",
+		},
+		Fill: map[string]string{
+			"#268bd2": "#0072b2",
+			"#2aa198": "#56b4e9",
+			"#859900": "#009e73",
+			"#b58900": "#e69f00",
+			"#cb4b16": "#e69f00",
+			"#dc322f": "#d55e00",
+			"#d33682": "#cc79a7",
+			"#6c71c4": "#cc79a7",
+		},
+	},
+}
+
+var colorAttributeRegexp = regexp.MustCompile(`\b(bgcolor|fillcolor|fontcolor|pencolor|color)=("[^"]*"|[A-Za-z0-9#]+)`)
+var colorRegexp = regexp.MustCompile(`^(#[0-9a-fA-F]{6}([0-9a-fA-F]{2})?|[A-Za-z][A-Za-z0-9]*)$`)
+
+var templateActionRegexp = regexp.MustCompile(`{{.*?}}`)
+
+func stripTemplates(s string) string {
+	return templateActionRegexp.ReplaceAllString(s, "")
+}
+
+// replaceColor replaces a single color. Transparent colors are only replaced if they
+// are listed explicitly, the "*" key leaves them alone.
+func (t Theme) replaceColor(color string, colors map[string]string) string {
+	if !colorRegexp.MatchString(color) {
+		return color
+	}
+	lower := strings.ToLower(color)
+	if replacement, found := colors[lower]; found {
+		return replacement
+	}
+	if lower == "none" || lower == "transparent" {
+		return color
+	}
+	if replacement, found := colors["*"]; found {
+		return replacement
+	}
+	return color
+}
+
+// replaceColors replaces the colors of a Graphviz color list, ie. "red;0.3:blue".
+func (t Theme) replaceColors(value string, colors map[string]string) string {
+	if len(colors) == 0 {
+		return value
+	}
+	replace := func(list string) string {
+		items := strings.Split(list, ":")
+		for idx, item := range items {
+			// Colors in a list can be weighted
+			parts := strings.SplitN(item, ";", 2)
+			parts[0] = t.replaceColor(parts[0], colors)
+			items[idx] = strings.Join(parts, ";")
+		}
+		return strings.Join(items, ":")
+	}
+
+	// Only replace colors outside of template actions
+	var result strings.Builder
+	last := 0
+	for _, action := range templateActionRegexp.FindAllStringIndex(value, -1) {
+		result.WriteString(replace(value[last:action[0]]))
+		result.WriteString(value[action[0]:action[1]])
+		last = action[1]
+	}
+	result.WriteString(replace(value[last:]))
+	return result.String()
+}
+
+// apply recolors a comma separated Graphviz attribute list. Template actions inside
+// attribute values are left as they are.
+func (t Theme) apply(attributes string, filled bool) string {
+	fillReplaced := false
+	if filled {
+		for _, match := range colorAttributeRegexp.FindAllStringSubmatch(attributes, -1) {
+			value := stripTemplates(strings.Trim(match[2], "\""))
+			if match[1] == "fillcolor" && t.replaceColors(value, t.Fill) != value {
+				fillReplaced = true
+			}
+		}
+	}
+
+	return colorAttributeRegexp.ReplaceAllStringFunc(attributes, func(attribute string) string {
+		match := colorAttributeRegexp.FindStringSubmatch(attribute)
+		name, value := match[1], match[2]
+
+		var colors map[string]string
+		switch {
+		case name == "bgcolor":
+			if t.Canvas == "" {
+				return attribute
+			}
+			return fmt.Sprintf("%s=%q", name, t.Canvas)
+		case name == "fillcolor":
+			colors = t.Fill
+		case name == "fontcolor" && filled && !fillReplaced:
+			return attribute
+		case name == "color" && filled:
+			colors = t.Fill
+		default:
+			colors = t.Background
+		}
+
+		quoted := strings.HasPrefix(value, "\"")
+		value = t.replaceColors(strings.Trim(value, "\""), colors)
+		if quoted || strings.HasPrefix(value, "#") {
+			return fmt.Sprintf("%s=\"%s\"", name, value)
+		}
+		return fmt.Sprintf("%s=%s", name, value)
+	})
+}
+
+// ApplyTheme recolors all global, edge, node and conditional styles.
+func (style *GraphStyle) ApplyTheme(name string) error {
+	theme, found := Themes[name]
+	if !found {
+		themes := make([]string, 0, len(Themes))
+		for k := range Themes {
+			themes = append(themes, k)
+		}
+		sort.Strings(themes)
+		return fmt.Errorf("unknown theme %s (available: %s)", name, strings.Join(themes, ", "))
+	}
+
+	for k, v := range style.Global {
+		style.Global[k] = theme.apply(v, false)
+	}
+	for k, targets := range style.Edges {
+		for kk, v := range targets {
+			style.Edges[k][kk] = theme.apply(v, false)
+		}
+	}
+	for k, v := range style.Relations {
+		style.Relations[k] = theme.apply(v, false)
+	}
+	for k, v := range style.Nodes {
+		style.Nodes[k] = theme.apply(v, strings.Contains(v, "filled"))
+	}
+	for k, conditions := range style.Conditions {
+		filled := strings.Contains(style.Nodes[k], "filled")
+		for idx := range conditions {
+			style.Conditions[k][idx].Style = theme.apply(conditions[idx].Style, filled)
+		}
+	}
+	return nil
+}
+
+// Merge layers another style on top of this one. Individual global, option, edge,
+// relation and node entries are replaced, conditions are appended.
+func (style *GraphStyle) Merge(other GraphStyle) {
+	if style.Global == nil {
+		style.Global = make(map[string]string, len(other.Global))
+	}
+	for k, v := range other.Global {
+		style.Global[k] = v
+	}
+	if style.Options == nil {
+		style.Options = make(map[string]string, len(other.Options))
+	}
+	for k, v := range other.Options {
+		style.Options[k] = v
+	}
+	if style.Edges == nil {
+		style.Edges = make(map[string]map[string]string, len(other.Edges))
+	}
+	for k, targets := range other.Edges {
+		if _, found := style.Edges[k]; !found {
+			style.Edges[k] = make(map[string]string, len(targets))
+		}
+		for kk, v := range targets {
+			style.Edges[k][kk] = v
+		}
+	}
+	if style.Relations == nil {
+		style.Relations = make(map[string]string, len(other.Relations))
+	}
+	for k, v := range other.Relations {
+		style.Relations[k] = v
+	}
+	if style.Nodes == nil {
+		style.Nodes = make(map[string]string, len(other.Nodes))
+	}
+	for k, v := range other.Nodes {
+		style.Nodes[k] = v
+	}
+	if style.Conditions == nil {
+		style.Conditions = make(map[string][]NodeCondition, len(other.Conditions))
+	}
+	for k, conditions := range other.Conditions {
+		style.Conditions[k] = append(style.Conditions[k], conditions...)
+	}
+}
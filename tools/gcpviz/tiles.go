@@ -0,0 +1,434 @@
+package gcpviz
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Diagrams of large organizations can be split into partitions (tiles) by folder,
+// project or connected component. Each partition is written as its own DOT file and
+// edges to nodes in other partitions point to stub nodes, which link to the other
+// partition. An index page links all partitions.
+
+const (
+	PartitionByFolder    = "folder"
+	PartitionByProject   = "project"
+	PartitionByComponent = "component"
+)
+
+// Nodes above the partitions (ie. the organization and folders when partitioning by
+// project) are placed in their own partition, as are nodes without references when
+// partitioning by component
+const (
+	hierarchyPartition   = "hierarchy"
+	unconnectedPartition = "unconnected"
+)
+
+const stubNodeStyle = `shape=box,style="dashed,rounded",color="#93a1a1",fontcolor="#93a1a1"`
+
+var tileFileRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+var tileIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>body { font-family: sans-serif; } td, th { padding: 2px 12px; text-align: left; }</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+<table>
+<tr><th>Partition</th><th>Nodes</th><th>Edges</th><th>Edges to other partitions</th><th>Source</th></tr>
+{{- range .Tiles }}
+<tr><td><a href="{{ .Link }}">{{ .Title }}</a></td><td>{{ .Nodes }}</td><td>{{ .Edges }}</td><td>{{ .CrossEdges }}</td><td><a href="{{ .File }}">{{ .File }}</a></td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+// Tile is one partition of a diagram.
+type Tile struct {
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+	File       string `json:"file"`
+	Link       string `json:"link"`
+	Nodes      int    `json:"nodes"`
+	Edges      int    `json:"edges"`
+	CrossEdges int    `json:"cross_edges"`
+
+	nodes          []int64
+	edges          []tileEdge
+	stubs          map[int64]string
+	rendered       bytes.Buffer
+	layoutNodes    map[int64]layoutNode
+	maxFolderDepth int
+	order          int
+}
+
+type tileEdge struct {
+	user   string
+	used   string
+	userId int64
+	usedId int64
+}
+
+func isHierarchyAssetType(assetType string) bool {
+	return assetType == "cloudresourcemanager.googleapis.com/Organization" ||
+		assetType == "cloudresourcemanager.googleapis.com/Folder" ||
+		assetType == "cloudresourcemanager.googleapis.com/Project"
+}
+
+// tilePartition returns the partition of an asset when partitioning by folder or
+// project, based on its ancestors.
+func tilePartition(resource *TemplateResource, partitionBy string) string {
+	if len(resource.Ancestors) == 0 {
+		return hierarchyPartition
+	}
+	switch partitionBy {
+	case PartitionByProject:
+		for _, ancestor := range resource.Ancestors {
+			if strings.HasPrefix(ancestor, "projects/") {
+				return ancestor
+			}
+		}
+		return hierarchyPartition
+	case PartitionByFolder:
+		for _, ancestor := range resource.Ancestors {
+			if strings.HasPrefix(ancestor, "folders/") {
+				return ancestor
+			}
+		}
+		// Assets directly under the organization
+		return resource.Ancestors[len(resource.Ancestors)-1]
+	}
+	return hierarchyPartition
+}
+
+// tileTitle returns the display name of a partition.
+func (v *GcpViz) tileTitle(partition string) string {
+	switch partition {
+	case hierarchyPartition:
+		return "Resource hierarchy"
+	case unconnectedPartition:
+		return "Unconnected resources"
+	}
+	if strings.Contains(partition, "/") {
+		asset, err := v.getAsset(fmt.Sprintf("//cloudresourcemanager.googleapis.com/%s", partition))
+		if err == nil {
+			if title := stringField(asset.Resource.Data, "projectId"); title != "" {
+				return title
+			}
+			if title := stringField(asset.Resource.Data, "displayName"); title != "" {
+				return title
+			}
+		}
+	}
+	return partition
+}
+
+// stubLabel returns a short label for a node in another partition.
+func stubLabel(name string, resource *TemplateResource, tile *Tile) string {
+	short := GetLastPart(name)
+	if resource != nil {
+		for _, field := range []string{"displayName", "projectId", "name"} {
+			if value := stringField(resource.Resource.Data, field); value != "" {
+				short = value
+				break
+			}
+		}
+	}
+	if short == tile.Title {
+		return fmt.Sprintf("→ %s", tile.Title)
+	}
+	return fmt.Sprintf("%s\n→ %s", short, tile.Title)
+}
+
+// GenerateTiles runs the query and writes the result partitioned by folder, project or
+// connected component to dir: one DOT file per partition and an index.html page. The
+// index and stub nodes link to the partitions as SVG files with the same name as the
+// DOT files.
+func (v *GcpViz) GenerateTiles(ctx context.Context, gizmoQuery string, parameters map[string]interface{}, dir string, partitionBy string) error {
+	if partitionBy != PartitionByFolder && partitionBy != PartitionByProject && partitionBy != PartitionByComponent {
+		return fmt.Errorf("invalid partition %s, specify either folder, project or component", partitionBy)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	gizmoQ, err := v.prepareQuery(gizmoQuery, parameters)
+	if err != nil {
+		return err
+	}
+
+	// Collect the nodes of the query result
+	ids := make(map[string]int64, 0)
+	names := make([]string, 0)
+	addNode := func(name string, id int64) {
+		if _, found := ids[name]; !found && id != -1 {
+			ids[name] = id
+			names = append(names, name)
+		}
+	}
+	err = v.executeQuery(ctx, gizmoQ, func(result queryResult) error {
+		addNode(result.parent, result.parentId)
+		addNode(result.node, result.id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	resources := make(map[string]*TemplateResource, len(names))
+	for _, name := range names {
+		resource, err := v.getAsset(name)
+		if err != nil {
+			v.warn(PhaseNodes, "resource %s not found: %v", name, err)
+			continue
+		}
+		resources[name] = resource
+	}
+
+	edges := make([]tileEdge, 0)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		v.eachUser(name, func(user string, userId int64) {
+			if _, found := ids[user]; found && resources[user] != nil && resources[name] != nil {
+				edges = append(edges, tileEdge{user: user, used: name, userId: userId, usedId: ids[name]})
+			}
+		})
+	}
+
+	partitions := make(map[string]string, len(names))
+	order := make(map[string]int, 0)
+	if partitionBy == PartitionByComponent {
+		partitions, order = componentPartitions(names, resources, edges)
+	} else {
+		for name, resource := range resources {
+			partitions[name] = tilePartition(resource, partitionBy)
+		}
+	}
+
+	tiles := make(map[string]*Tile, 0)
+	for _, name := range names {
+		partition, found := partitions[name]
+		if !found {
+			continue
+		}
+		tile, found := tiles[partition]
+		if !found {
+			file := tileFileRegexp.ReplaceAllString(strings.ReplaceAll(partition, "/", "-"), "_") + ".gv"
+			tile = &Tile{Name: partition, Title: v.tileTitle(partition), File: file, Link: strings.TrimSuffix(file, ".gv") + ".svg", stubs: make(map[int64]string, 0), order: order[partition]}
+			tiles[partition] = tile
+		}
+		tile.nodes = append(tile.nodes, ids[name])
+	}
+
+	// First pass, render nodes to learn which nodes are shown
+	progress := v.newProgressCounter(PhaseNodes, "Rendering partitions", "partitions", int64(len(tiles)), 1)
+	rendered := make(map[int64]bool, len(names))
+	nodeNames := make(map[int64]string, len(names))
+	for name, id := range ids {
+		nodeNames[id] = name
+	}
+	for _, tile := range tiles {
+		v.layoutNodes = make(map[int64]layoutNode, 0)
+		v.maxFolderDepth = 0
+		for _, id := range tile.nodes {
+			ok, err := v.renderNode(&tile.rendered, nodeNames[id], id)
+			if err != nil {
+				v.warn(PhaseNodes, "failed to render node %s: %v", nodeNames[id], err)
+			}
+			if ok {
+				rendered[id] = true
+				tile.Nodes++
+			}
+		}
+		tile.layoutNodes, tile.maxFolderDepth = v.layoutNodes, v.maxFolderDepth
+	}
+
+	for _, edge := range edges {
+		if !rendered[edge.userId] || !rendered[edge.usedId] {
+			continue
+		}
+		userTile, usedTile := tiles[partitions[edge.user]], tiles[partitions[edge.used]]
+		userTile.edges = append(userTile.edges, edge)
+		if userTile == usedTile {
+			userTile.Edges++
+			continue
+		}
+		userTile.stubs[edge.usedId] = usedTile.Name
+		usedTile.stubs[edge.userId] = userTile.Name
+		usedTile.edges = append(usedTile.edges, edge)
+		userTile.CrossEdges++
+		usedTile.CrossEdges++
+	}
+
+	// Second pass, write partitions with stubs and edges
+	sortedTiles := make([]*Tile, 0, len(tiles))
+	for _, tile := range tiles {
+		sortedTiles = append(sortedTiles, tile)
+	}
+	sort.Slice(sortedTiles, func(i, j int) bool {
+		if sortedTiles[i].order != sortedTiles[j].order {
+			return sortedTiles[i].order < sortedTiles[j].order
+		}
+		if sortedTiles[i].Title != sortedTiles[j].Title {
+			return sortedTiles[i].Title < sortedTiles[j].Title
+		}
+		return sortedTiles[i].Name < sortedTiles[j].Name
+	})
+	for _, tile := range sortedTiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := v.writeTile(tile, tiles, resources, nodeNames, parameters, dir); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("writing partition %s", tile.Name))
+		}
+		progress.Add(1)
+	}
+	progress.Done()
+
+	// The title parameter is escaped for use in DOT
+	title, _ := parameters["Title"].(string)
+	if unquoted, err := strconv.Unquote(title); err == nil {
+		title = unquoted
+	}
+	if title == "" {
+		title = "Partitions"
+	}
+	index, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	return tileIndexTemplate.Execute(index, map[string]interface{}{"Title": title, "Tiles": sortedTiles})
+}
+
+func (v *GcpViz) writeTile(tile *Tile, tiles map[string]*Tile, resources map[string]*TemplateResource, nodeNames map[int64]string, parameters map[string]interface{}, dir string) error {
+	f, err := os.Create(filepath.Join(dir, tile.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := bufio.NewWriter(f)
+
+	tileParameters := make(map[string]interface{}, len(parameters))
+	for k, value := range parameters {
+		tileParameters[k] = value
+	}
+	tileParameters["Title"] = v.EscapeLabel(tile.Title)
+	if err := v.writeGraphHeader(out, tileParameters); err != nil {
+		return err
+	}
+	out.Write(tile.rendered.Bytes())
+
+	stubs := make([]int64, 0, len(tile.stubs))
+	for id := range tile.stubs {
+		stubs = append(stubs, id)
+	}
+	sort.Slice(stubs, func(i, j int) bool { return stubs[i] < stubs[j] })
+	for _, id := range stubs {
+		other := tiles[tile.stubs[id]]
+		label := stubLabel(nodeNames[id], resources[nodeNames[id]], other)
+		fmt.Fprintf(out, "  N_%d [label=%s,URL=%s,%s];\n", id, v.EscapeLabel(label), v.EscapeLabel(other.Link), stubNodeStyle)
+	}
+
+	v.layoutNodes, v.maxFolderDepth = tile.layoutNodes, tile.maxFolderDepth
+	for _, edge := range tile.edges {
+		// Ignore errors, because some resources might be missing
+		v.renderEdge(edge.user, edge.used, edge.userId, edge.usedId, out)
+	}
+	v.writeLayoutRanks(out)
+	fmt.Fprintf(out, "}\n")
+	return out.Flush()
+}
+
+// componentPartitions partitions the nodes by connected components of the references
+// between them, largest first. The resource hierarchy would connect everything, so
+// organizations, folders and projects are placed in their own partition. Label
+// vertexes would connect all resources with the same label, so they are placed with
+// the unconnected resources. It also returns the order of the partitions.
+func componentPartitions(names []string, resources map[string]*TemplateResource, edges []tileEdge) (map[string]string, map[string]int) {
+	parents := make(map[string]string, len(names))
+	var find func(name string) string
+	find = func(name string) string {
+		if parents[name] == name {
+			return name
+		}
+		parents[name] = find(parents[name])
+		return parents[name]
+	}
+
+	for name, resource := range resources {
+		if !isHierarchyAssetType(resource.AssetType) && resource.AssetType != labelAssetType {
+			parents[name] = name
+		}
+	}
+	for _, edge := range edges {
+		if _, found := parents[edge.user]; !found {
+			continue
+		}
+		if _, found := parents[edge.used]; !found {
+			continue
+		}
+		user, used := find(edge.user), find(edge.used)
+		if user < used {
+			parents[used] = user
+		} else {
+			parents[user] = used
+		}
+	}
+
+	members := make(map[string][]string, 0)
+	for name := range parents {
+		root := find(name)
+		members[root] = append(members[root], name)
+	}
+	roots := make([]string, 0, len(members))
+	for root := range members {
+		roots = append(roots, root)
+	}
+	// Largest components first
+	sort.Slice(roots, func(i, j int) bool {
+		if len(members[roots[i]]) != len(members[roots[j]]) {
+			return len(members[roots[i]]) > len(members[roots[j]])
+		}
+		return roots[i] < roots[j]
+	})
+
+	partitions := make(map[string]string, len(names))
+	order := map[string]int{hierarchyPartition: 0, unconnectedPartition: len(roots) + 1}
+	for idx, root := range roots {
+		partition := unconnectedPartition
+		if len(members[root]) > 1 {
+			partition = fmt.Sprintf("component-%d", idx+1)
+			order[partition] = idx + 1
+		}
+		for _, name := range members[root] {
+			partitions[name] = partition
+		}
+	}
+	for name, resource := range resources {
+		switch {
+		case isHierarchyAssetType(resource.AssetType):
+			partitions[name] = hierarchyPartition
+		case resource.AssetType == labelAssetType:
+			partitions[name] = unconnectedPartition
+		}
+	}
+	return partitions, order
+}
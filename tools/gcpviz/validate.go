@@ -0,0 +1,407 @@
+package gcpviz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+
+	// Number of assets per asset type that templates are executed against
+	validateSamplesPerType = 20
+)
+
+var assetTypeRegexp = regexp.MustCompile(`^([a-z0-9-]+\.)*(googleapis\.com|k8s\.io|gcpviz)/[A-Z][A-Za-z0-9]*$`)
+
+var labelKeys = map[string]bool{
+	"label":     true,
+	"headLabel": true,
+	"tailLabel": true,
+	"link":      true,
+}
+
+type ConfigProblem struct {
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+type configValidator struct {
+	viz      *GcpViz
+	problems []ConfigProblem
+}
+
+func (c *configValidator) add(severity string, file string, path string, format string, args ...interface{}) {
+	c.problems = append(c.problems, ConfigProblem{Severity: severity, File: file, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *configValidator) checkAssetType(file string, path string, assetType string) {
+	if !assetTypeRegexp.MatchString(assetType) {
+		c.add(SeverityError, file, path, "%q is not a valid asset type name", assetType)
+	}
+}
+
+func (c *configValidator) checkJsonPath(file string, path string, jsonPath string) {
+	if !strings.HasPrefix(jsonPath, "$") {
+		c.add(SeverityError, file, path, "JSONPath %q must start with $", jsonPath)
+	}
+}
+
+func decodeStrict(fileName string, out interface{}) error {
+	yamlFile, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(yamlFile))
+	dec.KnownFields(true)
+	err = dec.Decode(out)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// ValidateConfig checks the relations, labels and style files against their schema
+// and executes the parsed templates against sample assets from the graph (if one
+// has been loaded).
+func (v *GcpViz) ValidateConfig(relationsFile string, labelsFile string, styleFiles []string) ([]ConfigProblem, error) {
+	c := &configValidator{viz: v}
+
+	var relations RawResourceRelations
+	if err := decodeStrict(relationsFile, &relations); err != nil {
+		c.add(SeverityError, relationsFile, "", "%v", err)
+	}
+	for assetType := range relations.AssetTypes {
+		path := fmt.Sprintf("asset_types.%s", assetType)
+		c.checkAssetType(relationsFile, path, assetType)
+		for _, jsonPath := range relations.AssetTypes[assetType] {
+			c.checkJsonPath(relationsFile, path, jsonPath.Path)
+			if err := checkRelationName(jsonPath.Relation); err != nil {
+				c.add(SeverityError, relationsFile, path, "%v", err)
+			}
+		}
+	}
+	for assetType := range relations.Aliases {
+		path := fmt.Sprintf("aliases.%s", assetType)
+		c.checkAssetType(relationsFile, path, assetType)
+		for _, jsonPath := range relations.Aliases[assetType] {
+			c.checkJsonPath(relationsFile, path, jsonPath)
+		}
+	}
+	for assetType := range relations.IpAddresses {
+		path := fmt.Sprintf("ip_addresses.%s", assetType)
+		c.checkAssetType(relationsFile, path, assetType)
+		for _, jsonPath := range relations.IpAddresses[assetType] {
+			c.checkJsonPath(relationsFile, path, jsonPath)
+		}
+	}
+	for assetType, fields := range relations.Enrich {
+		path := fmt.Sprintf("enrich.%s", assetType)
+		c.checkAssetType(relationsFile, path, assetType)
+		for field, subAssets := range fields {
+			for subAssetType, jsonPath := range subAssets {
+				subPath := fmt.Sprintf("%s.%s.%s", path, field, subAssetType)
+				c.checkAssetType(relationsFile, subPath, subAssetType)
+				c.checkJsonPath(relationsFile, subPath, jsonPath)
+			}
+		}
+	}
+
+	for assetType, fields := range relations.Computed {
+		path := fmt.Sprintf("computed.%s", assetType)
+		c.checkAssetType(relationsFile, path, assetType)
+		for field, computed := range fields {
+			fieldPath := fmt.Sprintf("%s.%s", path, field)
+			if err := computed.check(); err != nil {
+				c.add(SeverityError, relationsFile, fieldPath, "%v", err)
+			}
+			for _, subAssetType := range computed.AssetTypes {
+				c.checkAssetType(relationsFile, fieldPath, subAssetType)
+			}
+			if computed.Path != "" {
+				c.checkJsonPath(relationsFile, fieldPath, computed.Path)
+			}
+		}
+	}
+
+	var labels map[string]map[string]string
+	if err := decodeStrict(labelsFile, &labels); err != nil {
+		c.add(SeverityError, labelsFile, "", "%v", err)
+	}
+	for assetType := range labels {
+		c.checkAssetType(labelsFile, assetType, assetType)
+		for key := range labels[assetType] {
+			if !labelKeys[key] {
+				c.add(SeverityError, labelsFile, fmt.Sprintf("%s.%s", assetType, key), "unknown key %q (expected label, headLabel, tailLabel or link)", key)
+			}
+		}
+		if label, ok := labels[assetType]["label"]; ok && label != "" {
+			if _, found := c.viz.Nodes[assetType]; !found {
+				c.add(SeverityError, labelsFile, assetType, "has a label but no node style in %s, assets of this type will not be rendered", strings.Join(styleFiles, ", "))
+			}
+		}
+	}
+
+	var style GraphStyle
+	for _, styleFile := range styleFiles {
+		var layer GraphStyle
+		if err := decodeStrict(styleFile, &layer); err != nil {
+			c.add(SeverityError, styleFile, "", "%v", err)
+		}
+		for assetType := range layer.Nodes {
+			c.checkAssetType(styleFile, fmt.Sprintf("nodes.%s", assetType), assetType)
+		}
+		for parentType, targets := range layer.Edges {
+			c.checkAssetType(styleFile, fmt.Sprintf("edges.%s", parentType), parentType)
+			for targetType := range targets {
+				c.checkAssetType(styleFile, fmt.Sprintf("edges.%s.%s", parentType, targetType), targetType)
+			}
+		}
+		for relation := range layer.Relations {
+			if err := checkRelationName(relation); err != nil {
+				c.add(SeverityError, styleFile, fmt.Sprintf("relations.%s", relation), "%v", err)
+			}
+		}
+		for assetType, conditions := range layer.Conditions {
+			path := fmt.Sprintf("conditions.%s", assetType)
+			if assetType != "*" {
+				c.checkAssetType(styleFile, path, assetType)
+			}
+			for idx, condition := range conditions {
+				if strings.TrimSpace(condition.When) == "" {
+					c.add(SeverityError, styleFile, fmt.Sprintf("%s[%d]", path, idx), "condition is missing when")
+				}
+			}
+		}
+		style.Merge(layer)
+	}
+	styleFile := strings.Join(styleFiles, ", ")
+	for assetType := range style.Nodes {
+		if _, found := labels[assetType]; !found {
+			c.add(SeverityError, styleFile, fmt.Sprintf("nodes.%s", assetType), "has a node style but no label in %s, assets of this type will not be rendered", labelsFile)
+		}
+	}
+	for parentType, targets := range style.Edges {
+		for targetType := range targets {
+			if _, found := style.Nodes[targetType]; !found {
+				c.add(SeverityWarning, styleFile, fmt.Sprintf("edges.%s.%s", parentType, targetType), "target asset type has no node style")
+			}
+		}
+	}
+	for assetType := range style.Conditions {
+		if _, found := style.Nodes[assetType]; !found && assetType != "*" {
+			c.add(SeverityWarning, styleFile, fmt.Sprintf("conditions.%s", assetType), "conditions for asset type without node style are never evaluated")
+		}
+	}
+
+	if v.AssetDatabase != nil {
+		samples, err := v.sampleAssets(validateSamplesPerType)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching sample assets")
+		}
+		v.validateTemplates(c, samples, labelsFile, styleFile)
+
+		configured := make(map[string]bool, 0)
+		for assetType := range relations.AssetTypes {
+			configured[assetType] = true
+		}
+		for assetType := range labels {
+			configured[assetType] = true
+		}
+		for assetType := range style.Nodes {
+			configured[assetType] = true
+		}
+		for assetType := range configured {
+			if _, found := samples[assetType]; found {
+				continue
+			}
+			for existingType := range samples {
+				if levenshtein(strings.ToLower(assetType), strings.ToLower(existingType)) <= 2 {
+					c.add(SeverityWarning, "", assetType, "asset type does not occur in the graph, did you mean %s?", existingType)
+				}
+			}
+		}
+		for assetType := range samples {
+			if _, found := labels[assetType]; !found {
+				c.add(SeverityWarning, labelsFile, assetType, "asset type occurs in the graph but has no label")
+			}
+		}
+	}
+
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		if c.problems[i].File != c.problems[j].File {
+			return c.problems[i].File < c.problems[j].File
+		}
+		if c.problems[i].Path != c.problems[j].Path {
+			return c.problems[i].Path < c.problems[j].Path
+		}
+		return c.problems[i].Message < c.problems[j].Message
+	})
+	return c.problems, nil
+}
+
+func (v *GcpViz) sampleAssets(perType int) (map[string][]*TemplateResource, error) {
+	samples := make(map[string][]*TemplateResource, 0)
+
+	tx, err := v.AssetDatabase.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+		var templateResource TemplateResource
+		err := json.Unmarshal(bv, &templateResource)
+		if err != nil {
+			return errors.Wrapf(err, "unmarshaling asset %s", string(bk))
+		}
+		if len(samples[templateResource.AssetType]) < perType {
+			samples[templateResource.AssetType] = append(samples[templateResource.AssetType], &templateResource)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// checkTemplate executes a template against all samples. Execution errors are
+// reported once per template, and fields that are missing from every sample are
+// reported as warnings.
+func (c *configValidator) checkTemplate(file string, path string, tmpl *template.Template, samples []interface{}) {
+	if tmpl == nil || len(samples) == 0 {
+		return
+	}
+	tmpl, err := c.viz.bindTemplate(tmpl)
+	if err != nil {
+		return
+	}
+	strict, err := tmpl.Clone()
+	if err != nil {
+		return
+	}
+	strict.Option("missingkey=error")
+
+	var missingErr error
+	missing := 0
+	for _, sample := range samples {
+		if err := tmpl.Execute(ioutil.Discard, sample); err != nil {
+			c.add(SeverityError, file, path, "template execution failed: %v", err)
+			return
+		}
+		if err := strict.Execute(ioutil.Discard, sample); err != nil {
+			missingErr = err
+			missing++
+		}
+	}
+	if missing == len(samples) {
+		c.add(SeverityWarning, file, path, "template references fields missing from all %d sample assets: %v", len(samples), missingErr)
+	}
+}
+
+func (v *GcpViz) validateTemplates(c *configValidator, samples map[string][]*TemplateResource, labelsFile string, styleFile string) {
+	var allNodeStyles []interface{}
+	for assetType := range samples {
+		resources := make([]interface{}, len(samples[assetType]))
+		nodeStyles := make([]interface{}, len(samples[assetType]))
+		for idx, resource := range samples[assetType] {
+			resource.Metrics = v.metricsFor(resource)
+			resources[idx] = resource
+			nodeStyles[idx] = NodeStyle{Resource: &resource.Resource, Planned: resource.Planned, Metrics: resource.Metrics, Label: `"label"`, Link: `"link"`}
+		}
+		allNodeStyles = append(allNodeStyles, nodeStyles...)
+
+		c.checkTemplate(labelsFile, fmt.Sprintf("%s.label", assetType), v.Labels[assetType], resources)
+		c.checkTemplate(labelsFile, fmt.Sprintf("%s.headLabel", assetType), v.HeadLabels[assetType], resources)
+		c.checkTemplate(labelsFile, fmt.Sprintf("%s.tailLabel", assetType), v.TailLabels[assetType], resources)
+		c.checkTemplate(labelsFile, fmt.Sprintf("%s.link", assetType), v.Links[assetType], resources)
+		c.checkTemplate(styleFile, fmt.Sprintf("nodes.%s", assetType), v.Nodes[assetType], nodeStyles)
+		for idx, condition := range v.Conditions[assetType] {
+			c.checkTemplate(styleFile, fmt.Sprintf("conditions.%s[%d].when", assetType, idx), condition.When, nodeStyles)
+			c.checkTemplate(styleFile, fmt.Sprintf("conditions.%s[%d].style", assetType, idx), condition.Style, nodeStyles)
+		}
+	}
+
+	if len(allNodeStyles) > 0 {
+		for idx, condition := range v.Conditions["*"] {
+			c.checkTemplate(styleFile, fmt.Sprintf("conditions.*[%d].when", idx), condition.When, allNodeStyles)
+			c.checkTemplate(styleFile, fmt.Sprintf("conditions.*[%d].style", idx), condition.Style, allNodeStyles)
+		}
+	}
+
+	edgeSample := []interface{}{NodeStyle{HeadLabel: `"head"`, TailLabel: `"tail"`, Relation: "uses"}}
+	for parentType, targets := range v.Edges {
+		for targetType, tmpl := range targets {
+			c.checkTemplate(styleFile, fmt.Sprintf("edges.%s.%s", parentType, targetType), tmpl, edgeSample)
+		}
+	}
+	for relation, tmpl := range v.RelationEdges {
+		c.checkTemplate(styleFile, fmt.Sprintf("relations.%s", relation), tmpl, edgeSample)
+	}
+
+	globalSample := []interface{}{map[string]interface{}{"Title": `"title"`, "Organizations": []string{}}}
+	for k, s := range v.Style.Global {
+		styleTemplate, err := template.New("style").Parse(s)
+		if err != nil {
+			c.add(SeverityError, styleFile, fmt.Sprintf("global.%s", k), "error parsing style template: %v", err)
+			continue
+		}
+		c.checkTemplate(styleFile, fmt.Sprintf("global.%s", k), styleTemplate, globalSample)
+	}
+}
+
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// WriteConfigProblems writes validation results in human readable form.
+func WriteConfigProblems(out io.Writer, problems []ConfigProblem) {
+	for _, p := range problems {
+		location := p.File
+		if p.Path != "" {
+			if location != "" {
+				location = fmt.Sprintf("%s: %s", location, p.Path)
+			} else {
+				location = p.Path
+			}
+		}
+		fmt.Fprintf(out, "%s: %s: %s\n", p.Severity, location, p.Message)
+	}
+}
@@ -0,0 +1,564 @@
+package gcpviz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/cayleygraph/cayley"
+	"github.com/cayleygraph/cayley/graph"
+	cquad "github.com/cayleygraph/quad"
+	"github.com/pkg/errors"
+)
+
+// Cloud Asset Inventory feeds publish every change of an asset as a TemporalAsset to
+// Pub/Sub. In watch mode, the changes are applied to the assets of a generated graph
+// file in batches. Instead of creating the whole graph again, the references of the
+// changed assets and of the assets using them are created again, together with the
+// links of Kubernetes objects and on-premises sites that changed and the subassets
+// incorporated into the assets they use. IP address links, IP address usage and
+// computed fields depend on many assets, so they are still calculated from all
+// assets of the types involved. The graph is the same as if it had been generated
+// from an export taken after the changes.
+
+const (
+	// Maximum number of changes applied at once, and the time to wait before pulling
+	// again when there were none
+	watchBatchSize    = 1000
+	watchPollInterval = 5 * time.Second
+	// Time to acknowledge saved changes, even after the watch was stopped
+	watchAckTimeout = 10 * time.Second
+)
+
+// AssetChange is a change of an asset read from a TemporalAsset. Asset is the asset
+// in the format of Cloud Asset Inventory exports, or nil if it was deleted. Time is
+// the start of the window of the change, when the asset was deleted.
+type AssetChange struct {
+	Name      string
+	AssetType string
+	Deleted   bool
+	Asset     []byte
+	Time      time.Time
+}
+
+// snakeCase converts a field name from the JSON representation of protobufs used by
+// feeds (assetType) to the one of exports (asset_type).
+func snakeCase(name string) string {
+	var b strings.Builder
+	for idx, r := range name {
+		if unicode.IsUpper(r) {
+			if idx > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func snakeCaseKeys(m map[string]interface{}) map[string]interface{} {
+	converted := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		converted[snakeCase(key)] = value
+	}
+	return converted
+}
+
+// ParseAssetChange parses a TemporalAsset in JSON format, as published by feeds.
+func ParseAssetChange(data []byte) (*AssetChange, error) {
+	var temporalAsset struct {
+		Asset   map[string]interface{} `json:"asset"`
+		Deleted bool                   `json:"deleted"`
+		Window  struct {
+			StartTime string `json:"startTime"`
+		} `json:"window"`
+	}
+	if err := json.Unmarshal(data, &temporalAsset); err != nil {
+		return nil, errors.Wrap(err, "parsing temporal asset")
+	}
+	if temporalAsset.Asset == nil {
+		return nil, errors.New("temporal asset without an asset")
+	}
+
+	// Only the fields of the asset and its resource are converted, not the data
+	asset := snakeCaseKeys(temporalAsset.Asset)
+	if resource, ok := asset["resource"].(map[string]interface{}); ok {
+		asset["resource"] = snakeCaseKeys(resource)
+	}
+	change := &AssetChange{
+		Name:      stringField(asset, "name"),
+		AssetType: stringField(asset, "asset_type"),
+		Deleted:   temporalAsset.Deleted,
+		Time:      parseUpdateTime(temporalAsset.Window.StartTime),
+	}
+	if change.Name == "" {
+		return nil, errors.New("temporal asset without an asset name")
+	}
+	if !change.Deleted {
+		jsn, err := json.Marshal(asset)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshaling to json")
+		}
+		change.Asset = jsn
+	}
+	return change, nil
+}
+
+// graphUpdate tracks the assets affected by a batch of changes. A nil update, when
+// generating a graph, affects all assets.
+type graphUpdate struct {
+	// Assets added, replaced or deleted by the changes
+	changed map[string]bool
+	// Changed assets and the assets using them, whose references are created again
+	affected map[string]bool
+	// Assets used by affected assets, whose subassets are incorporated again
+	enriched map[string]bool
+	// Label vertexes affected assets were linked to
+	labels map[string]bool
+}
+
+func (u *graphUpdate) changedAssets() map[string]bool {
+	if u == nil {
+		return nil
+	}
+	return u.changed
+}
+
+func (u *graphUpdate) enrichedAssets() map[string]bool {
+	if u == nil {
+		return nil
+	}
+	return u.enriched
+}
+
+func (u *graphUpdate) isAffected(name string) bool {
+	return u == nil || u.affected[name]
+}
+
+// linksIps tells whether an IP address link from user to used is created. Unaffected
+// assets did not use any of the changed assets before, so only links to those are new.
+func (u *graphUpdate) linksIps(user string, used string) bool {
+	return u == nil || u.affected[user] || u.changed[used]
+}
+
+func sortedNames(m map[string]bool) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forEachAssetIn calls fn for the assets in names, or for all assets if names is nil.
+func forEachAssetIn(tx *bolt.Tx, names map[string]bool, fn func(k, v []byte) error) error {
+	assets := tx.Bucket([]byte("Assets"))
+	if names == nil {
+		return assets.ForEach(fn)
+	}
+	for _, name := range sortedNames(names) {
+		if bv := assets.Get([]byte(name)); bv != nil {
+			if err := fn([]byte(name), bv); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sameJson(a interface{}, b interface{}) bool {
+	jsnA, errA := json.Marshal(a)
+	jsnB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(jsnA, jsnB)
+}
+
+// quadsOf returns the quads with value in direction.
+func (v *GcpViz) quadsOf(direction cquad.Direction, value string) []cquad.Quad {
+	ref := v.QS.ValueOf(cquad.String(value))
+	if ref == nil {
+		return nil
+	}
+	it := v.QS.QuadIterator(direction, ref)
+	defer it.Close()
+
+	quads := make([]cquad.Quad, 0)
+	for it.Next(context.Background()) {
+		quads = append(quads, v.QS.Quad(it.Result()))
+	}
+	return quads
+}
+
+// affect removes the edges created from an asset, except to its children, so that
+// its references are created again.
+func (v *GcpViz) affect(name string) {
+	if v.update == nil || v.update.affected[name] {
+		return
+	}
+	v.update.affected[name] = true
+	for _, q := range v.quadsOf(cquad.Subject, name) {
+		switch quadValue(q.Predicate) {
+		case "child":
+			continue
+		case "uses":
+			v.update.enriched[quadValue(q.Object)] = true
+			v.TotalEdges--
+		case "labelled":
+			v.update.labels[quadValue(q.Object)] = true
+		}
+		v.QW.RemoveQuad(q)
+	}
+}
+
+// affectUsers affects the assets using vertex.
+func (v *GcpViz) affectUsers(vertex string) {
+	for _, q := range v.quadsOf(cquad.Object, vertex) {
+		if quadValue(q.Predicate) == "uses" {
+			v.affect(quadValue(q.Subject))
+		}
+	}
+}
+
+// affectAliasUsers affects the assets that could not resolve a new alias before. Their
+// references are to the alias, or to the alias prefixed with their service.
+func (v *GcpViz) affectAliasUsers(vertex string) {
+	if v.update == nil {
+		return
+	}
+	v.affectUsers(vertex)
+	services := make(map[string]bool, 0)
+	for assetType := range v.Relations.AssetTypes {
+		service := strings.SplitN(assetType, "/", 2)[0]
+		if !services[service] {
+			services[service] = true
+			v.affectUsers(fmt.Sprintf("//%s/%s", service, vertex))
+		}
+	}
+}
+
+// addEnrichedAssets adds the assets that affected assets use after creating their
+// references again.
+func (v *GcpViz) addEnrichedAssets() {
+	if v.update == nil {
+		return
+	}
+	for name := range v.update.affected {
+		for _, q := range v.quadsOf(cquad.Subject, name) {
+			if quadValue(q.Predicate) == "uses" {
+				v.update.enriched[quadValue(q.Object)] = true
+			}
+		}
+	}
+}
+
+// Update opens a generated graph file to apply changes to with ApplyChanges. Like
+// when generating, the changes are made to a copy that replaces dbFile when saved, so
+// that the graph file stays intact if applying them fails.
+func (v *GcpViz) Update(dbFile string) error {
+	if _, err := os.Stat(dbFile); err != nil {
+		return err
+	}
+	v.dbFile = dbFile
+	v.tmpFile = dbFile + ".tmp"
+	if err := copyFile(dbFile, v.tmpFile); err != nil {
+		return err
+	}
+	db, err := bolt.Open(v.tmpFile, 0600, nil)
+	if err != nil {
+		return err
+	}
+	v.AssetDatabase = db
+
+	// The graph of a previous batch may have been changed after it was saved
+	qs, _ := graph.NewQuadStore("memstore", "", nil)
+	qw, _ := graph.NewQuadWriter("single", qs, nil)
+	v.QS, v.QW = qs, qw
+	v.OrgRoots = nil
+	return db.View(func(tx *bolt.Tx) error {
+		if err := v.readGraph(tx); err != nil {
+			return err
+		}
+		v.TotalVertexes = int64(tx.Bucket([]byte("Assets")).Stats().KeyN)
+		v.TotalAliases = int64(tx.Bucket([]byte("Aliases")).Stats().KeyN)
+		v.TotalEdges = 0
+		it := v.QS.QuadsAllIterator()
+		defer it.Close()
+		for it.Next(context.Background()) {
+			if predicate := quadValue(v.QS.Quad(it.Result()).Predicate); predicate == "uses" || predicate == "child" {
+				v.TotalEdges++
+			}
+		}
+		return nil
+	})
+}
+
+func (v *GcpViz) openReadOnly(dbFile string) error {
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	v.AssetDatabase = db
+	return nil
+}
+
+// ApplyChanges adds, replaces or deletes the changed assets in the graph file opened
+// with Update and creates the references of the changed assets and the assets using
+// them again. Changes older than the asset in the graph are ignored. Deleted assets
+// are kept as tombstones with the time they were deleted, so that changes to them
+// that arrive late are ignored as well. Call Save afterwards.
+func (v *GcpViz) ApplyChanges(ctx context.Context, changes []*AssetChange) error {
+	v.update = &graphUpdate{
+		changed:  make(map[string]bool, 0),
+		affected: make(map[string]bool, 0),
+		enriched: make(map[string]bool, 0),
+		labels:   make(map[string]bool, 0),
+	}
+	defer func() { v.update = nil }()
+	v.Report = nil
+	v.TotalIps, v.TotalDuplicates, v.TotalCrossOrg = 0, 0, 0
+
+	tx, err := v.AssetDatabase.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tombstones, err := tx.CreateBucketIfNotExists([]byte("Tombstones"))
+	if err != nil {
+		return err
+	}
+
+	// Versions of the assets before the changes, nil for new assets
+	previous := make(map[string][]byte, 0)
+	deleted, stale := 0, 0
+	for _, change := range changes {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		existing := tx.Bucket([]byte("Assets")).Get([]byte(change.Name))
+		if _, found := previous[change.Name]; !found {
+			previous[change.Name] = append([]byte(nil), existing...)
+		}
+		deletedAt := parseUpdateTime(string(tombstones.Get([]byte(change.Name))))
+		if change.Deleted {
+			if !change.Time.After(deletedAt) {
+				stale++
+				continue
+			}
+			if existing != nil {
+				var resource TemplateResource
+				if err = json.Unmarshal(existing, &resource); err != nil {
+					return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", change.Name))
+				}
+				if parseUpdateTime(resource.UpdateTime).After(change.Time) {
+					stale++
+					continue
+				}
+				if err = tx.Bucket([]byte("Assets")).Delete([]byte(change.Name)); err != nil {
+					return err
+				}
+				v.QW.RemoveQuad(cayley.Quad(resource.Resource.Parent, "child", change.Name, resource.AssetType))
+				v.TotalVertexes--
+				v.TotalEdges--
+				deleted++
+			}
+			if err = tombstones.Put([]byte(change.Name), []byte(change.Time.Format(time.RFC3339Nano))); err != nil {
+				return err
+			}
+			continue
+		}
+		pbAsset, resource, err := v.parseJsonAsset(change.Asset)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("parsing changed asset %s", change.Name))
+		}
+		if !deletedAt.IsZero() {
+			if !updateTimeOf(resource).After(deletedAt) {
+				stale++
+				continue
+			}
+			if err = tombstones.Delete([]byte(change.Name)); err != nil {
+				return err
+			}
+		}
+		if err = v.AddAsset(tx, *pbAsset, resource); err != nil {
+			return err
+		}
+	}
+
+	versions := make([][]byte, 0)
+	for name, before := range previous {
+		after := tx.Bucket([]byte("Assets")).Get([]byte(name))
+		if bytes.Equal(before, after) {
+			continue
+		}
+		v.update.changed[name] = true
+		for _, version := range [][]byte{before, after} {
+			if version != nil {
+				versions = append(versions, append([]byte(nil), version...))
+			}
+		}
+	}
+
+	// Aliases of changed assets are created again
+	staleAliases := make([][]byte, 0)
+	err = tx.Bucket([]byte("Aliases")).ForEach(func(k, bv []byte) error {
+		if v.update.changed[string(bv)] {
+			staleAliases = append(staleAliases, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range staleAliases {
+		if err = tx.Bucket([]byte("Aliases")).Delete(k); err != nil {
+			return err
+		}
+		v.TotalAliases--
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseWatch, Message: fmt.Sprintf("Applied %d changes, %d assets changed, %d deleted, %d outdated changes ignored.", len(changes), len(v.update.changed), deleted, stale)})
+
+	rootsChanged := false
+	for _, version := range versions {
+		var resource TemplateResource
+		if err = json.Unmarshal(version, &resource); err != nil {
+			return errors.Wrap(err, "unmarshaling changed asset")
+		}
+		switch resource.AssetType {
+		case tagBindingAssetType:
+			// Resources are linked to their tag values by the bindings
+			v.affect(stringField(resource.Resource.Data, "parent"))
+		case "cloudresourcemanager.googleapis.com/Organization", "cloudresourcemanager.googleapis.com/Folder", "cloudresourcemanager.googleapis.com/Project":
+			rootsChanged = true
+		}
+	}
+	for _, name := range sortedNames(v.update.changed) {
+		v.affect(name)
+		v.affectUsers(name)
+		v.update.enriched[name] = true
+	}
+	if rootsChanged {
+		if err = v.resolveOrgRoots(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err = v.EnrichAssets(ctx); err != nil {
+		return err
+	}
+	v.progress(ProgressEvent{Phase: PhaseWatch, Message: fmt.Sprintf("Created references of %d of %d assets again.", len(v.update.affected), v.TotalVertexes)})
+	return nil
+}
+
+// resolveOrgRoots finds the roots of the graph again, after organizations, folders or
+// projects changed.
+func (v *GcpViz) resolveOrgRoots(ctx context.Context) error {
+	v.OrgRoots = nil
+	err := v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Simple optimization to avoid unmarshaling tons of JSON
+			if !strings.Contains(string(bv), "cloudresourcemanager.googleapis.com/Organization") {
+				return nil
+			}
+			var asset map[string]interface{}
+			if err := json.Unmarshal(bv, &asset); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("unmarshaling asset %s", string(k)))
+			}
+			if stringField(asset, "asset_type") == "cloudresourcemanager.googleapis.com/Organization" {
+				v.OrgRoots = append(v.OrgRoots, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return v.ResolveRoots()
+}
+
+// Watch applies the changes published by a feed to sub to dbFile until ctx is done.
+// Messages are acknowledged once their changes are saved, messages that are not
+// temporal assets are skipped. Afterwards, updated is called (if set) with the saved
+// graph file open read-only, ie. to render a diagram of the graph with GenerateNodes.
+func (v *GcpViz) Watch(ctx context.Context, dbFile string, sub *PubSubSubscription, updated func() error) error {
+	v.progress(ProgressEvent{Phase: PhaseWatch, Message: fmt.Sprintf("Watching %s for changes...", sub.Name)})
+	for {
+		messages, err := sub.Pull(ctx, watchBatchSize)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchPollInterval):
+			}
+			continue
+		}
+
+		changes := make([]*AssetChange, 0, len(messages))
+		ackIds := make([]string, 0, len(messages))
+		for _, message := range messages {
+			ackIds = append(ackIds, message.AckId)
+			change, err := ParseAssetChange(message.Data)
+			if err != nil {
+				v.warn(PhaseWatch, "skipping message %s: %v", message.MessageId, err)
+				continue
+			}
+			changes = append(changes, change)
+		}
+		if len(changes) > 0 {
+			if err = v.Update(dbFile); err != nil {
+				v.Abort()
+				return err
+			}
+			if err = v.ApplyChanges(ctx, changes); err != nil {
+				v.Abort()
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if err = v.Save(); err != nil {
+				v.Abort()
+				return err
+			}
+		}
+
+		// Saved changes are acknowledged even if the watch has been stopped meanwhile
+		ackCtx, cancel := context.WithTimeout(context.Background(), watchAckTimeout)
+		err = sub.Acknowledge(ackCtx, ackIds)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if len(changes) > 0 && updated != nil {
+			if err = v.openReadOnly(dbFile); err != nil {
+				return err
+			}
+			err = updated()
+			v.AssetDatabase.Close()
+			v.AssetDatabase = nil
+			if err != nil {
+				return errors.Wrap(err, "rendering updated graph")
+			}
+		}
+	}
+}